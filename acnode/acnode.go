@@ -8,42 +8,239 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode/utf16"
 
+	"github.com/fsnotify/fsnotify"
+
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
 )
 
+// 敏感词和白名单文件
+const (
+	wordsInFile  = "sensitive_words_in.txt"
+	wordsOutFile = "sensitive_words_out.txt"
+	whiteFile    = "white.txt"
+	aliasFile    = "sensitive_alias.txt" // 别名 一行一个 别名####敏感词 用于拼音、缩写等写法
+)
+
+// 文件改动后等待多久再重新载入,编辑器保存时往往会连续写入多次
+const reloadDelay = 500 * time.Millisecond
+
+// wordList 一个词库文件构建出的AC自动机,norm由规范化后的词构建,供sensitiveNormalize使用
+type wordList struct {
+	raw        *AhoCorasick
+	norm       *AhoCorasick
+	rules      []*wordRule // re:和wc:开头的正则与通配符规则,只在原文上匹配
+	count      int
+	maxLen     int // 最长的词的字数,流式过滤时需要保留的长度
+	maxNormLen int // 规范化后最长的词的字数
+}
+
+// acSet 同一时刻使用的一组词库,重新载入时整体替换,读取时不需要加锁
+type acSet struct {
+	in    *wordList // 入
+	out   *wordList // 出
+	white *wordList // 白名单
+}
+
 // 定义包级别的全局变量
-var ac *AhoCorasick
-var acout *AhoCorasick
-var wac *AhoCorasick
+var current atomic.Pointer[acSet]
+
+// 重新载入时互斥,避免两个文件同时变化时互相覆盖
+var reloadMu sync.Mutex
 
 // init函数用于初始化操作
 func init() {
-	ac = NewAhoCorasick()
-	acout = NewAhoCorasick()
-	wac = NewAhoCorasick()
+	set, err := loadAllWords()
+	if err != nil {
+		log.Fatalf("初始化敏感词库失败：%v", err)
+	}
+	current.Store(set)
+
+	// 移除了启动HTTP服务器的代码
+}
 
-	// 载入敏感词库 入
-	if err := loadWordsIntoAC(ac, "sensitive_words_in.txt"); err != nil {
-		log.Fatalf("初始化敏感入词库失败：%v", err)
-		// 注意，log.Fatalf会调用os.Exit(1)终止程序，因此后面的return不是必须的
+// loadAllWords 读取全部词库文件和别名文件,构建一组新的词库
+func loadAllWords() (*acSet, error) {
+	aliases, count, err := loadAliasFile(aliasFile)
+	if err != nil {
+		return nil, fmtf.Errorf("载入别名%s失败：%v", aliasFile, err)
 	}
+	fmtf.Printf("载入别名%s,共%d个别名\n", aliasFile, count)
 
-	// 载入敏感词库 出
-	if err := loadWordsIntoAC(acout, "sensitive_words_out.txt"); err != nil {
-		log.Fatalf("初始化敏感出词库失败：%v", err)
-		// 注意，log.Fatalf会调用os.Exit(1)终止程序，因此后面的return不是必须的
+	in, err := loadWordsFile(wordsInFile, aliases)
+	if err != nil {
+		return nil, fmtf.Errorf("载入敏感入词库失败：%v", err)
 	}
+	fmtf.Printf("载入敏感入词库%s,共%d个词\n", wordsInFile, in.count)
 
-	// 载入白名单词库
-	if err := loadWordsIntoAC(wac, "white.txt"); err != nil {
-		log.Fatalf("初始化白名单词库失败：%v", err)
-		// 同上，这里的return也不是必须的
+	out, err := loadWordsFile(wordsOutFile, aliases)
+	if err != nil {
+		return nil, fmtf.Errorf("载入敏感出词库失败：%v", err)
 	}
+	fmtf.Printf("载入敏感出词库%s,共%d个词\n", wordsOutFile, out.count)
 
-	// 移除了启动HTTP服务器的代码
+	white, err := loadWordsFile(whiteFile, nil)
+	if err != nil {
+		return nil, fmtf.Errorf("载入白名单词库失败：%v", err)
+	}
+	fmtf.Printf("载入白名单词库%s,共%d个词\n", whiteFile, white.count)
+
+	return &acSet{in: in, out: out, white: white}, nil
+}
+
+// loadWordsFile 从文件构建原文和规范化两个AC自动机,aliases中以该文件的词为目标的别名使用相同的替换文本
+func loadWordsFile(filename string, aliases map[string][]string) (*wordList, error) {
+	list := &wordList{raw: NewAhoCorasick(), norm: NewAhoCorasick()}
+	err := loadWordsIntoAC(filename, func(word, replaceText string) {
+		list.count++
+		if isRuleLine(word) {
+			rule, err := compileRule(word, replaceText)
+			if err != nil {
+				log.Printf("词库%s中的规则%s无效：%v", filename, word, err)
+				list.count--
+				return
+			}
+			list.rules = append(list.rules, rule)
+			list.maxLen = max(list.maxLen, rule.maxLen)
+			return
+		}
+		variants := append([]string{word}, aliases[word]...)
+		for _, variant := range variants {
+			list.raw.Insert(variant, replaceText)
+			if length := len([]rune(variant)); length > list.maxLen {
+				list.maxLen = length
+			}
+
+			// 对于Unicode转义的处理，可能需要根据实际情况调整
+			list.raw.Insert(convertToUnicodeEscape(variant), replaceText)
+
+			// 全部由干扰字符组成的词规范化后为空,只能按原文匹配
+			if normalized := NormalizeString(variant); normalized != "" {
+				list.norm.Insert(normalized, replaceText)
+				if length := len([]rune(normalized)); length > list.maxNormLen {
+					list.maxNormLen = length
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 构建失败指针
+	list.raw.BuildFailPointer()
+	list.norm.BuildFailPointer()
+	return list, nil
+}
+
+// loadAliasFile 读取别名文件,返回 敏感词->别名列表
+func loadAliasFile(filename string) (map[string][]string, int, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		// 如果文件不存在，则创建一个空文件
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, 0, fmtf.Errorf("failed to create the file: %v", err)
+		}
+		file.Close()
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, fmtf.Errorf("failed to open the alias file: %v", err)
+	}
+	defer file.Close()
+
+	aliases := make(map[string][]string)
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "####", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		aliases[parts[1]] = append(aliases[parts[1]], parts[0])
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return aliases, count, nil
+}
+
+// ReloadWords 在后台重新构建全部词库,构建完成后替换,构建失败时继续使用旧的词库
+func ReloadWords() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	set, err := loadAllWords()
+	if err != nil {
+		return err
+	}
+	current.Store(set)
+	return nil
+}
+
+// WatchWordsFiles 监听敏感词、白名单和别名文件,文件变化后重新载入,不需要重启
+func WatchWordsFiles() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal("Error creating watcher:", err)
+	}
+	defer watcher.Close()
+
+	files := []string{wordsInFile, wordsOutFile, whiteFile, aliasFile}
+
+	var timerMu sync.Mutex
+	var timer *time.Timer
+	scheduleReload := func() {
+		timerMu.Lock()
+		defer timerMu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(reloadDelay, func() {
+			fmtf.Println("Detected update to sensitive words, reloading...")
+			if err := ReloadWords(); err != nil {
+				log.Printf("Error reloading sensitive words: %v", err)
+			}
+			// 编辑器保存时可能先删除再创建文件,需要重新监听
+			for _, filename := range files {
+				watcher.Add(filename)
+			}
+		})
+	}
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					scheduleReload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Watcher error:", err)
+			}
+		}
+	}()
+
+	for _, filename := range files {
+		if err := watcher.Add(filename); err != nil {
+			log.Printf("Error adding watcher to file %s: %v", filename, err)
+		}
+	}
+	<-done // Keep the watcher alive
 }
 
 type ACNode struct {
@@ -63,6 +260,7 @@ type Replacement struct {
 	Start int    // 替换起始位置
 	End   int    // 替换结束位置
 	Text  string // 替换文本
+	Rule  string // 命中的正则或通配符规则,词库中的词为空
 }
 
 func NewAhoCorasick() *AhoCorasick {
@@ -112,9 +310,19 @@ func (ac *AhoCorasick) BuildFailPointer() {
 }
 
 func (ac *AhoCorasick) FilterWithWhitelist(text string, whiteListedPositions []Position) string {
+	replacements := ac.findReplacements([]rune(text), whiteListedPositions)
+
+	// 使用applyReplacements函数替换原有的替换逻辑
+	if len(replacements) > 0 {
+		newText := applyReplacements(text, replacements)
+		return newText
+	}
+	return text
+}
+
+// findReplacements 找出runes中所有不在白名单范围内的匹配
+func (ac *AhoCorasick) findReplacements(runes []rune, whiteListedPositions []Position) []Replacement {
 	node := ac.root
-	runes := []rune(text)
-	changes := false // 标记是否有替换发生
 
 	// 创建一个替换列表，用于记录所有替换操作
 	var replacements []Replacement
@@ -145,7 +353,6 @@ func (ac *AhoCorasick) FilterWithWhitelist(text string, whiteListedPositions []P
 						End:   i,
 						Text:  tmp.replaceText, // 使用节点存储的替换文本
 					})
-					changes = true
 					break // 找到匹配，退出循环
 				}
 			}
@@ -153,12 +360,7 @@ func (ac *AhoCorasick) FilterWithWhitelist(text string, whiteListedPositions []P
 		}
 	}
 
-	// 使用applyReplacements函数替换原有的替换逻辑
-	if changes {
-		newText := applyReplacements(text, replacements)
-		return newText
-	}
-	return text
+	return replacements
 }
 
 // 假设Replacement定义如前所述
@@ -248,7 +450,8 @@ func (wac *AhoCorasick) MatchPositions(text string) []Position {
 	return positions
 }
 
-func loadWordsIntoAC(ac *AhoCorasick, filename string) error {
+// loadWordsIntoAC 读取词库文件,对每个词调用insert,没有####替换文本的行会补充默认替换文本并写回文件
+func loadWordsIntoAC(filename string, insert func(word, replaceText string)) error {
 	// 检查文件是否存在
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		// 如果文件不存在，则创建一个空文件
@@ -267,10 +470,12 @@ func loadWordsIntoAC(ac *AhoCorasick, filename string) error {
 
 	// 创建一个临时的buffer来存储修改后的内容
 	var buffer bytes.Buffer
+	var original bytes.Buffer
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
+		original.WriteString(line + "\n")
 		parts := strings.Split(line, "####")
 		word := parts[0]
 		DefaultChangeWord := config.GetDefaultChangeWord()
@@ -286,19 +491,19 @@ func loadWordsIntoAC(ac *AhoCorasick, filename string) error {
 		buffer.WriteString(line + "\n")
 
 		// 插入到AC Trie中
-		ac.Insert(word, replaceText)
-
-		// 对于Unicode转义的处理，可能需要根据实际情况调整
-		unicodeWord := convertToUnicodeEscape(word)
-		ac.Insert(unicodeWord, replaceText)
+		if word != "" {
+			insert(word, replaceText)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		return err
 	}
 
-	// 构建失败指针
-	ac.BuildFailPointer()
+	// 没有补充####的行时不写回,避免写回文件再次触发重新载入
+	if bytes.Equal(buffer.Bytes(), original.Bytes()) {
+		return nil
+	}
 
 	// 将buffer中的内容写回到原文件或新文件中
 	// 如果要覆盖原文件，请先关闭原文件
@@ -324,54 +529,88 @@ func convertToUnicodeEscape(str string) string {
 	return unicodeEscapeBuilder.String()
 }
 
-// 改写后的函数，接受word参数，并返回处理结果
-func CheckWordIN(word string) string {
+// checkWordGuard 检查空文本和过长的文本,ok为false时直接返回result
+func checkWordGuard(word string) (result string, ok bool) {
 	if word == "" {
 		log.Println("错误请求：缺少 'word' 参数")
-		return "错误：缺少 'word' 参数"
+		return "错误：缺少 'word' 参数", false
 	}
 
 	if len([]rune(word)) > 5000 {
 		if strings.Contains(word, "[CQ:image,file=base64://") {
 			// 当word包含特定字符串时原样返回
 			//fmtf.Printf("原样返回的文本：%s", word)
-			return word
+			return word, false
 		}
 		log.Printf("错误请求：字符数超过最大限制（5000字符）。内容：%s", word)
-		return "错误：字符数超过最大限制（5000字符）"
+		return "错误：字符数超过最大限制（5000字符）", false
 	}
 
-	// 使用全局的wac进行白名单匹配
-	whiteListedPositions := wac.MatchPositions(word)
+	return word, true
+}
 
-	// 使用全局的ac进行过滤，并结合白名单
-	result := ac.FilterWithWhitelist(word, whiteListedPositions)
+// 改写后的函数，接受word参数，并返回处理结果
+func CheckWordIN(word string) string {
+	if result, ok := checkWordGuard(word); !ok {
+		return result
+	}
 
-	return result
+	// 使用当前的入词库进行过滤，并结合白名单
+	set := current.Load()
+	return filterWithList([]*wordList{set.in}, []*wordList{set.white}, word)
 }
 
 // 改写后的函数，接受word参数，并返回处理结果
 func CheckWordOUT(word string) string {
-	if word == "" {
-		log.Println("错误请求：缺少 'word' 参数")
-		return "错误：缺少 'word' 参数"
+	if result, ok := checkWordGuard(word); !ok {
+		return result
 	}
 
-	if len([]rune(word)) > 5000 {
-		if strings.Contains(word, "[CQ:image,file=base64://") {
-			// 当word包含特定字符串时原样返回
-			//fmtf.Printf("原样返回的文本：%s", word)
-			return word
-		}
-		log.Printf("错误请求：字符数超过最大限制（5000字符）。内容：%s", word)
-		return "错误：字符数超过最大限制（5000字符）"
+	// 使用当前的出词库进行过滤，并结合白名单
+	set := current.Load()
+	return filterWithList([]*wordList{set.out}, []*wordList{set.white}, word)
+}
+
+// filterWithList 使用词库和白名单过滤文本
+func filterWithList(lists []*wordList, whites []*wordList, word string) string {
+	runes := []rune(word)
+	replacements := findListReplacements(lists, whites, runes)
+	if len(replacements) == 0 {
+		return word
 	}
+	logRuleHits(runes, replacements)
+	return applyReplacements(word, replacements)
+}
 
-	// 使用全局的wac进行白名单匹配
-	whiteListedPositions := wac.MatchPositions(word)
+// findListReplacements 找出原文中需要替换的位置,开启sensitiveNormalize时同时在规范化文本上匹配,并把匹配位置映射回原文
+func findListReplacements(lists []*wordList, whites []*wordList, runes []rune) []Replacement {
+	text := string(runes)
 
-	// 使用全局的ac进行过滤，并结合白名单
-	result := acout.FilterWithWhitelist(word, whiteListedPositions)
+	// 原文匹配,保留对Unicode转义等写法的支持
+	var whiteListedPositions []Position
+	for _, white := range whites {
+		whiteListedPositions = append(whiteListedPositions, white.raw.MatchPositions(text)...)
+		whiteListedPositions = append(whiteListedPositions, rulePositions(white.rules, text)...)
+	}
+	var replacements []Replacement
+	for _, list := range lists {
+		replacements = append(replacements, list.raw.findReplacements(runes, whiteListedPositions)...)
+		replacements = append(replacements, ruleReplacements(list.rules, text, whiteListedPositions)...)
+	}
+	if !config.GetSensitiveNormalize() {
+		return replacements
+	}
 
-	return result
+	// 规范化文本匹配,去除了干扰字符、全角和形近字母
+	normalized, offsets := normalizeText(text)
+	normalizedText := string(normalized)
+	var normWhiteListedPositions []Position
+	for _, white := range whites {
+		normWhiteListedPositions = append(normWhiteListedPositions, white.norm.MatchPositions(normalizedText)...)
+	}
+	for _, list := range lists {
+		normReplacements := list.norm.findReplacements(normalized, normWhiteListedPositions)
+		replacements = append(replacements, mapReplacements(normReplacements, offsets)...)
+	}
+	return replacements
 }
@@ -0,0 +1,170 @@
+package acnode
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 提示词词库的处理方式
+const (
+	DictActionReplace = "replace"
+	DictActionBlock   = "block"
+	DictActionReply   = "reply"
+)
+
+// CheckResult 按提示词词库过滤的结果
+type CheckResult struct {
+	Text    string   // 过滤后的文本
+	Blocked bool     // 是否拦截整条消息
+	Reply   string   // 拦截时的回复,为空代表不回复
+	Hits    []string // 命中的词或规则,用于记录拦截事件
+}
+
+// cachedDict 已经构建好的提示词词库,文件修改时间或大小变化后重新构建
+type cachedDict struct {
+	list    *wordList
+	modTime time.Time
+	size    int64
+}
+
+var (
+	dictCache  sync.Map // 文件名 -> *cachedDict
+	dictLoadMu sync.Mutex
+)
+
+// loadDict 读取提示词词库,没有变化时直接使用缓存
+func loadDict(filename string) (*wordList, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := dictCache.Load(filename); ok {
+		cached := value.(*cachedDict)
+		if cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			return cached.list, nil
+		}
+	}
+
+	dictLoadMu.Lock()
+	defer dictLoadMu.Unlock()
+
+	list, err := loadWordsFile(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 载入时可能补充了####并写回文件,以写回后的状态为准
+	if info, err = os.Stat(filename); err != nil {
+		return nil, err
+	}
+	dictCache.Store(filename, &cachedDict{list: list, modTime: info.ModTime(), size: info.Size()})
+	fmtf.Printf("载入提示词词库%s,共%d个词\n", filename, list.count)
+	return list, nil
+}
+
+// blockDict 拦截整条消息的词库
+type blockDict struct {
+	list *wordList
+	dict structs.SensitiveDict
+}
+
+// resolveDicts 按类型整理全局词库和提示词词库,返回 替换用的词库,拦截用的词库,白名单
+func resolveDicts(set *acSet, dictType string, dicts []structs.SensitiveDict) ([]*wordList, []blockDict, []*wordList) {
+	lists := []*wordList{set.in}
+	if dictType == "out" {
+		lists = []*wordList{set.out}
+	}
+	whites := []*wordList{set.white}
+	var blocks []blockDict
+
+	for _, dict := range dicts {
+		if dict.Type != dictType && dict.Type != "white" {
+			continue
+		}
+		list, err := loadDict(dict.File)
+		if err != nil {
+			log.Printf("载入提示词词库%s失败：%v", dict.File, err)
+			continue
+		}
+		switch {
+		case dict.Type == "white":
+			whites = append(whites, list)
+		case dict.Action == DictActionBlock || dict.Action == DictActionReply:
+			blocks = append(blocks, blockDict{list: list, dict: dict})
+		default:
+			lists = append(lists, list)
+		}
+	}
+	return lists, blocks, whites
+}
+
+// CheckWordINPrompt 使用全局词库和提示词的in词库过滤用户输入
+func CheckWordINPrompt(word string, dicts []structs.SensitiveDict) CheckResult {
+	return checkWordPrompt(word, "in", dicts, true)
+}
+
+// CheckWordOUTPrompt 使用全局词库和提示词的out词库过滤模型输出
+func CheckWordOUTPrompt(word string, dicts []structs.SensitiveDict) CheckResult {
+	return checkWordPrompt(word, "out", dicts, true)
+}
+
+// CheckWordOUTStream 过滤useSse为2时的一段流式消息,只进行替换
+// 之前的段已经发出,无法拦截整条回复,block和reply的词库在这里不生效
+func CheckWordOUTStream(word string, dicts []structs.SensitiveDict) CheckResult {
+	return checkWordPrompt(word, "out", dicts, false)
+}
+
+func checkWordPrompt(word string, dictType string, dicts []structs.SensitiveDict, useBlocks bool) CheckResult {
+	if result, ok := checkWordGuard(word); !ok {
+		return CheckResult{Text: result}
+	}
+
+	lists, blocks, whites := resolveDicts(current.Load(), dictType, dicts)
+	runes := []rune(word)
+	if !useBlocks {
+		blocks = nil
+	}
+
+	// 先检查拦截整条消息的词库
+	for _, block := range blocks {
+		replacements := findListReplacements([]*wordList{block.list}, whites, runes)
+		if len(replacements) == 0 {
+			continue
+		}
+		fmtf.Printf("消息命中拦截词库%s,已拦截:%s\n", block.dict.File, word)
+		result := CheckResult{Text: word, Blocked: true, Hits: replacementHits(runes, replacements)}
+		if block.dict.Action == DictActionReply && len(block.dict.Replies) > 0 {
+			result.Reply = block.dict.Replies[rand.Intn(len(block.dict.Replies))]
+		}
+		return result
+	}
+
+	replacements := findListReplacements(lists, whites, runes)
+	if len(replacements) == 0 {
+		return CheckResult{Text: word}
+	}
+	logRuleHits(runes, replacements)
+	return CheckResult{Text: applyReplacements(word, replacements), Hits: replacementHits(runes, replacements)}
+}
+
+// replacementHits 整理命中的规则或原文中被替换的词,去除重复
+func replacementHits(runes []rune, replacements []Replacement) []string {
+	var hits []string
+	seen := make(map[string]bool)
+	for _, r := range replacements {
+		hit := r.Rule
+		if hit == "" {
+			hit = string(runes[r.Start : r.End+1])
+		}
+		if !seen[hit] {
+			seen[hit] = true
+			hits = append(hits, hit)
+		}
+	}
+	return hits
+}
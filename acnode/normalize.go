@@ -0,0 +1,82 @@
+package acnode
+
+import (
+	"unicode"
+)
+
+// 常见的形近字母,西里尔字母和希腊字母写成的"拉丁字母"统一还原
+var homoglyphs = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	'ℓ': 'l', 'ⅰ': 'i', 'ⅴ': 'v', 'ⅹ': 'x',
+}
+
+// 句末的标点和换行在规范化文本中保留为分界,敏感词不会跨句匹配,如"...学习。近..."
+// 逗号和半角句点常被用来分隔敏感词,仍视为干扰字符
+const sentenceBoundary = '\n'
+
+var sentenceEnds = map[rune]bool{
+	'。': true, '！': true, '？': true, '；': true, '…': true,
+	'!': true, '?': true, ';': true, '\n': true, '\r': true,
+}
+
+// normalizeRune 将单个字符转换为规范形式,返回false代表该字符是用来分隔敏感词的干扰字符,应当忽略
+func normalizeRune(r rune) (rune, bool) {
+	if sentenceEnds[r] {
+		return sentenceBoundary, true
+	}
+
+	// 全角转半角
+	if r >= 0xFF01 && r <= 0xFF5E {
+		r -= 0xFEE0
+	}
+
+	// 空格、零宽字符、组合附加符号、标点和符号都视为干扰字符
+	if unicode.IsSpace(r) || unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Mn, r) {
+		return 0, false
+	}
+	if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+		return 0, false
+	}
+
+	if mapped, ok := homoglyphs[r]; ok {
+		r = mapped
+	}
+	return unicode.ToLower(r), true
+}
+
+// normalizeText 返回规范化后的文本,以及规范化文本中每个字符在原文中的位置
+func normalizeText(text string) ([]rune, []int) {
+	runes := []rune(text)
+	normalized := make([]rune, 0, len(runes))
+	offsets := make([]int, 0, len(runes))
+	for i, r := range runes {
+		if n, ok := normalizeRune(r); ok {
+			normalized = append(normalized, n)
+			offsets = append(offsets, i)
+		}
+	}
+	return normalized, offsets
+}
+
+// NormalizeString 返回文本的规范形式,用于构建规范化词库
+func NormalizeString(text string) string {
+	normalized, _ := normalizeText(text)
+	return string(normalized)
+}
+
+// mapReplacements 将规范化文本上的替换位置映射回原文
+func mapReplacements(replacements []Replacement, offsets []int) []Replacement {
+	mapped := make([]Replacement, len(replacements))
+	for i, r := range replacements {
+		mapped[i] = Replacement{
+			Start: offsets[r.Start],
+			End:   offsets[r.End],
+			Text:  r.Text,
+			Rule:  r.Rule,
+		}
+	}
+	return mapped
+}
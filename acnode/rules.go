@@ -0,0 +1,217 @@
+package acnode
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 词库文件中的规则行前缀
+const (
+	rulePrefixRegex    = "re:" // re:正则表达式####替换文本
+	rulePrefixWildcard = "wc:" // wc:通配符####替换文本 ?=任意1个字 *=任意0到3个字 *{n}=任意0到n个字
+)
+
+// 通配符*默认最多跨越的字数
+const wildcardDefaultGap = 3
+
+// 长度不设上限的规则,流式过滤时最多保留的字数
+const ruleMaxHold = 32
+
+// wordRule 词库中的正则或通配符规则
+type wordRule struct {
+	source      string // 规则原文,用于日志
+	re          *regexp.Regexp
+	replaceText string
+	maxLen      int // 规则可能匹配的最长字数
+}
+
+// ruleMatch 规则在文本中的一次匹配,位置以字为单位,End包含在内
+type ruleMatch struct {
+	Start int
+	End   int
+	rule  *wordRule
+}
+
+// isRuleLine 判断词库中的一行是否是规则
+func isRuleLine(word string) bool {
+	return strings.HasPrefix(word, rulePrefixRegex) || strings.HasPrefix(word, rulePrefixWildcard)
+}
+
+// compileRule 编译一行规则
+func compileRule(word string, replaceText string) (*wordRule, error) {
+	var expr string
+	if strings.HasPrefix(word, rulePrefixRegex) {
+		expr = strings.TrimPrefix(word, rulePrefixRegex)
+	} else {
+		expr = wildcardToRegex(strings.TrimPrefix(word, rulePrefixWildcard))
+	}
+	if expr == "" {
+		return nil, fmtf.Errorf("empty rule")
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	maxLen := regexMaxLen(parsed.Simplify())
+	if maxLen < 0 || maxLen > ruleMaxHold {
+		maxLen = ruleMaxHold
+	}
+
+	return &wordRule{source: word, re: re, replaceText: replaceText, maxLen: maxLen}, nil
+}
+
+// wildcardToRegex 将通配符规则转换为正则表达式,其余字符按字面匹配
+func wildcardToRegex(pattern string) string {
+	var builder strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '?':
+			builder.WriteString(".")
+		case '*':
+			gap := wildcardDefaultGap
+			// *{n} 指定最多跨越的字数
+			if i+1 < len(runes) && runes[i+1] == '{' {
+				if end := strings.IndexRune(string(runes[i+2:]), '}'); end >= 0 {
+					closing := i + 2 + len([]rune(string(runes[i+2:])[:end]))
+					if n, err := strconv.Atoi(string(runes[i+2 : closing])); err == nil && n >= 0 {
+						gap = n
+						i = closing
+					}
+				}
+			}
+			builder.WriteString(".{0," + strconv.Itoa(gap) + "}")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	return builder.String()
+}
+
+// regexMaxLen 计算正则可能匹配的最长字数,没有上限时返回-1
+func regexMaxLen(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return 1
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return 0
+	case syntax.OpCapture:
+		return regexMaxLen(re.Sub[0])
+	case syntax.OpConcat:
+		total := 0
+		for _, sub := range re.Sub {
+			n := regexMaxLen(sub)
+			if n < 0 {
+				return -1
+			}
+			total += n
+		}
+		return total
+	case syntax.OpAlternate:
+		longest := 0
+		for _, sub := range re.Sub {
+			n := regexMaxLen(sub)
+			if n < 0 {
+				return -1
+			}
+			longest = max(longest, n)
+		}
+		return longest
+	case syntax.OpQuest:
+		return regexMaxLen(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return -1
+		}
+		n := regexMaxLen(re.Sub[0])
+		if n < 0 {
+			return -1
+		}
+		return n * re.Max
+	default:
+		// OpStar OpPlus等没有上限
+		return -1
+	}
+}
+
+// findRuleMatches 找出规则在文本中的全部匹配,位置转换为字的位置
+func findRuleMatches(rules []*wordRule, text string) []ruleMatch {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	// 字节位置到字位置的对应关系
+	runeIndex := make([]int, len(text)+1)
+	count := 0
+	for i := range text {
+		runeIndex[i] = count
+		count++
+	}
+	runeIndex[len(text)] = count
+	for i := len(text) - 1; i >= 0; i-- {
+		if !utf8.RuneStart(text[i]) {
+			runeIndex[i] = runeIndex[i+1]
+		}
+	}
+
+	var matches []ruleMatch
+	for _, rule := range rules {
+		for _, loc := range rule.re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			matches = append(matches, ruleMatch{Start: runeIndex[loc[0]], End: runeIndex[loc[1]] - 1, rule: rule})
+		}
+	}
+	return matches
+}
+
+// ruleReplacements 将不在白名单范围内的规则匹配转换为替换
+func ruleReplacements(rules []*wordRule, text string, whiteListedPositions []Position) []Replacement {
+	var replacements []Replacement
+	for _, match := range findRuleMatches(rules, text) {
+		isInWhiteList := false
+		for _, pos := range whiteListedPositions {
+			if match.Start >= pos.Start && match.End <= pos.End {
+				isInWhiteList = true
+				break
+			}
+		}
+		if isInWhiteList {
+			continue
+		}
+		replacements = append(replacements, Replacement{Start: match.Start, End: match.End, Text: match.rule.replaceText, Rule: match.rule.source})
+	}
+	return replacements
+}
+
+// logRuleHits 输出实际应用的替换中命中的规则,流式过滤会反复扫描保留的文本,只在放出时输出
+func logRuleHits(runes []rune, replacements []Replacement) {
+	for _, r := range replacements {
+		if r.Rule != "" {
+			fmtf.Printf("敏感词规则[%s]命中:%s\n", r.Rule, string(runes[r.Start:r.End+1]))
+		}
+	}
+}
+
+// rulePositions 白名单中的规则匹配到的位置
+func rulePositions(rules []*wordRule, text string) []Position {
+	var positions []Position
+	for _, match := range findRuleMatches(rules, text) {
+		positions = append(positions, Position{Start: match.Start, End: match.End})
+	}
+	return positions
+}
@@ -0,0 +1,94 @@
+package acnode
+
+import (
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// StreamFilter 流式输出的敏感词过滤,末尾保留不足以排除匹配的部分,等后续文本到达后再一起判断
+// 避免敏感词被切分到两段流式消息中而漏过滤
+// 拦截整条消息的词库无法用于已经发出的部分,useSse为2时不生效,见CheckWordOUTStream
+type StreamFilter struct {
+	pending []rune
+	dicts   []structs.SensitiveDict
+}
+
+// NewStreamFilter 创建一个流式过滤器,每个流式回复使用一个,dicts为当前提示词的词库
+func NewStreamFilter(dicts []structs.SensitiveDict) *StreamFilter {
+	return &StreamFilter{dicts: dicts}
+}
+
+// Push 追加一段文本,返回已经可以确定不会再与后续文本组成敏感词的部分(已过滤)
+func (f *StreamFilter) Push(text string) string {
+	f.pending = append(f.pending, []rune(text)...)
+	if len(f.pending) == 0 {
+		return ""
+	}
+
+	lists, _, whites := resolveDicts(current.Load(), "out", f.dicts)
+	replacements := findListReplacements(lists, whites, f.pending)
+	cut := safeCut(append(lists, whites...), f.pending)
+
+	// 不在匹配中间切开,已经跨过切分位置的匹配整体留到下一次
+	for moved := true; moved; {
+		moved = false
+		for _, r := range replacements {
+			if r.Start < cut && r.End >= cut {
+				cut = r.Start
+				moved = true
+			}
+		}
+	}
+	if cut <= 0 {
+		return ""
+	}
+
+	var released []Replacement
+	for _, r := range replacements {
+		if r.End < cut {
+			released = append(released, r)
+		}
+	}
+
+	logRuleHits(f.pending, released)
+	text = string(f.pending[:cut])
+	f.pending = append([]rune(nil), f.pending[cut:]...)
+	if len(released) == 0 {
+		return text
+	}
+	return applyReplacements(text, released)
+}
+
+// Flush 流结束时调用,返回剩余的全部文本(已过滤)
+func (f *StreamFilter) Flush() string {
+	if len(f.pending) == 0 {
+		return ""
+	}
+	text := string(f.pending)
+	f.pending = nil
+
+	lists, _, whites := resolveDicts(current.Load(), "out", f.dicts)
+	return filterWithList(lists, whites, text)
+}
+
+// safeCut 返回可以放出的前缀长度,末尾至少保留 最长词字数-1 个字,规范化匹配时按规范化后的字数计算
+func safeCut(lists []*wordList, runes []rune) int {
+	maxLen, maxNormLen := 0, 0
+	for _, list := range lists {
+		maxLen = max(maxLen, list.maxLen)
+		maxNormLen = max(maxNormLen, list.maxNormLen)
+	}
+	cut := len(runes) - max(maxLen-1, 0)
+
+	if config.GetSensitiveNormalize() && maxNormLen > 1 {
+		normHold := maxNormLen - 1
+		_, offsets := normalizeText(string(runes))
+		normCut := 0
+		if len(offsets) > normHold {
+			normCut = offsets[len(offsets)-normHold]
+		}
+		cut = min(cut, normCut)
+	}
+
+	return max(cut, 0)
+}
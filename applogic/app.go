@@ -3,6 +3,7 @@ package applogic
 import (
 	"database/sql"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
@@ -14,6 +15,7 @@ import (
 type App struct {
 	DB     *sql.DB
 	Client *hunyuan.Client
+	trace  atomic.Pointer[simulationTrace] // 离线模拟时记录每轮应用的规则,正常运行时为nil
 }
 
 func (app *App) createConversation(conversationID string) error {
@@ -85,7 +87,8 @@ func (app *App) EnsureEmbeddingsTablesExist() error {
         text TEXT NOT NULL,
         vector BLOB NOT NULL,
         norm FLOAT NOT NULL,
-        group_id INTEGER NOT NULL
+        group_id INTEGER NOT NULL,
+        model_fingerprint TEXT NOT NULL DEFAULT ''
     );`
 
 	_, err := app.DB.Exec(createMessagesTableSQL)
@@ -103,7 +106,11 @@ func (app *App) EnsureEmbeddingsTablesExist() error {
 		return fmtf.Errorf("error creating indexes: %w", err)
 	}
 
-	// 其他创建
+	// 旧版本数据库没有向量指纹列
+	err = app.ensureFingerprintColumn("vector_data")
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -116,7 +123,8 @@ func (app *App) EnsureSensitiveWordsTableExists() error {
         text TEXT NOT NULL,
         vector BLOB NOT NULL,
         norm FLOAT NOT NULL,
-        group_id INTEGER NOT NULL
+        group_id INTEGER NOT NULL,
+        model_fingerprint TEXT NOT NULL DEFAULT ''
     );`
 
 	_, err := app.DB.Exec(createTableSQL)
@@ -134,6 +142,72 @@ func (app *App) EnsureSensitiveWordsTableExists() error {
 		return fmt.Errorf("error creating indexes: %w", err)
 	}
 
+	// 旧版本数据库没有向量指纹列
+	err = app.ensureFingerprintColumn("sensitive_words")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensureColumnExists 检查表中是否存在指定列,不存在则添加,返回是否新添加了该列
+func (app *App) ensureColumnExists(table, column, definition string) (bool, error) {
+	rows, err := app.DB.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return false, fmt.Errorf("error reading table info of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("error scanning table info of %s: %w", table, err)
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("error during table info iteration: %w", err)
+	}
+	rows.Close()
+
+	_, err = app.DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	if err != nil {
+		return false, fmt.Errorf("error adding column %s to %s: %w", column, table, err)
+	}
+	return true, nil
+}
+
+// ensureFingerprintColumn 为向量表补充model_fingerprint列
+// 升级前的向量默认认为是由当前配置生成的,打上当前指纹,之后修改embeddingType需要运行 -reembed
+func (app *App) ensureFingerprintColumn(table string) error {
+	added, err := app.ensureColumnExists(table, "model_fingerprint", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	if added {
+		fingerprint := embeddingFingerprint()
+		_, err = app.DB.Exec(fmt.Sprintf("UPDATE %s SET model_fingerprint = ? WHERE model_fingerprint = '';", table), fingerprint)
+		if err != nil {
+			return fmt.Errorf("error stamping fingerprint on %s: %w", table, err)
+		}
+		fmtf.Printf("已为%s表中的旧向量打上当前向量指纹:%s\n", table, fingerprint)
+	}
+
+	createIndexSQL := fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_model_fingerprint ON %s(model_fingerprint);", table, table)
+	_, err = app.DB.Exec(createIndexSQL)
+	if err != nil {
+		return fmt.Errorf("error creating index on %s(model_fingerprint): %w", table, err)
+	}
 	return nil
 }
 
@@ -0,0 +1,207 @@
+package applogic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 黑名单指令的种类
+const (
+	blacklistCommandNone = iota
+	blacklistCommandAdd
+	blacklistCommandRemove
+	blacklistCommandList
+)
+
+// 黑名单范围的写法
+var blacklistScopes = map[string]string{
+	"user":   moderation.ScopeUser,
+	"用户":     moderation.ScopeUser,
+	"group":  moderation.ScopeGroup,
+	"群":      moderation.ScopeGroup,
+	"频道":     moderation.ScopeGroup,
+	"member": moderation.ScopeMember,
+	"群成员":    moderation.ScopeMember,
+}
+
+// isAdmin 用户是否在blacklistAdmins中,黑名单和向量安全词指令只对管理员生效
+func isAdmin(userID string) bool {
+	for _, admin := range config.GetBlacklistAdmins() {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchBlacklistCommand 判断是否是管理员发出的黑名单指令,返回指令种类和指令后面的参数
+func MatchBlacklistCommand(checkResetCommand string, userID string) (int, string) {
+	if !isAdmin(userID) {
+		return blacklistCommandNone, ""
+	}
+
+	for _, command := range config.GetBlacklistListCommand() {
+		if checkResetCommand == command {
+			return blacklistCommandList, ""
+		}
+	}
+	// 先匹配删除指令,避免 解除拉黑 被 拉黑 之类的短指令误匹配
+	for _, command := range config.GetBlacklistRemoveCommand() {
+		if command != "" && strings.HasPrefix(checkResetCommand, command) {
+			return blacklistCommandRemove, strings.TrimSpace(strings.TrimPrefix(checkResetCommand, command))
+		}
+	}
+	for _, command := range config.GetBlacklistAddCommand() {
+		if command != "" && strings.HasPrefix(checkResetCommand, command) {
+			return blacklistCommandAdd, strings.TrimSpace(strings.TrimPrefix(checkResetCommand, command))
+		}
+	}
+	return blacklistCommandNone, ""
+}
+
+// parseBanDuration 解析黑名单时长,0代表永久,支持Go时长写法和以d或天结尾的天数
+func parseBanDuration(text string) (time.Duration, bool) {
+	if text == "永久" || text == "forever" {
+		return 0, true
+	}
+	for _, suffix := range []string{"d", "天"} {
+		if strings.HasSuffix(text, suffix) {
+			days, err := strconv.Atoi(strings.TrimSuffix(text, suffix))
+			if err != nil || days <= 0 {
+				return 0, false
+			}
+			return time.Duration(days) * 24 * time.Hour, true
+		}
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration <= 0 {
+		return 0, false
+	}
+	return duration, true
+}
+
+// parseBlacklistArgs 解析 范围 ID [时长] [self] [原因]
+func parseBlacklistArgs(arg string, operatorID string, selfid string) (moderation.Entry, error) {
+	fields := strings.Fields(arg)
+	if len(fields) < 2 {
+		return moderation.Entry{}, fmt.Errorf("格式:范围 ID [时长] [self] [原因],范围可选 user group member")
+	}
+
+	scope, ok := blacklistScopes[strings.ToLower(fields[0])]
+	if !ok {
+		return moderation.Entry{}, fmt.Errorf("未知的范围%s,可选 user group member", fields[0])
+	}
+	entry := moderation.Entry{Scope: scope, AddedBy: operatorID}
+	switch scope {
+	case moderation.ScopeUser:
+		entry.UserID = fields[1]
+	case moderation.ScopeGroup:
+		entry.GroupID = fields[1]
+	case moderation.ScopeMember:
+		ids := strings.SplitN(fields[1], "@", 2)
+		if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+			return moderation.Entry{}, fmt.Errorf("群成员请写作 用户ID@群ID")
+		}
+		entry.UserID, entry.GroupID = ids[0], ids[1]
+	}
+
+	// 原因之前可以有时长和self,顺序不限
+	rest := fields[2:]
+	for len(rest) > 0 {
+		if rest[0] == "self" || rest[0] == "本机" {
+			entry.SelfID = selfid
+		} else if duration, ok := parseBanDuration(rest[0]); ok {
+			if duration > 0 {
+				entry.ExpiresAt = time.Now().Add(duration)
+			}
+		} else {
+			break
+		}
+		rest = rest[1:]
+	}
+	entry.Reason = strings.Join(rest, " ")
+	return entry, nil
+}
+
+// formatBlacklistEntry 黑名单列表中的一行
+func formatBlacklistEntry(entry moderation.Entry) string {
+	expires := "永久"
+	if !entry.ExpiresAt.IsZero() {
+		expires = entry.ExpiresAt.Local().Format("2006-01-02 15:04") + "到期"
+	}
+	line := fmt.Sprintf("[%d] %s %s", entry.ID, entry.Target(), expires)
+	if entry.Reason != "" {
+		line += " 原因:" + entry.Reason
+	}
+	if entry.AddedBy != "" {
+		line += " 添加者:" + entry.AddedBy
+	}
+	return line
+}
+
+// buildBlacklistResponse 执行黑名单指令并组合回复
+func buildBlacklistResponse(kind int, arg string, operatorID string, selfid string) string {
+	switch kind {
+	case blacklistCommandList:
+		entries := moderation.ListEntries()
+		if len(entries) == 0 {
+			return "黑名单为空(不含blacklist.txt)"
+		}
+		var builder strings.Builder
+		builder.WriteString("黑名单(不含blacklist.txt):")
+		for _, entry := range entries {
+			builder.WriteString("\n" + formatBlacklistEntry(entry))
+		}
+		return builder.String()
+
+	case blacklistCommandRemove:
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return "请在指令后输入要解除的编号"
+		}
+		entry, found, err := moderation.RemoveEntry(id)
+		if err != nil {
+			fmtf.Printf("解除黑名单时出错:%v\n", err)
+			return "解除失败,请稍后再试"
+		}
+		if !found {
+			return fmt.Sprintf("没有编号为%d的黑名单", id)
+		}
+		if entry.Scope == "" {
+			return fmt.Sprintf("已解除编号%d", id)
+		}
+		return "已解除 " + entry.Target()
+
+	case blacklistCommandAdd:
+		entry, err := parseBlacklistArgs(arg, operatorID, selfid)
+		if err != nil {
+			return err.Error()
+		}
+		entry, err = moderation.AddEntry(entry)
+		if err != nil {
+			fmtf.Printf("添加黑名单时出错:%v\n", err)
+			return "添加失败,请稍后再试"
+		}
+		return "已添加 " + formatBlacklistEntry(entry)
+	}
+	return ""
+}
+
+// handleBlacklistCommand 处理管理员的黑名单指令
+func (app *App) handleBlacklistCommand(msg structs.OnebotGroupMessage, kind int, arg string, promptstr string) {
+	response := buildBlacklistResponse(kind, arg, strconv.FormatInt(msg.UserID, 10), strconv.FormatInt(msg.SelfID, 10))
+	app.sendMemoryResponse(msg, response, promptstr)
+}
+
+// handleBlacklistCommandSP 处理管理员的黑名单指令
+func (app *App) handleBlacklistCommandSP(msg structs.OnebotGroupMessageS, kind int, arg string, promptstr string) {
+	response := buildBlacklistResponse(kind, arg, msg.UserID, strconv.FormatInt(msg.SelfID, 10))
+	app.sendMemoryResponseSP(msg, response, promptstr)
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/google/uuid"
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
-	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
 	"github.com/hoshinonyaruko/gensokyo-llm/utils"
 )
@@ -86,7 +85,7 @@ func (app *App) ChatHandlerGlm(w http.ResponseWriter, r *http.Request) {
 	//根据是否有prompt参数 选择是否载入config.yml的prompt还是prompts文件夹的
 	if promptstr == "" {
 		// 获取系统提示词
-		systemPromptContent := config.SystemPrompt()
+		systemPromptContent := renderConversationTemplate(msg.TemplateVars, promptstr, config.SystemPrompt())
 		if systemPromptContent != "0" {
 			systemPrompt := structs.Message{
 				Text: systemPromptContent,
@@ -112,11 +111,11 @@ func (app *App) ChatHandlerGlm(w http.ResponseWriter, r *http.Request) {
 		for _, pair := range pairs {
 			if pair.Q != "" && pair.A != "" {
 				qMessage := structs.Message{
-					Text: pair.Q,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.Q),
 					Role: pair.RoleQ,
 				}
 				aMessage := structs.Message{
-					Text: pair.A,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.A),
 					Role: pair.RoleA,
 				}
 
@@ -126,7 +125,7 @@ func (app *App) ChatHandlerGlm(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// 只获取系统提示词
-		systemMessage, err := prompt.GetFirstSystemMessageStruct(promptstr)
+		systemMessage, err := templateSystemMessageStruct(msg.TemplateVars, promptstr)
 		if err != nil {
 			fmt.Println("Error:", err)
 		} else {
@@ -151,13 +150,13 @@ func (app *App) ChatHandlerGlm(w http.ResponseWriter, r *http.Request) {
 			// 注意追加的顺序，确保问题在系统提示词之后
 			// 使用...操作符来展开userhistory切片并追加到history切片
 			// 获取系统级预埋的系统自定义QA对
-			systemHistory, err := prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err := templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmtf.Printf("Error getting system history: %v,promptstr[%v]\n", err, promptstr)
 				return
 			}
 			if config.GetEnhancedQA(promptstr) {
-				systemHistory, err := prompt.GetMessagesExcludingSystem(promptstr)
+				systemHistory, err := templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 				if err != nil {
 					fmt.Printf("Error getting system history: %v\n", err)
 					return
@@ -198,7 +197,7 @@ func (app *App) ChatHandlerGlm(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var systemHistory []structs.Message
 		if promptstr != "" {
-			systemHistory, err = prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err = templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmtf.Printf("prompt.GetMessagesExcludingSystem error: %v\n", err)
 			}
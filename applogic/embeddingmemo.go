@@ -0,0 +1,167 @@
+package applogic
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// embeddingLRU 内存中的向量记录,按最近使用淘汰
+type embeddingLRU struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type embeddingLRUEntry struct {
+	key    string
+	vector []float64
+}
+
+var embeddingMemo = &embeddingLRU{
+	items: make(map[string]*list.Element),
+	order: list.New(),
+}
+
+// 每记录这么多条向量检查一次数据库中的数量
+const embeddingMemoTrimEvery = 100
+
+var embeddingMemoStores atomic.Int64
+
+func (c *embeddingLRU) get(key string) ([]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*embeddingLRUEntry).vector, true
+}
+
+func (c *embeddingLRU) put(key string, vector []float64, capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		element.Value.(*embeddingLRUEntry).vector = vector
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(&embeddingLRUEntry{key: key, vector: vector})
+	for c.order.Len() > capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*embeddingLRUEntry).key)
+	}
+}
+
+// EnsureEmbeddingMemoTableExists 向量记录表,保存文本哈希与原始向量,重启后也不需要重新请求向量接口
+func (app *App) EnsureEmbeddingMemoTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS embedding_memo (
+        text_hash TEXT NOT NULL,
+        model TEXT NOT NULL,
+        vector BLOB NOT NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (text_hash, model)
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating embedding_memo table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_embedding_memo_created ON embedding_memo (created_at);`
+	if _, err := app.DB.Exec(createIndexSQL); err != nil {
+		return fmt.Errorf("error creating embedding_memo index: %w", err)
+	}
+	return app.trimEmbeddingMemo(config.GetEmbeddingMemoRows())
+}
+
+// trimEmbeddingMemo 只保留最近记录的max条向量
+func (app *App) trimEmbeddingMemo(max int) error {
+	if max <= 0 {
+		return nil
+	}
+	_, err := app.DB.Exec(`
+    DELETE FROM embedding_memo WHERE rowid NOT IN (
+        SELECT rowid FROM embedding_memo ORDER BY created_at DESC, rowid DESC LIMIT ?
+    )`, max)
+	if err != nil {
+		return fmt.Errorf("error trimming embedding_memo: %w", err)
+	}
+	return nil
+}
+
+func embeddingTextHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupEmbeddingMemo 先查内存再查数据库,数据库命中后放入内存
+func (app *App) lookupEmbeddingMemo(modelID string, text string) ([]float64, bool) {
+	textHash := embeddingTextHash(text)
+	key := modelID + "|" + textHash
+	if vector, ok := embeddingMemo.get(key); ok {
+		return vector, true
+	}
+
+	var data []byte
+	err := app.DB.QueryRow("SELECT vector FROM embedding_memo WHERE text_hash = ? AND model = ?", textHash, modelID).Scan(&data)
+	if err != nil {
+		return nil, false
+	}
+	vector := decodeEmbedding(data)
+	if len(vector) == 0 {
+		return nil, false
+	}
+	embeddingMemo.put(key, vector, config.GetEmbeddingMemoSize())
+	return vector, true
+}
+
+// storeEmbeddingMemo 记录新计算的向量,空向量不记录
+func (app *App) storeEmbeddingMemo(modelID string, text string, vector []float64) {
+	if len(vector) == 0 {
+		return
+	}
+	textHash := embeddingTextHash(text)
+	embeddingMemo.put(modelID+"|"+textHash, vector, config.GetEmbeddingMemoSize())
+
+	_, err := app.DB.Exec("INSERT OR REPLACE INTO embedding_memo (text_hash, model, vector) VALUES (?, ?, ?)", textHash, modelID, encodeEmbedding(vector))
+	if err != nil {
+		fmtf.Printf("记录向量时出错:%v\n", err)
+		return
+	}
+
+	// 每条用户消息都会被记录,定期删除最早的记录,避免数据库无限增长
+	if embeddingMemoStores.Add(1)%embeddingMemoTrimEvery == 0 {
+		if err := app.trimEmbeddingMemo(config.GetEmbeddingMemoRows()); err != nil {
+			fmtf.Printf("清理向量记录时出错:%v\n", err)
+		}
+	}
+}
+
+// encodeEmbedding 原始向量按float64小端序保存,二值化阈值变化后仍然可以使用
+func encodeEmbedding(vector []float64) []byte {
+	data := make([]byte, len(vector)*8)
+	for i, v := range vector {
+		binary.LittleEndian.PutUint64(data[i*8:], math.Float64bits(v))
+	}
+	return data
+}
+
+func decodeEmbedding(data []byte) []float64 {
+	vector := make([]float64, len(data)/8)
+	for i := range vector {
+		vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	return vector
+}
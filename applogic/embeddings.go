@@ -22,67 +22,197 @@ type TextDistance struct {
 	Distance int
 }
 
-func (app *App) CalculateTextEmbedding(text string) ([]float64, error) {
+// embeddingModelID 返回当前向量模型的标识,不同的embeddingType或接口地址产生的向量不能互相比较
+func embeddingModelID() string {
 	embeddingType := config.GetEmbeddingType()
 	switch embeddingType {
 	case 0:
-		return app.CalculateTextEmbeddingHunyuan(text)
+		return "hunyuan"
 	case 1:
-		// 从头构造请求到其他API的接口
-		apiURL := config.GetWenxinEmbeddingUrl()
-		accessToken := config.GetWenxinAccessToken()
+		return "wenxin:" + config.GetWenxinEmbeddingUrl()
+	case 2:
+		return "gpt:" + config.GetGptEmbeddingUrl()
+	default:
+		return fmt.Sprintf("unknown:%d", embeddingType)
+	}
+}
+
+// embeddingFingerprint 返回向量指纹,由向量模型和二值化阈值共同决定,写入每一行向量数据
+func embeddingFingerprint() string {
+	return fmt.Sprintf("%s|vtb=%g", embeddingModelID(), config.GetVToBThreshold())
+}
+
+// CalculateTextEmbedding 计算文本的向量,优先使用内存和数据库中记录过的结果
+func (app *App) CalculateTextEmbedding(text string) ([]float64, error) {
+	if config.GetNoEmbeddingMemo() {
+		return app.calculateTextEmbeddingDirect(text)
+	}
 
-		// 构建请求URL
-		url := fmt.Sprintf("%s?access_token=%s", apiURL, accessToken)
+	modelID := embeddingModelID()
+	if vector, ok := app.lookupEmbeddingMemo(modelID, text); ok {
+		return vector, nil
+	}
 
-		// 构建请求负载
-		payload := map[string]interface{}{
-			"input": []string{text},
-			// 可以添加其他必要的字段
+	vector, err := app.calculateTextEmbeddingDirect(text)
+	if err != nil {
+		return nil, err
+	}
+	app.storeEmbeddingMemo(modelID, text, vector)
+	return vector, nil
+}
+
+// CalculateTextEmbeddings 批量计算文本的向量,返回的顺序与texts一致
+// 记录过的文本直接使用记录,其余文本按embeddingBatchSize分批请求,不支持批量输入的接口逐条请求
+func (app *App) CalculateTextEmbeddings(texts []string) ([][]float64, error) {
+	vectors := make([][]float64, len(texts))
+	useMemo := !config.GetNoEmbeddingMemo()
+	modelID := embeddingModelID()
+
+	// 相同的文本只计算一次
+	pending := make(map[string][]int)
+	var missing []string
+	for i, text := range texts {
+		if useMemo {
+			if vector, ok := app.lookupEmbeddingMemo(modelID, text); ok {
+				vectors[i] = vector
+				continue
+			}
 		}
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			return nil, fmt.Errorf("error marshaling payload: %v", err)
+		if _, ok := pending[text]; !ok {
+			missing = append(missing, text)
 		}
+		pending[text] = append(pending[text], i)
+	}
 
-		// 创建并发送POST请求
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			return nil, fmt.Errorf("error creating request: %v", err)
+	batchSize := config.GetEmbeddingBatchSize()
+	for start := 0; start < len(missing); start += batchSize {
+		end := start + batchSize
+		if end > len(missing) {
+			end = len(missing)
 		}
-		req.Header.Set("Content-Type", "application/json")
+		batch := missing[start:end]
 
-		resp, err := http.DefaultClient.Do(req)
+		batchVectors, err := app.calculateTextEmbeddingsDirect(batch)
 		if err != nil {
-			return nil, fmt.Errorf("error sending request: %v", err)
+			return nil, err
+		}
+		for j, text := range batch {
+			if useMemo {
+				app.storeEmbeddingMemo(modelID, text, batchVectors[j])
+			}
+			for _, i := range pending[text] {
+				vectors[i] = batchVectors[j]
+			}
 		}
-		defer resp.Body.Close()
+	}
+
+	return vectors, nil
+}
 
-		body, err := io.ReadAll(resp.Body)
+// calculateTextEmbeddingDirect 不经过记录,直接请求接口计算单条文本的向量
+func (app *App) calculateTextEmbeddingDirect(text string) ([]float64, error) {
+	if simulating {
+		return nil, errSimulationEmbedding
+	}
+	embeddingType := config.GetEmbeddingType()
+	switch embeddingType {
+	case 0:
+		return app.CalculateTextEmbeddingHunyuan(text)
+	case 1:
+		embeddings, err := app.calculateTextEmbeddingsWenxin([]string{text})
 		if err != nil {
-			return nil, fmt.Errorf("error reading response body: %v", err)
+			return nil, err
 		}
+		return embeddings[0], nil
+	default:
+		return nil, fmt.Errorf("unsupported embedding type: %d", embeddingType)
+	}
+}
 
-		// 解析响应数据
-		var response structs.EmbeddingResponseErnie
-		if err := json.Unmarshal(body, &response); err != nil {
-			return nil, fmt.Errorf("error decoding response: %v", err)
+// calculateTextEmbeddingsDirect 不经过记录,直接请求接口计算一批文本的向量
+func (app *App) calculateTextEmbeddingsDirect(texts []string) ([][]float64, error) {
+	if simulating {
+		return nil, errSimulationEmbedding
+	}
+	embeddingType := config.GetEmbeddingType()
+	switch embeddingType {
+	case 1:
+		// 文心向量接口支持一次输入多条文本
+		return app.calculateTextEmbeddingsWenxin(texts)
+	default:
+		vectors := make([][]float64, len(texts))
+		for i, text := range texts {
+			vector, err := app.calculateTextEmbeddingDirect(text)
+			if err != nil {
+				return nil, fmt.Errorf("计算文本向量时出错 '%s': %w", text, err)
+			}
+			vectors[i] = vector
 		}
+		return vectors, nil
+	}
+}
 
-		// 提取embedding向量
-		var embedding []float64
-		for _, data := range response.Data {
-			embedding = append(embedding, data.Embedding...)
-		}
+// calculateTextEmbeddingsWenxin 调用文心向量接口,一次请求计算多条文本的向量
+func (app *App) calculateTextEmbeddingsWenxin(texts []string) ([][]float64, error) {
+	// 从头构造请求到其他API的接口
+	apiURL := config.GetWenxinEmbeddingUrl()
+	accessToken := config.GetWenxinAccessToken()
 
-		if config.GetPrintVector() {
-			fmt.Printf("百度返回的向量:%v\n", embedding)
+	// 构建请求URL
+	url := fmt.Sprintf("%s?access_token=%s", apiURL, accessToken)
+
+	// 构建请求负载
+	payload := map[string]interface{}{
+		"input": texts,
+		// 可以添加其他必要的字段
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling payload: %v", err)
+	}
+
+	// 创建并发送POST请求
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	// 解析响应数据
+	var response structs.EmbeddingResponseErnie
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	if len(response.Data) != len(texts) {
+		return nil, fmt.Errorf("文心向量接口返回了%d条向量,请求了%d条: %s", len(response.Data), len(texts), string(body))
+	}
+
+	// 按index提取embedding向量
+	embeddings := make([][]float64, len(texts))
+	for i, data := range response.Data {
+		index := data.Index
+		if index < 0 || index >= len(texts) {
+			index = i
 		}
+		embeddings[index] = data.Embedding
+	}
 
-		return embedding, nil
-	default:
-		return nil, fmt.Errorf("unsupported embedding type: %d", embeddingType)
+	if config.GetPrintVector() {
+		fmt.Printf("百度返回的向量:%v\n", embeddings)
 	}
+
+	return embeddings, nil
 }
 
 // CalculateTextEmbedding 调用混元-Embedding接口将文本转换为向量表示。
@@ -239,7 +369,7 @@ func (app *App) insertVectorData(text string, vector []float64) (int64, error) {
 		fmtf.Printf("groupid : %v\n", groupID)
 	}
 
-	result, err := app.DB.Exec("INSERT INTO vector_data (text, vector, norm, group_id) VALUES (?, ?, ?, ?)", text, binaryVector, norm, groupID)
+	result, err := app.DB.Exec("INSERT INTO vector_data (text, vector, norm, group_id, model_fingerprint) VALUES (?, ?, ?, ?, ?)", text, binaryVector, norm, groupID, embeddingFingerprint())
 	if err != nil {
 		return 0, err
 	}
@@ -257,8 +387,10 @@ func (app *App) searchSimilarText(vector []float64, threshold int, targetGroupID
 	binaryVector := vectorToBinaryConcurrent(vector) // 二值化查询向量
 	var results []TextDistance
 	var ids []int
+	fingerprint := embeddingFingerprint()
+	skipped := 0
 
-	rows, err := app.DB.Query("SELECT id, text, vector FROM vector_data WHERE group_id = ?", targetGroupID)
+	rows, err := app.DB.Query("SELECT id, text, vector, model_fingerprint FROM vector_data WHERE group_id = ?", targetGroupID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -268,7 +400,13 @@ func (app *App) searchSimilarText(vector []float64, threshold int, targetGroupID
 		var id int
 		var text string
 		var dbVectorBytes []byte
-		if err := rows.Scan(&id, &text, &dbVectorBytes); err != nil {
+		var dbFingerprint string
+		if err := rows.Scan(&id, &text, &dbVectorBytes, &dbFingerprint); err != nil {
+			continue
+		}
+		// 不同指纹的向量来自不同的模型或二值化阈值,比较汉明距离没有意义
+		if dbFingerprint != fingerprint {
+			skipped++
 			continue
 		}
 		//fmtf.Printf("二值一,%v,二值二,%v", binaryVector, dbVectorBytes)
@@ -282,6 +420,10 @@ func (app *App) searchSimilarText(vector []float64, threshold int, targetGroupID
 		}
 	}
 
+	if skipped > 0 {
+		fmtf.Printf("vector_data中有%d条向量的指纹与当前指纹[%s]不一致,已拒绝比较,请使用 -reembed 参数重新计算向量\n", skipped, fingerprint)
+	}
+
 	// 根据汉明距离对结果进行排序，并保持ids数组与results数组的一致性
 	sort.SliceStable(results, func(i, j int) bool {
 		return results[i].Distance < results[j].Distance
@@ -86,7 +86,7 @@ func (app *App) GetAndSendEnv(msg string, promptstr string, message structs.Oneb
 			return
 		}
 	} else {
-		responseData.Response = processSelection(PromptStrStat, PromptLength, promptstr)
+		responseData.Response = app.renderMessageTemplate(processSelection(PromptStrStat, PromptLength, promptstr), &message, promptstr)
 
 		// 打印或处理 responseData
 		fmt.Println("最终env响应:", responseData.Response)
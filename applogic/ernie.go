@@ -89,11 +89,11 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 		for _, pair := range pairs {
 			if pair.Q != "" && pair.A != "" {
 				qMessage := structs.Message{
-					Text: pair.Q,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.Q),
 					Role: pair.RoleQ,
 				}
 				aMessage := structs.Message{
-					Text: pair.A,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.A),
 					Role: pair.RoleA,
 				}
 
@@ -103,7 +103,7 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// 只获取系统提示词
-		systemMessage, err := prompt.GetFirstSystemMessageStruct(promptstr)
+		systemMessage, err := templateSystemMessageStruct(msg.TemplateVars, promptstr)
 		if err != nil {
 			fmt.Println("Error:", err)
 		} else {
@@ -126,7 +126,7 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 
 		if promptstr != "" {
 			// 获取系统级预埋的系统自定义QA对
-			systemHistory, err := prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err := templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmt.Printf("Error getting system history: %v\n", err)
 				return
@@ -172,7 +172,7 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var systemHistory []structs.Message
 		if promptstr != "" {
-			systemHistory, err = prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err = templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmtf.Printf("prompt.GetMessagesExcludingSystem error: %v\n", err)
 			}
@@ -214,7 +214,7 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 	// 是否从参数中获取prompt
 	if promptstr == "" {
 		// 获取系统提示词，并设置system字段，如果它不为空
-		systemPromptContent := config.SystemPrompt() // 确保函数名正确
+		systemPromptContent := renderConversationTemplate(msg.TemplateVars, promptstr, config.SystemPrompt()) // 确保函数名正确
 		if systemPromptContent != "0" {
 			payload.System = systemPromptContent // 直接在请求负载中设置system字段
 		}
@@ -224,6 +224,7 @@ func (app *App) ChatHandlerErnie(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			fmtf.Printf("prompt.GetFirstSystemMessage error: %v\n", err)
 		}
+		systemPromptContent = renderConversationTemplate(msg.TemplateVars, promptstr, systemPromptContent)
 		if systemPromptContent != "" {
 			payload.System = systemPromptContent // 直接在请求负载中设置system字段
 		}
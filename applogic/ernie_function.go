@@ -85,7 +85,7 @@ func (app *App) ChatHandlerErnieFunction(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 获取系统提示词，并设置system字段，如果它不为空
-	systemPromptContent := config.SystemPrompt() // 确保函数名正确
+	systemPromptContent := renderConversationTemplate(msg.TemplateVars, "", config.SystemPrompt()) // 确保函数名正确
 	if systemPromptContent != "0" {
 		payload.System = systemPromptContent // 直接在请求负载中设置system字段
 	}
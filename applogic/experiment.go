@@ -0,0 +1,291 @@
+package applogic
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 实验统计的事件
+const (
+	experimentEventTurn  = "turn"  // 一轮对话,会话为conversation_id
+	experimentEventReset = "reset" // 重置指令
+	experimentEventGood  = "good"  // 好评
+	experimentEventBad   = "bad"   // 差评
+)
+
+// 与拦截记录的created_at格式一致,统计拦截次数时按分配时间比较
+const experimentTimeLayout = "2006-01-02 15:04:05"
+
+// experimentAssignment 一个用户或群在实验中分配到的变体
+type experimentAssignment struct {
+	Experiment  string
+	Variant     string // 变体的提示词名,为空时为config.yml
+	SubjectType string // user 或 group
+	SubjectID   string
+}
+
+// EnsureExperimentTablesExist 实验分配表和实验事件表
+func (app *App) EnsureExperimentTablesExist() error {
+	createAssignmentsSQL := `
+    CREATE TABLE IF NOT EXISTS experiment_assignments (
+        experiment TEXT NOT NULL,
+        subject_type TEXT NOT NULL,
+        subject_id TEXT NOT NULL,
+        variant TEXT NOT NULL,
+        assigned_at TEXT NOT NULL,
+        PRIMARY KEY (experiment, subject_type, subject_id)
+    );`
+	if _, err := app.DB.Exec(createAssignmentsSQL); err != nil {
+		return fmt.Errorf("error creating experiment_assignments table: %w", err)
+	}
+
+	createEventsSQL := `
+    CREATE TABLE IF NOT EXISTS experiment_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        experiment TEXT NOT NULL,
+        variant TEXT NOT NULL,
+        subject_type TEXT NOT NULL,
+        subject_id TEXT NOT NULL,
+        event TEXT NOT NULL,
+        conversation_id TEXT NOT NULL DEFAULT '',
+        created_at TEXT NOT NULL
+    );`
+	if _, err := app.DB.Exec(createEventsSQL); err != nil {
+		return fmt.Errorf("error creating experiment_events table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_experiment_events ON experiment_events (experiment, variant, event);`
+	if _, err := app.DB.Exec(createIndexSQL); err != nil {
+		return fmt.Errorf("error creating experiment_events index: %w", err)
+	}
+	return nil
+}
+
+// experimentFor 请求的提示词所参与的实验,同一提示词有多个实验时使用第一个
+func experimentFor(promptstr string) (structs.Experiment, bool) {
+	for _, experiment := range config.GetExperiments() {
+		if experiment.Name != "" && experiment.Prompt == promptstr && len(experiment.Variants) > 0 {
+			return experiment, true
+		}
+	}
+	return structs.Experiment{}, false
+}
+
+// experimentSubject 分配的对象,群消息在assignBy为group时按群分配
+func experimentSubject(experiment structs.Experiment, message *structs.OnebotGroupMessage) (string, string) {
+	if experiment.AssignBy == "group" && message.MessageType != "private" && message.GroupID != 0 {
+		return "group", strconv.FormatInt(message.GroupID, 10)
+	}
+	return "user", strconv.FormatInt(message.UserID, 10)
+}
+
+// pickVariant 按实验名和对象的哈希在权重中选择变体,同一对象总是得到同一结果,权重都不大于0时平均分配
+// 使用sha256而不是fnv,fnv的低位混合不充分,对权重之和取模时不同实验的分配几乎相同
+func pickVariant(experiment structs.Experiment, subjectType string, subjectID string) string {
+	total := 0
+	for _, variant := range experiment.Variants {
+		if variant.Weight > 0 {
+			total += variant.Weight
+		}
+	}
+
+	hash := sha256.Sum256([]byte(experiment.Name + ":" + subjectType + ":" + subjectID))
+	sum := binary.BigEndian.Uint64(hash[:8])
+
+	if total == 0 {
+		return experiment.Variants[sum%uint64(len(experiment.Variants))].Prompt
+	}
+	bucket := int(sum % uint64(total))
+	for _, variant := range experiment.Variants {
+		if variant.Weight <= 0 {
+			continue
+		}
+		if bucket < variant.Weight {
+			return variant.Prompt
+		}
+		bucket -= variant.Weight
+	}
+	return experiment.Variants[len(experiment.Variants)-1].Prompt
+}
+
+// hasVariant 变体是否仍在实验配置中
+func hasVariant(experiment structs.Experiment, prompt string) bool {
+	for _, variant := range experiment.Variants {
+		if variant.Prompt == prompt {
+			return true
+		}
+	}
+	return false
+}
+
+// assignExperiment 返回请求的提示词所参与实验的变体,已分配的对象保持原来的变体,变体被移出配置时重新分配
+func (app *App) assignExperiment(message *structs.OnebotGroupMessage, promptstr string) (experimentAssignment, bool) {
+	experiment, ok := experimentFor(promptstr)
+	if !ok {
+		return experimentAssignment{}, false
+	}
+	subjectType, subjectID := experimentSubject(experiment, message)
+	assignment := experimentAssignment{Experiment: experiment.Name, SubjectType: subjectType, SubjectID: subjectID}
+
+	err := app.DB.QueryRow(`SELECT variant FROM experiment_assignments WHERE experiment = ? AND subject_type = ? AND subject_id = ?`,
+		experiment.Name, subjectType, subjectID).Scan(&assignment.Variant)
+	if err == nil && hasVariant(experiment, assignment.Variant) {
+		return assignment, true
+	}
+	if err != nil && err != sql.ErrNoRows {
+		fmtf.Printf("读取实验分配出错:%v\n", err)
+	}
+
+	assignment.Variant = pickVariant(experiment, subjectType, subjectID)
+	_, err = app.DB.Exec(`INSERT OR REPLACE INTO experiment_assignments (experiment, subject_type, subject_id, variant, assigned_at)
+    VALUES (?, ?, ?, ?, ?)`, experiment.Name, subjectType, subjectID, assignment.Variant, time.Now().UTC().Format(experimentTimeLayout))
+	if err != nil {
+		fmtf.Printf("保存实验分配出错:%v\n", err)
+	}
+	fmtf.Printf("实验[%s] %s:%s 分配到变体:%s\n", experiment.Name, subjectType, subjectID, displayPromptstr(assignment.Variant))
+	return assignment, true
+}
+
+// recordExperimentEvent 记录实验统计的事件
+func (app *App) recordExperimentEvent(assignment experimentAssignment, event string, conversationID string) {
+	_, err := app.DB.Exec(`INSERT INTO experiment_events (experiment, variant, subject_type, subject_id, event, conversation_id, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`, assignment.Experiment, assignment.Variant, assignment.SubjectType, assignment.SubjectID,
+		event, conversationID, time.Now().UTC().Format(experimentTimeLayout))
+	if err != nil {
+		fmtf.Printf("记录实验事件出错:%v\n", err)
+	}
+}
+
+// MatchFeedbackCommand 判断是否是好评或差评指令,返回对应的事件,不是时返回空字符串
+func MatchFeedbackCommand(checkResetCommand string) string {
+	for _, command := range config.GetFeedbackGoodCommand() {
+		if checkResetCommand == command {
+			return experimentEventGood
+		}
+	}
+	for _, command := range config.GetFeedbackBadCommand() {
+		if checkResetCommand == command {
+			return experimentEventBad
+		}
+	}
+	return ""
+}
+
+// ExperimentVariantStats 一个变体的统计
+type ExperimentVariantStats struct {
+	Variant        string
+	Subjects       int
+	Sessions       int
+	Turns          int
+	Resets         int
+	ModerationHits int
+	GoodFeedbacks  int
+	BadFeedbacks   int
+}
+
+// GetExperimentStats 实验各变体的统计,拦截次数为分配后该用户或群的拦截记录数
+func (app *App) GetExperimentStats(experiment string) ([]ExperimentVariantStats, error) {
+	rows, err := app.DB.Query(`SELECT variant, COUNT(*) FROM experiment_assignments WHERE experiment = ? GROUP BY variant ORDER BY variant`, experiment)
+	if err != nil {
+		return nil, fmt.Errorf("error querying experiment_assignments: %w", err)
+	}
+	var stats []ExperimentVariantStats
+	for rows.Next() {
+		var stat ExperimentVariantStats
+		if err := rows.Scan(&stat.Variant, &stat.Subjects); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning experiment_assignments: %w", err)
+		}
+		stats = append(stats, stat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range stats {
+		stat := &stats[i]
+		err := app.DB.QueryRow(`
+        SELECT COUNT(DISTINCT CASE WHEN event = ? THEN conversation_id END),
+            COALESCE(SUM(event = ?), 0), COALESCE(SUM(event = ?), 0),
+            COALESCE(SUM(event = ?), 0), COALESCE(SUM(event = ?), 0)
+        FROM experiment_events WHERE experiment = ? AND variant = ?`,
+			experimentEventTurn, experimentEventTurn, experimentEventReset, experimentEventGood, experimentEventBad,
+			experiment, stat.Variant).Scan(&stat.Sessions, &stat.Turns, &stat.Resets, &stat.GoodFeedbacks, &stat.BadFeedbacks)
+		if err != nil {
+			return nil, fmt.Errorf("error querying experiment_events: %w", err)
+		}
+
+		// 没有开启拦截记录时为0
+		err = app.DB.QueryRow(`
+        SELECT COUNT(*) FROM moderation_events m JOIN experiment_assignments a
+            ON a.experiment = ? AND a.variant = ? AND m.created_at >= a.assigned_at
+            AND ((a.subject_type = 'user' AND m.user_id = a.subject_id) OR (a.subject_type = 'group' AND m.group_id = a.subject_id))`,
+			experiment, stat.Variant).Scan(&stat.ModerationHits)
+		if err != nil {
+			return nil, fmt.Errorf("error querying moderation_events: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+// PrintExperimentReport 输出实验的统计,name为空时输出config.yml中的全部实验,用于 -experiment-report
+func (app *App) PrintExperimentReport(name string) error {
+	experiments := config.GetExperiments()
+	if name != "" {
+		experiments = []structs.Experiment{{Name: name}}
+		for _, experiment := range config.GetExperiments() {
+			if experiment.Name == name {
+				experiments = []structs.Experiment{experiment}
+			}
+		}
+	}
+	if len(experiments) == 0 {
+		fmtf.Println("没有设置实验")
+		return nil
+	}
+
+	for _, experiment := range experiments {
+		weights := make(map[string]int)
+		for _, variant := range experiment.Variants {
+			weights[variant.Prompt] = variant.Weight
+		}
+		fmtf.Printf("实验[%s] 提示词:%s\n", experiment.Name, displayPromptstr(experiment.Prompt))
+
+		stats, err := app.GetExperimentStats(experiment.Name)
+		if err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			fmtf.Println("  还没有分配记录")
+			continue
+		}
+		for _, stat := range stats {
+			weight := "已移出配置"
+			if w, ok := weights[stat.Variant]; ok {
+				weight = fmt.Sprintf("权重%d", w)
+			}
+			fmtf.Printf("  [%s] %s 对象:%d 会话:%d 对话:%d 每会话对话:%.2f 重置:%d 重置率:%.2f 拦截:%d 好评:%d 差评:%d\n",
+				displayPromptstr(stat.Variant), weight, stat.Subjects, stat.Sessions, stat.Turns,
+				ratio(stat.Turns, stat.Sessions), stat.Resets, ratio(stat.Resets, stat.Sessions),
+				stat.ModerationHits, stat.GoodFeedbacks, stat.BadFeedbacks)
+		}
+	}
+	return nil
+}
+
+// ratio 除数为0时返回0
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
@@ -0,0 +1,103 @@
+package applogic
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// variantShares 给subjects个用户分配变体,返回每个变体的比例
+func variantShares(experiment structs.Experiment, subjects int) map[string]float64 {
+	counts := make(map[string]int)
+	for i := 0; i < subjects; i++ {
+		counts[pickVariant(experiment, "user", strconv.Itoa(100000+i*7))]++
+	}
+	shares := make(map[string]float64)
+	for variant, count := range counts {
+		shares[variant] = float64(count) / float64(subjects)
+	}
+	return shares
+}
+
+func TestPickVariantIsSticky(t *testing.T) {
+	experiment := structs.Experiment{
+		Name:     "persona",
+		Variants: []structs.ExperimentVariant{{Prompt: "", Weight: 1}, {Prompt: "v2", Weight: 1}},
+	}
+	for i := 0; i < 200; i++ {
+		id := strconv.Itoa(i)
+		first := pickVariant(experiment, "user", id)
+		for j := 0; j < 3; j++ {
+			if again := pickVariant(experiment, "user", id); again != first {
+				t.Fatalf("user %s got %q then %q", id, first, again)
+			}
+		}
+	}
+}
+
+func TestPickVariantFollowsWeights(t *testing.T) {
+	experiment := structs.Experiment{
+		Name: "persona",
+		Variants: []structs.ExperimentVariant{
+			{Prompt: "", Weight: 1},
+			{Prompt: "off", Weight: 0},
+			{Prompt: "v2", Weight: 3},
+		},
+	}
+	shares := variantShares(experiment, 20000)
+	// 权重为0的变体暂停分配
+	if shares["off"] != 0 {
+		t.Errorf("zero-weight variant got %.3f of subjects", shares["off"])
+	}
+	if math.Abs(shares[""]-0.25) > 0.03 || math.Abs(shares["v2"]-0.75) > 0.03 {
+		t.Errorf("shares = %v, want about 25%% config.yml and 75%% v2", shares)
+	}
+}
+
+func TestPickVariantWithoutWeights(t *testing.T) {
+	experiment := structs.Experiment{
+		Name:     "persona",
+		Variants: []structs.ExperimentVariant{{Prompt: "a"}, {Prompt: "b"}},
+	}
+	shares := variantShares(experiment, 20000)
+	if math.Abs(shares["a"]-0.5) > 0.03 || math.Abs(shares["b"]-0.5) > 0.03 {
+		t.Errorf("shares = %v, want an even split", shares)
+	}
+}
+
+func TestExperimentSubject(t *testing.T) {
+	byGroup := structs.Experiment{Name: "persona", AssignBy: "group"}
+	group := &structs.OnebotGroupMessage{MessageType: "group", GroupID: 789, UserID: 123}
+	private := &structs.OnebotGroupMessage{MessageType: "private", UserID: 123}
+
+	if kind, id := experimentSubject(byGroup, group); kind != "group" || id != "789" {
+		t.Errorf("group message assigned by %s %s, want group 789", kind, id)
+	}
+	// 私聊没有群,仍然按用户分配
+	if kind, id := experimentSubject(byGroup, private); kind != "user" || id != "123" {
+		t.Errorf("private message assigned by %s %s, want user 123", kind, id)
+	}
+	if kind, id := experimentSubject(structs.Experiment{Name: "persona"}, group); kind != "user" || id != "123" {
+		t.Errorf("default assignment by %s %s, want user 123", kind, id)
+	}
+}
+
+func TestPickVariantIndependentAcrossExperiments(t *testing.T) {
+	variants := []structs.ExperimentVariant{{Prompt: "a", Weight: 1}, {Prompt: "b", Weight: 1}}
+	first := structs.Experiment{Name: "persona", Variants: variants}
+	second := structs.Experiment{Name: "greeting", Variants: variants}
+
+	// 同时进行的两个实验分配应当互不相关,约一半的用户在两个实验中分到不同的变体
+	differ := 0
+	for i := 0; i < 1000; i++ {
+		id := strconv.Itoa(i)
+		if pickVariant(first, "user", id) != pickVariant(second, "user", id) {
+			differ++
+		}
+	}
+	if differ < 400 || differ > 600 {
+		t.Errorf("%d of 1000 users got different variants in the two experiments", differ)
+	}
+}
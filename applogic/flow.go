@@ -3,7 +3,6 @@ package applogic
 import (
 	"fmt"
 	"math/rand"
-	"strings"
 
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
@@ -33,7 +32,7 @@ func (app *App) ApplyPromptChoiceQ(promptstr string, requestmsg *string, message
 			if len(systemHistory) > 0 {
 				lastSystemMessage := systemHistory[len(systemHistory)-2] // 获取最后一个系统消息
 				// 将最后一个系统历史消息附加到用户消息后
-				*requestmsg += " (" + lastSystemMessage.Text + ")"
+				*requestmsg += " (" + app.renderMessageTemplate(lastSystemMessage.Text, message, promptstr) + ")"
 			}
 		} else {
 			var ischange bool
@@ -61,21 +60,15 @@ func (app *App) ApplyPromptChoiceQ(promptstr string, requestmsg *string, message
 					} else {
 						bestMatchCount := 0
 						bestText := ""
-						// 遍历每组触发词设置
-						for _, keyword := range choice.Keywords {
-							matchCount := 0
-							if strings.Contains(*requestmsg, keyword) {
-								matchCount++
-							}
-							// 如果当前组的匹配数量最高，更新最佳文本
-							if matchCount > bestMatchCount {
-								bestMatchCount = matchCount
-								bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
-							}
+						// 遍历每组触发词设置,支持正则、排除词和语义例句
+						if matched := app.matchTriggers(*requestmsg, choice.Keywords, fmt.Sprintf("%s promptChoicesQ 第%d轮", promptstr, choice.Round)); len(matched) > 0 {
+							bestMatchCount = len(matched)
+							bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
 						}
 						// 如果找到了有效的触发词组合，附加最佳文本到消息中
 						if bestMatchCount > 0 {
-							*requestmsg += " (" + bestText + ")"
+							*requestmsg += " (" + app.renderMessageTemplate(bestText, message, promptstr) + ")"
+							app.traceRule("promptChoicesQ 第%d轮 %v: %s", choice.Round, choice.Keywords, bestText)
 
 						}
 					}
@@ -85,7 +78,9 @@ func (app *App) ApplyPromptChoiceQ(promptstr string, requestmsg *string, message
 			// 处理 randomChoices 中的随机选择 从符合轮次的里选一个 如果选出的包含多个 就再随机选一个
 			if len(randomChoices) > 0 {
 				selectedChoice := randomChoices[rand.Intn(len(randomChoices))]
-				*requestmsg += " (" + selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))] + ")"
+				selectedText := selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))]
+				*requestmsg += " (" + app.renderMessageTemplate(selectedText, message, promptstr) + ")"
+				app.traceRule("promptChoicesQ 第%d轮 随机: %s", selectedChoice.Round, selectedText)
 			}
 
 			// 如果内容没有改变,回滚到用最后一个Q来加入对话中
@@ -101,7 +96,7 @@ func (app *App) ApplyPromptChoiceQ(promptstr string, requestmsg *string, message
 				if len(systemHistory) > 0 {
 					lastSystemMessage := systemHistory[len(systemHistory)-2] // 获取最后一个系统消息
 					// 将最后一个系统历史消息附加到用户消息后
-					*requestmsg += " (" + lastSystemMessage.Text + ")"
+					*requestmsg += " (" + app.renderMessageTemplate(lastSystemMessage.Text, message, promptstr) + ")"
 				}
 			}
 		}
@@ -147,22 +142,16 @@ func (app *App) ApplyPromptCoverQ(promptstr string, requestmsg *string, message
 					} else {
 						bestMatchCount := 0
 						bestText := ""
-						// 遍历每组触发词设置
-						for _, keyword := range choice.Keywords {
-							matchCount := 0
-							if strings.Contains(*requestmsg, keyword) {
-								matchCount++
-							}
-							// 如果当前组的匹配数量最高，更新最佳文本
-							if matchCount > bestMatchCount {
-								bestMatchCount = matchCount
-								bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
-							}
+						// 遍历每组触发词设置,支持正则、排除词和语义例句
+						if matched := app.matchTriggers(*requestmsg, choice.Keywords, fmt.Sprintf("%s promptCoverQ 第%d轮", promptstr, choice.Round)); len(matched) > 0 {
+							bestMatchCount = len(matched)
+							bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
 						}
 						// 如果找到了有效的触发词组合，附加最佳文本到消息中
 						if bestMatchCount > 0 {
-							*requestmsg = bestText
+							*requestmsg = app.renderMessageTemplate(bestText, message, promptstr)
 							ischange = true
+							app.traceRule("promptCoverQ 第%d轮 %v: %s", choice.Round, choice.Keywords, bestText)
 						}
 					}
 				}
@@ -171,8 +160,10 @@ func (app *App) ApplyPromptCoverQ(promptstr string, requestmsg *string, message
 			// 处理 randomChoices 中的随机选择 从符合轮次的里选一个 如果选出的包含多个 就再随机选一个
 			if len(randomChoices) > 0 {
 				selectedChoice := randomChoices[rand.Intn(len(randomChoices))]
-				*requestmsg = selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))]
+				selectedText := selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))]
+				*requestmsg = app.renderMessageTemplate(selectedText, message, promptstr)
 				ischange = true
+				app.traceRule("promptCoverQ 第%d轮 随机: %s", selectedChoice.Round, selectedText)
 			}
 
 			// 如果内容没有改变,回滚到用最后一个Q来覆盖对话中
@@ -188,7 +179,7 @@ func (app *App) ApplyPromptCoverQ(promptstr string, requestmsg *string, message
 				if len(systemHistory) > 0 {
 					lastSystemMessage := systemHistory[len(systemHistory)-2] // 获取最后一个系统消息
 					// 将最后一个系统历史消息覆盖用户消息
-					*requestmsg = lastSystemMessage.Text
+					*requestmsg = app.renderMessageTemplate(lastSystemMessage.Text, message, promptstr)
 				}
 			}
 		}
@@ -222,24 +213,17 @@ func (app *App) ApplySwitchOnQ(promptstr *string, requestmsg *string, message *s
 		// 遍历所有的PromptSwitch配置项
 		var randomChoices []structs.PromptSwitch
 		for _, choice := range promptstrChoices {
-			if choice.Round == currentRound {
+			if choice.Round == currentRound && app.storyConditionMet(userid, choice.Condition, fmt.Sprintf("%s switchOnQ 第%d轮", *promptstr, choice.Round)) {
 				if len(choice.Keywords) == 0 {
 					// Keywords为空，收集所有符合条件的Switch
 					randomChoices = append(randomChoices, choice)
 				} else {
 					bestMatchCount := 0
 					var bestText string
-					// 遍历每组关键词设置
-					for _, keyword := range choice.Keywords {
-						matchCount := 0
-						if strings.Contains(*requestmsg, keyword) {
-							matchCount++
-						}
-						// 如果当前组的匹配数量最高，更新最佳文本
-						if matchCount > bestMatchCount {
-							bestMatchCount = matchCount
-							bestText = choice.Switch[rand.Intn(len(choice.Switch))]
-						}
+					// 遍历每组触发词设置,支持正则、排除词和语义例句
+					if matched := app.matchTriggers(*requestmsg, choice.Keywords, fmt.Sprintf("%s switchOnQ 第%d轮", *promptstr, choice.Round)); len(matched) > 0 {
+						bestMatchCount = len(matched)
+						bestText = choice.Switch[rand.Intn(len(choice.Switch))]
 					}
 					// 如果找到了有效的触发词组合，修改分支
 					if bestMatchCount > 0 {
@@ -248,6 +232,7 @@ func (app *App) ApplySwitchOnQ(promptstr *string, requestmsg *string, message *s
 						PromptMarksLength := config.GetPromptMarksLength(*promptstr)
 						app.InsertCustomTableRecord(userid, *promptstr, PromptMarksLength)
 						fmt.Printf("根据关键词切换prompt为: %s, newPromptStrStat: %d\n", *promptstr, PromptMarksLength)
+						app.traceRule("switchOnQ 第%d轮 %v: 切换到%s", choice.Round, choice.Keywords, *promptstr)
 						// 应用 PromptChoiceQ
 						app.ApplyPromptChoiceQ(*promptstr, requestmsg, message)
 					}
@@ -264,6 +249,7 @@ func (app *App) ApplySwitchOnQ(promptstr *string, requestmsg *string, message *s
 			PromptMarksLength := config.GetPromptMarksLength(*promptstr)
 			app.InsertCustomTableRecord(userid, *promptstr, PromptMarksLength)
 			fmt.Printf("随机选择prompt为: %s, newPromptStrStat: %d\n", *promptstr, PromptMarksLength)
+			app.traceRule("switchOnQ 第%d轮 随机: 切换到%s", selectedChoice.Round, *promptstr)
 			// 应用 PromptChoiceQ
 			app.ApplyPromptChoiceQ(*promptstr, requestmsg, message)
 		}
@@ -302,17 +288,10 @@ func (app *App) ProcessExitChoicesQ(promptstr string, requestmsg *string, messag
 		if choice.Round == currentRound {
 			bestMatchCount := 0
 			bestText := ""
-			// 遍历每组触发词设置
-			for _, keyword := range choice.Keywords {
-				matchCount := 0
-				if strings.Contains(*requestmsg, keyword) {
-					matchCount++
-				}
-				// 如果当前组的匹配数量最高，更新最佳文本
-				if matchCount > bestMatchCount {
-					bestMatchCount = matchCount
-					bestText = keyword
-				}
+			// 遍历每组触发词设置,支持正则、排除词和语义例句
+			if matched := app.matchTriggers(*requestmsg, choice.Keywords, fmt.Sprintf("%s exitOnQ 第%d轮", promptstr, choice.Round)); len(matched) > 0 {
+				bestMatchCount = len(matched)
+				bestText = matched[0]
 			}
 			// 如果找到了有效的触发词组合，就退出分支
 			if bestMatchCount > 0 {
@@ -331,6 +310,7 @@ func (app *App) HandleExit(exitText string, message *structs.OnebotGroupMessage,
 	}
 
 	fmt.Printf("处理重置操作on:%v", exitText)
+	app.traceRule("退出: %s", exitText)
 	app.migrateUserToNewContext(userid)
 	RestoreResponse := config.GetRandomRestoreResponses()
 	if message.RealMessageType == "group_private" || message.MessageType == "private" {
@@ -343,6 +323,7 @@ func (app *App) HandleExit(exitText string, message *structs.OnebotGroupMessage,
 		utils.SendGroupMessage(message.GroupID, message.UserID, RestoreResponse, selfid, promptstr)
 	}
 	app.deleteCustomRecord(userid)
+	app.deleteStoryVars(userid)
 }
 
 // ProcessExitChoicesA 处理基于关键词的退出逻辑。
@@ -376,17 +357,10 @@ func (app *App) ProcessExitChoicesA(promptstr string, response *string, message
 		if choice.Round == currentRound {
 			bestMatchCount := 0
 			bestText := ""
-			// 遍历每组触发词设置
-			for _, keyword := range choice.Keywords {
-				matchCount := 0
-				if strings.Contains(*response, keyword) {
-					matchCount++
-				}
-				// 如果当前组的匹配数量最高，更新最佳文本
-				if matchCount > bestMatchCount {
-					bestMatchCount = matchCount
-					bestText = keyword
-				}
+			// 遍历每组触发词设置,支持正则、排除词和语义例句
+			if matched := app.matchTriggers(*response, choice.Keywords, fmt.Sprintf("%s exitOnA 第%d轮", promptstr, choice.Round)); len(matched) > 0 {
+				bestMatchCount = len(matched)
+				bestText = matched[0]
 			}
 			// 如果找到了有效的触发词组合，就退出分支
 			if bestMatchCount > 0 {
@@ -424,24 +398,17 @@ func (app *App) ApplySwitchOnA(promptstr *string, response *string, message *str
 		// 遍历所有的PromptSwitch配置项
 		var randomChoices []structs.PromptSwitch
 		for _, choice := range promptstrChoices {
-			if choice.Round == currentRound {
+			if choice.Round == currentRound && app.storyConditionMet(userid, choice.Condition, fmt.Sprintf("%s switchOnA 第%d轮", *promptstr, choice.Round)) {
 				if len(choice.Keywords) == 0 {
 					// Keywords为空，收集所有符合条件的Switch
 					randomChoices = append(randomChoices, choice)
 				} else {
 					bestMatchCount := 0
 					var bestText string
-					// 遍历每组关键词设置
-					for _, keyword := range choice.Keywords {
-						matchCount := 0
-						if strings.Contains(*response, keyword) {
-							matchCount++
-						}
-						// 如果当前组的匹配数量最高，更新最佳文本
-						if matchCount > bestMatchCount {
-							bestMatchCount = matchCount
-							bestText = choice.Switch[rand.Intn(len(choice.Switch))]
-						}
+					// 遍历每组触发词设置,支持正则、排除词和语义例句
+					if matched := app.matchTriggers(*response, choice.Keywords, fmt.Sprintf("%s switchOnA 第%d轮", *promptstr, choice.Round)); len(matched) > 0 {
+						bestMatchCount = len(matched)
+						bestText = choice.Switch[rand.Intn(len(choice.Switch))]
 					}
 					// 如果找到了有效的触发词组合，修改分支
 					if bestMatchCount > 0 {
@@ -450,6 +417,7 @@ func (app *App) ApplySwitchOnA(promptstr *string, response *string, message *str
 						PromptMarksLength := config.GetPromptMarksLength(*promptstr)
 						app.InsertCustomTableRecord(userid, *promptstr, PromptMarksLength)
 						fmt.Printf("根据关键词切换prompt为: %s, newPromptStrStat: %d\n", *promptstr, PromptMarksLength)
+						app.traceRule("switchOnA 第%d轮 %v: 切换到%s", choice.Round, choice.Keywords, *promptstr)
 					}
 				}
 			}
@@ -464,6 +432,7 @@ func (app *App) ApplySwitchOnA(promptstr *string, response *string, message *str
 			PromptMarksLength := config.GetPromptMarksLength(*promptstr)
 			app.InsertCustomTableRecord(userid, *promptstr, PromptMarksLength)
 			fmt.Printf("随机选择prompt为: %s, newPromptStrStat: %d\n", *promptstr, PromptMarksLength)
+			app.traceRule("switchOnA 第%d轮 随机: 切换到%s", selectedChoice.Round, *promptstr)
 		}
 	}
 }
@@ -488,7 +457,7 @@ func (app *App) ApplyPromptChoiceA(promptstr string, response string, message *s
 		if len(systemHistory) > 0 {
 			lastSystemMessage := systemHistory[len(systemHistory)-1] // 获取最后一个消息 角色是assistant
 			// 将最后一个系统历史消息附加到用户消息后
-			return " (" + lastSystemMessage.Text + ")"
+			return " (" + app.renderMessageTemplate(lastSystemMessage.Text, message, promptstr) + ")"
 		}
 		// 如果systemHistory没有内容 且 promptChoices 长度是0
 		return ""
@@ -518,21 +487,15 @@ func (app *App) ApplyPromptChoiceA(promptstr string, response string, message *s
 			} else {
 				bestMatchCount := 0
 				bestText := ""
-				// 遍历每组触发词设置
-				for _, keyword := range choice.Keywords {
-					matchCount := 0
-					if strings.Contains(response, keyword) {
-						matchCount++
-					}
-					// 如果当前组的匹配数量最高，更新最佳文本
-					if matchCount > bestMatchCount {
-						bestMatchCount = matchCount
-						bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
-					}
+				// 遍历每组触发词设置,支持正则、排除词和语义例句
+				if matched := app.matchTriggers(response, choice.Keywords, fmt.Sprintf("%s promptChoicesA 第%d轮", promptstr, choice.Round)); len(matched) > 0 {
+					bestMatchCount = len(matched)
+					bestText = choice.ReplaceText[rand.Intn(len(choice.ReplaceText))]
 				}
 				// 如果找到了有效的触发词组合，返回最佳文本，会附加到当前的llm回复后方
 				if bestMatchCount > 0 {
-					return "(" + bestText + ")"
+					app.traceRule("promptChoicesA 第%d轮 %v: %s", choice.Round, choice.Keywords, bestText)
+					return "(" + app.renderMessageTemplate(bestText, message, promptstr) + ")"
 
 				}
 			}
@@ -542,7 +505,9 @@ func (app *App) ApplyPromptChoiceA(promptstr string, response string, message *s
 	// 处理 randomChoices 中的随机选择 从符合轮次的里选一个 如果选出的包含多个 就再随机选一个
 	if len(randomChoices) > 0 {
 		selectedChoice := randomChoices[rand.Intn(len(randomChoices))]
-		return " (" + selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))] + ")"
+		selectedText := selectedChoice.ReplaceText[rand.Intn(len(selectedChoice.ReplaceText))]
+		app.traceRule("promptChoicesA 第%d轮 随机: %s", selectedChoice.Round, selectedText)
+		return " (" + app.renderMessageTemplate(selectedText, message, promptstr) + ")"
 	}
 
 	// 默认 没有匹配到任何内容时
@@ -559,6 +524,7 @@ func (app *App) ApplyPromptChanceQ(promptstr string, requestmsg *string, message
 		// 基于概率进行计算
 		if rand.Intn(100) < chance.Probability {
 			*requestmsg += " (" + chance.Text + ")"
+			app.traceRule("promptChanceQ %d%%: %s", chance.Probability, chance.Text)
 		}
 	}
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
 	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
 	"github.com/hoshinonyaruko/gensokyo-llm/promptkb"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
@@ -167,6 +168,12 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 		fmtf.Printf("收到prompt参数: %s\n", promptstr)
 	}
 
+	// A/B实验 在读取剧情存档之前,按用户或群把请求的提示词替换为分配到的变体
+	experiment, inExperiment := app.assignExperiment(&message, promptstr)
+	if inExperiment {
+		promptstr = experiment.Variant
+	}
+
 	var lockPrompt bool
 	// 读取URL参数 "lock_prompt"
 	lockPromptValue := r.URL.Query().Get("lock_prompt")
@@ -276,7 +283,8 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 
 			// 提示词之间流转 达到信号量
 			if PromptStrStat-1 <= 0 {
-				PromptMarks := config.GetPromptMarks(promptstr)
+				// 只从满足数值变量条件的分支中选择
+				PromptMarks := app.availablePromptMarks(storyUserID(&message), promptstr)
 				if len(PromptMarks) != 0 {
 					randomIndex := rand.Intn(len(PromptMarks))
 					selectedBranch := PromptMarks[randomIndex]
@@ -290,6 +298,7 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 					}
 
 					fmt.Printf("流转prompt参数: %s, newPromptStrStat: %d\n", newPromptStr, 1)
+					app.traceRule("promptMarks 满%d轮: 切换到%s", config.GetPromptMarksLength(promptstr), newPromptStr)
 					promptstr = newPromptStr
 				}
 			}
@@ -389,12 +398,15 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 		//处理重置指令
 		if isResetCommand {
 			fmtf.Println("处理重置操作")
+			if inExperiment {
+				app.recordExperimentEvent(experiment, experimentEventReset, "")
+			}
 			if config.GetGroupContext() == 2 && message.MessageType != "private" {
 				app.migrateUserToNewContext(message.GroupID + message.SelfID)
 			} else {
 				app.migrateUserToNewContext(message.UserID + message.SelfID)
 			}
-			RestoreResponse := config.GetRandomRestoreResponses()
+			RestoreResponse := app.renderMessageTemplate(config.GetRandomRestoreResponses(), &message, promptstr)
 			if message.RealMessageType == "group_private" || message.MessageType == "private" {
 				if !config.GetUsePrivateSSE() {
 					utils.SendPrivateMessage(message.UserID, RestoreResponse, selfid, promptstr)
@@ -407,8 +419,10 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			// 处理故事情节的重置
 			if config.GetGroupContext() == 2 && message.MessageType != "private" {
 				app.deleteCustomRecord(message.GroupID + message.SelfID)
+				app.deleteStoryVars(message.GroupID + message.SelfID)
 			} else {
 				app.deleteCustomRecord(message.UserID + message.SelfID)
+				app.deleteStoryVars(message.UserID + message.SelfID)
 			}
 			return
 		}
@@ -482,7 +496,7 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 
 		// 向量安全词部分,机器人向量安全屏障
 		if config.GetVectorSensitiveFilter() {
-			ret, retstr, err := app.InterceptSensitiveContent(vector, message, selfid, promptstr)
+			ret, retstr, err := app.InterceptSensitiveContent(vector, newmsg, message, selfid, promptstr)
 			if err != nil {
 				fmtf.Printf("Error in InterceptSensitiveContent: %v", err)
 				// 发送响应
@@ -569,11 +583,24 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			// 注意：根据实际情况调整后续逻辑
 		}
 
+		// 个人信息占位符的范围,与发送回复时还原的范围一致
+		piiGroupID := message.GroupID
+		if message.RealMessageType == "group_private" || message.MessageType == "private" {
+			piiGroupID = 0
+		}
+
 		//提示词安全部分
-		if config.GetAntiPromptAttackPath() != "" {
-			if checkResponseThreshold(newmsg) {
+		if config.GetAntiPromptAttackPath() != "" || config.GetInjectionDetect() {
+			// 注入检测可能把文本发给antiPromptAttackPath,同样先替换个人信息
+			if verdict := app.checkInjection(utils.RedactPII(newmsg, piiGroupID, message.UserID, selfid), vector); verdict.Unsafe {
 				fmtf.Printf("提示词不安全,过滤:%v", message)
-				saveresponse := config.GetRandomSaveResponse()
+				saveresponse := app.renderMessageTemplate(config.GetRandomSaveResponse(), &message, promptstr)
+				event := utils.ModerationEvent(message, selfid, promptstr, moderation.StageInjection)
+				event.Rule = verdict.Judge + ":" + verdict.Rule
+				event.Score = verdict.Score
+				event.Original = newmsg
+				event.Final = saveresponse
+				moderation.Record(event)
 				if saveresponse != "" {
 					if message.RealMessageType == "group_private" || message.MessageType == "private" {
 						if !config.GetUsePrivateSSE() {
@@ -649,6 +676,37 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 剧情存档指令
+		if kind, slotArg := MatchStorySlotCommand(checkResetCommand); kind != storySlotCommandNone {
+			app.handleStorySlotCommand(message, kind, slotArg, conversationID, parentMessageID, promptstr) // 适配群
+			return
+		}
+
+		// 实验中的好评和差评,不在实验中时作为普通消息处理
+		if feedback := MatchFeedbackCommand(checkResetCommand); feedback != "" && inExperiment {
+			app.recordExperimentEvent(experiment, feedback, conversationID)
+			app.sendMemoryResponse(message, "感谢你的反馈", promptstr)
+			return
+		}
+
+		// 管理员的黑名单指令
+		if kind, blacklistArg := MatchBlacklistCommand(checkResetCommand, strconv.FormatInt(message.UserID, 10)); kind != blacklistCommandNone {
+			app.handleBlacklistCommand(message, kind, blacklistArg, promptstr) // 适配群
+			return
+		}
+
+		// 向量安全词管理指令
+		if kind, sensitiveArg := MatchSensitiveCommand(checkResetCommand, strconv.FormatInt(message.UserID, 10)); kind != sensitiveCommandNone {
+			app.handleSensitiveCommand(message, kind, sensitiveArg, promptstr) // 适配群
+			return
+		}
+
+		// 用户事实列表和忘记指令
+		if isFactList, isFactForget, factArg := MatchFactCommand(checkResetCommand); isFactList || isFactForget {
+			app.handleFactCommand(message, isFactList, factArg, promptstr) // 适配群
+			return
+		}
+
 		// 新对话
 		newConversationCommand := config.GetNewConversationCommand()
 
@@ -698,11 +756,40 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 
 		// 替换in替换词规则
 		if config.GetSensitiveMode() {
-			requestmsg = acnode.CheckWordIN(requestmsg)
+			checkResult := acnode.CheckWordINPrompt(requestmsg, config.GetSensitiveDicts(promptstr))
+			if len(checkResult.Hits) > 0 {
+				event := utils.ModerationEvent(message, selfid, promptstr, moderation.StageWordIn)
+				event.Rule = strings.Join(checkResult.Hits, ",")
+				event.Original = requestmsg
+				event.Final = checkResult.Text
+				if checkResult.Blocked {
+					event.Final = checkResult.Reply
+				}
+				moderation.Record(event)
+			}
+			if checkResult.Blocked {
+				if checkResult.Reply != "" {
+					app.sendMemoryResponse(message, checkResult.Reply, promptstr)
+				}
+				// 发送响应
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("requestmsg is blocked"))
+				return
+			}
+			requestmsg = checkResult.Text
 		}
 
+		// 用户原本的Q,提取用户事实时使用,不含剧情和检索添加的内容
+		factmsg := requestmsg
+
 		// MARK: 对当前的Q进行各种处理
 
+		// 关键词设置剧情变量 setVarsQ
+		app.ApplySetVarsQ(promptstr, requestmsg, &message)
+
+		// 关键词修改数值变量 changeVarsQ
+		app.ApplyChangeVarsQ(promptstr, requestmsg, &message)
+
 		// 关键词退出部分ExitChoicesQ
 		app.ProcessExitChoicesQ(promptstr, &requestmsg, &message, selfid) // 适配群
 
@@ -718,6 +805,12 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 		// 概率的添加内容到当前的Q后方
 		app.ApplyPromptChanceQ(promptstr, &requestmsg, &message) // 适配群
 
+		// 从提示词所使用的知识库中检索相关片段,添加到当前的Q后方
+		app.ApplyKnowledgeBase(promptstr, newmsg, vector, &requestmsg)
+
+		// 检索关于用户的长期记忆,添加到当前的Q后方
+		app.ApplyUserFacts(strconv.FormatInt(message.UserID+message.SelfID, 10), newmsg, vector, &requestmsg)
+
 		// 从数据库读取用户的剧情存档
 		var CustomRecord *structs.CustomRecord
 		if config.GetGroupContext() == 2 && message.MessageType != "private" {
@@ -752,6 +845,10 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 将个人信息替换为占位符
+		requestmsg = utils.RedactPII(requestmsg, piiGroupID, message.UserID, selfid)
+		factmsg = utils.RedactPII(factmsg, piiGroupID, message.UserID, selfid)
+
 		if config.GetGroupContext() == 2 && message.MessageType != "private" {
 			fmtf.Printf("实际请求conversation端点内容:[%v]%v\n", message.GroupID+message.SelfID, requestmsg)
 		} else {
@@ -763,11 +860,13 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			parentMessageID = ""
 		}
 
+		// template_vars为conversation端点渲染提示词时使用的模板变量
 		requestBody, err := json.Marshal(map[string]interface{}{
 			"message":         requestmsg,
 			"conversationId":  conversationID,
 			"parentMessageId": parentMessageID,
 			"user_id":         message.UserID,
+			"template_vars":   app.messageTemplateVars(&message, promptstr),
 		})
 
 		if err != nil {
@@ -892,12 +991,14 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 							// 如果accumulatedMessage是response的子串，则提取新的部分并发送
 							if exists && strings.HasPrefix(response, accumulatedMessage) {
 								newPart := response[len(accumulatedMessage):]
+								// 加上流式过滤器中保留的部分
+								newPart = streamFilterFinish(key, newPart)
 								if newPart != "" {
 									fmtf.Printf("A完整信息: %s,已发送信息:%s 新部分:%s\n", response, accumulatedMessage, newPart)
 									// 判断消息类型，如果是私人消息或私有群消息，发送私人消息；否则，根据配置决定是否发送群消息
 									if userinfo.RealMessageType == "group_private" || userinfo.MessageType == "private" {
 										if !config.GetUsePrivateSSE() {
-											utils.SendPrivateMessage(userinfo.UserID, newPart, selfid, promptstr)
+											utils.SendPrivateMessageStream(userinfo.UserID, newPart, selfid, promptstr)
 										} else {
 											//判断是否最后一条
 											var state int
@@ -917,16 +1018,16 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 										if !config.GetMdPromptKeyboardAtGroup() {
 											// 如果没有 EnhancedAContent
 											if EnhancedAContent == "" {
-												utils.SendGroupMessage(userinfo.GroupID, userinfo.UserID, newPart, selfid, promptstr)
+												utils.SendGroupMessageStream(userinfo.GroupID, userinfo.UserID, newPart, selfid, promptstr)
 											} else {
-												utils.SendGroupMessage(userinfo.GroupID, userinfo.UserID, newPart+EnhancedAContent, selfid, promptstr)
+												utils.SendGroupMessageStream(userinfo.GroupID, userinfo.UserID, newPart+EnhancedAContent, selfid, promptstr)
 											}
 										} else {
 											// 如果没有 EnhancedAContent
 											if EnhancedAContent == "" {
-												go utils.SendGroupMessageMdPromptKeyboard(userinfo.GroupID, userinfo.UserID, newPart, selfid, newmsg, response, promptstr)
+												go utils.SendGroupMessageMdPromptKeyboardStream(userinfo.GroupID, userinfo.UserID, newPart, selfid, newmsg, response, promptstr)
 											} else {
-												go utils.SendGroupMessageMdPromptKeyboard(userinfo.GroupID, userinfo.UserID, newPart+EnhancedAContent, selfid, newmsg, response, promptstr)
+												go utils.SendGroupMessageMdPromptKeyboardStream(userinfo.GroupID, userinfo.UserID, newPart+EnhancedAContent, selfid, newmsg, response, promptstr)
 											}
 										}
 									}
@@ -997,6 +1098,7 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 
 							// 清空key的值
 							groupUserMessages.Store(key, "")
+							streamFilters.Delete(key)
 						}
 					} else {
 						//发送信息
@@ -1157,6 +1259,20 @@ func (app *App) GensokyoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 实验统计 以conversationID区分会话
+		if inExperiment {
+			app.recordExperimentEvent(experiment, experimentEventTurn, conversationID)
+		}
+
+		// 关键词设置剧情变量 setVarsA
+		app.ApplySetVarsA(promptstr, response, &message)
+
+		// 关键词修改数值变量 changeVarsA
+		app.ApplyChangeVarsA(promptstr, response, &message)
+
+		// 从本轮问答中提取关于用户的事实
+		go app.LearnUserFacts(strconv.FormatInt(message.UserID+message.SelfID, 10), factmsg, response)
+
 		// 关键词退出部分A
 		app.ProcessExitChoicesA(promptstr, &requestmsg, &message, selfid)
 
@@ -1234,10 +1350,24 @@ func processMessage(response string, conversationid string, newmesssage string,
 				groupUserMessages.Store(key, value)
 				processMessageMu.Unlock() // 完成更新后时解锁
 
+				// 先还原本人的个人信息占位符,过滤器暂不发送的末尾可能把占位符切成两段,分开发送后无法还原
+				restoreGroupID := userinfo.GroupID
+				if userinfo.RealMessageType == "group_private" || userinfo.MessageType == "private" {
+					restoreGroupID = 0
+				}
+				accumulatedMessage = utils.RestorePII(accumulatedMessage, restoreGroupID, userinfo.UserID, selfid)
+
+				// 末尾可能与后续文本组成敏感词的部分暂不发送
+				accumulatedMessage = streamFilterPush(key, accumulatedMessage, promptstr)
+				if accumulatedMessage == "" {
+					ClearMessage(conversationid)
+					continue
+				}
+
 				// 判断消息类型，如果是私人消息或私有群消息，发送私人消息；否则，根据配置决定是否发送群消息
 				if userinfo.RealMessageType == "group_private" || userinfo.MessageType == "private" {
 					if !config.GetUsePrivateSSE() {
-						utils.SendPrivateMessage(userinfo.UserID, accumulatedMessage, selfid, promptstr)
+						utils.SendPrivateMessageStream(userinfo.UserID, accumulatedMessage, selfid, promptstr)
 					} else {
 						if IncrementIndex(newmesssage) == 1 {
 							//第一条信息
@@ -1261,7 +1391,7 @@ func processMessage(response string, conversationid string, newmesssage string,
 						}
 					}
 				} else {
-					utils.SendGroupMessage(userinfo.GroupID, userinfo.UserID, accumulatedMessage, selfid, promptstr)
+					utils.SendGroupMessageStream(userinfo.GroupID, userinfo.UserID, accumulatedMessage, selfid, promptstr)
 				}
 
 				ClearMessage(conversationid)
@@ -16,6 +16,7 @@ import (
 	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
 	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
 	"github.com/hoshinonyaruko/gensokyo-llm/promptkb"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
@@ -226,7 +227,7 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 			} else {
 				app.migrateUserToNewContextSP(message.UserID)
 			}
-			RestoreResponse := config.GetRandomRestoreResponses()
+			RestoreResponse := utils.RenderTemplate(config.GetRandomRestoreResponses(), utils.MessageTemplateVarsSP(message, promptstr))
 			if message.RealMessageType == "group_private" || message.MessageType == "private" {
 				if !config.GetUsePrivateSSE() {
 					utils.SendPrivateMessageSP(message.UserID, RestoreResponse, selfid, promptstr)
@@ -383,10 +384,16 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//提示词安全部分
-		if config.GetAntiPromptAttackPath() != "" {
-			if checkResponseThreshold(newmsg) {
+		if config.GetAntiPromptAttackPath() != "" || config.GetInjectionDetect() {
+			if verdict := app.checkInjection(newmsg, vector); verdict.Unsafe {
 				fmtf.Printf("提示词不安全,过滤:%v", message)
-				saveresponse := config.GetRandomSaveResponse()
+				saveresponse := utils.RenderTemplate(config.GetRandomSaveResponse(), utils.MessageTemplateVarsSP(message, promptstr))
+				event := utils.ModerationEventSP(message, selfid, promptstr, moderation.StageInjection)
+				event.Rule = verdict.Judge + ":" + verdict.Rule
+				event.Score = verdict.Score
+				event.Original = newmsg
+				event.Final = saveresponse
+				moderation.Record(event)
 				if saveresponse != "" {
 					if message.RealMessageType == "group_private" || message.MessageType == "private" {
 						if !config.GetUsePrivateSSE() {
@@ -462,6 +469,24 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 管理员的黑名单指令
+		if kind, blacklistArg := MatchBlacklistCommand(checkResetCommand, message.UserID); kind != blacklistCommandNone {
+			app.handleBlacklistCommandSP(message, kind, blacklistArg, promptstr) // 适配群
+			return
+		}
+
+		// 向量安全词管理指令
+		if kind, sensitiveArg := MatchSensitiveCommand(checkResetCommand, message.UserID); kind != sensitiveCommandNone {
+			app.handleSensitiveCommandSP(message, kind, sensitiveArg, promptstr) // 适配群
+			return
+		}
+
+		// 用户事实列表和忘记指令
+		if isFactList, isFactForget, factArg := MatchFactCommand(checkResetCommand); isFactList || isFactForget {
+			app.handleFactCommandSP(message, isFactList, factArg, promptstr) // 适配群
+			return
+		}
+
 		// 新对话
 		newConversationCommand := config.GetNewConversationCommand()
 
@@ -511,9 +536,38 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 
 		// 替换in替换词规则
 		if config.GetSensitiveMode() {
-			requestmsg = acnode.CheckWordIN(requestmsg)
+			checkResult := acnode.CheckWordINPrompt(requestmsg, config.GetSensitiveDicts(promptstr))
+			if len(checkResult.Hits) > 0 {
+				event := utils.ModerationEventSP(message, selfid, promptstr, moderation.StageWordIn)
+				event.Rule = strings.Join(checkResult.Hits, ",")
+				event.Original = requestmsg
+				event.Final = checkResult.Text
+				if checkResult.Blocked {
+					event.Final = checkResult.Reply
+				}
+				moderation.Record(event)
+			}
+			if checkResult.Blocked {
+				if checkResult.Reply != "" {
+					app.sendMemoryResponseSP(message, checkResult.Reply, promptstr)
+				}
+				// 发送响应
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("requestmsg is blocked"))
+				return
+			}
+			requestmsg = checkResult.Text
 		}
 
+		// 用户原本的Q,提取用户事实时使用,不含检索添加的内容
+		factmsg := requestmsg
+
+		// 从提示词所使用的知识库中检索相关片段,添加到当前的Q后方
+		app.ApplyKnowledgeBase(promptstr, newmsg, vector, &requestmsg)
+
+		// 检索关于用户的长期记忆,添加到当前的Q后方
+		app.ApplyUserFacts(message.UserID, newmsg, vector, &requestmsg)
+
 		// 按提示词区分的细化替换 这里主要不是为了安全和敏感词,而是细化效果,也就没有使用acnode提高效率
 		requestmsg = utils.ReplaceTextIn(requestmsg, promptstr)
 
@@ -653,12 +707,14 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 							// 如果accumulatedMessage是response的子串，则提取新的部分并发送
 							if exists && strings.HasPrefix(response, accumulatedMessage) {
 								newPart := response[len(accumulatedMessage):]
+								// 加上流式过滤器中保留的部分
+								newPart = streamFilterFinish(key, newPart)
 								if newPart != "" {
 									fmtf.Printf("A完整信息: %s,已发送信息:%s 新部分:%s\n", response, accumulatedMessage, newPart)
 									// 判断消息类型，如果是私人消息或私有群消息，发送私人消息；否则，根据配置决定是否发送群消息
 									if userinfo.RealMessageType == "group_private" || userinfo.MessageType == "private" {
 										if !config.GetUsePrivateSSE() {
-											utils.SendPrivateMessageSP(userinfo.UserID, newPart, selfid, promptstr)
+											utils.SendPrivateMessageStreamSP(userinfo.UserID, newPart, selfid, promptstr)
 										} else {
 											//判断是否最后一条
 											state := 11 //继续
@@ -672,10 +728,10 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 										// 这里发送的是newPart api最后补充的部分
 										if !config.GetMdPromptKeyboardAtGroup() {
 
-											utils.SendGroupMessageSP(userinfo.GroupID, userinfo.UserID, newPart, selfid, promptstr)
+											utils.SendGroupMessageStreamSP(userinfo.GroupID, userinfo.UserID, newPart, selfid, promptstr)
 
 										} else {
-											go utils.SendGroupMessageMdPromptKeyboardSP(userinfo.GroupID, userinfo.UserID, newPart, selfid, newmsg, response, promptstr)
+											go utils.SendGroupMessageMdPromptKeyboardStreamSP(userinfo.GroupID, userinfo.UserID, newPart, selfid, newmsg, response, promptstr)
 
 										}
 									}
@@ -727,6 +783,7 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 
 							// 清空key的值
 							groupUserMessages.Store(key, "")
+							streamFilters.Delete(key)
 						}
 					} else {
 						//发送信息
@@ -873,6 +930,12 @@ func (app *App) GensokyoHandlerSP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 从本轮问答中提取关于用户的事实
+		// 这里的请求不替换个人信息,开启piiRedactMode时不提取,避免个人信息被记录下来
+		if config.GetPIIRedactMode() == 0 {
+			go app.LearnUserFacts(message.UserID, factmsg, response)
+		}
+
 	case map[string]interface{}:
 		// message.Message是一个map[string]interface{}
 		// 理论上不应该执行到这里，因为我们已确保它是字符串
@@ -984,10 +1047,17 @@ func processMessageSP(response string, conversationid string, newmesssage string
 				groupUserMessages.Store(key, value)
 				processMessageMu.Unlock() // 完成更新后时解锁
 
+				// 末尾可能与后续文本组成敏感词的部分暂不发送
+				accumulatedMessage = streamFilterPush(key, accumulatedMessage, promptstr)
+				if accumulatedMessage == "" {
+					ClearMessage(conversationid)
+					continue
+				}
+
 				// 判断消息类型，如果是私人消息或私有群消息，发送私人消息；否则，根据配置决定是否发送群消息
 				if userinfo.RealMessageType == "group_private" || userinfo.MessageType == "private" {
 					if !config.GetUsePrivateSSE() {
-						utils.SendPrivateMessageSP(userinfo.UserID, accumulatedMessage, selfid, promptstr)
+						utils.SendPrivateMessageStreamSP(userinfo.UserID, accumulatedMessage, selfid, promptstr)
 					} else {
 						if IncrementIndex(newmesssage) == 1 {
 							//第一条信息
@@ -1011,7 +1081,7 @@ func processMessageSP(response string, conversationid string, newmesssage string
 						}
 					}
 				} else {
-					utils.SendGroupMessageSP(userinfo.GroupID, userinfo.UserID, accumulatedMessage, selfid, promptstr)
+					utils.SendGroupMessageStreamSP(userinfo.GroupID, userinfo.UserID, accumulatedMessage, selfid, promptstr)
 				}
 
 				ClearMessage(conversationid)
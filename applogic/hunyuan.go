@@ -11,7 +11,6 @@ import (
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
 	"github.com/hoshinonyaruko/gensokyo-llm/hunyuan"
-	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
 	"github.com/hoshinonyaruko/gensokyo-llm/utils"
 )
@@ -77,7 +76,7 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 	//根据是否有prompt参数 选择是否载入config.yml的prompt还是prompts文件夹的
 	if promptstr == "" {
 		// 获取系统提示词
-		systemPromptContent := config.SystemPrompt() // 注意检查实际的函数名是否正确
+		systemPromptContent := renderConversationTemplate(msg.TemplateVars, promptstr, config.SystemPrompt()) // 注意检查实际的函数名是否正确
 		// 如果系统提示词不为空，则添加到历史信息的开始
 		if systemPromptContent != "0" {
 			systemPromptRole := "system"
@@ -105,11 +104,11 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 		for _, pair := range pairs {
 			if pair.Q != "" && pair.A != "" {
 				qMessage := structs.Message{
-					Text: pair.Q,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.Q),
 					Role: pair.RoleQ,
 				}
 				aMessage := structs.Message{
-					Text: pair.A,
+					Text: renderConversationTemplate(msg.TemplateVars, promptstr, pair.A),
 					Role: pair.RoleA,
 				}
 
@@ -119,7 +118,7 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// 只获取系统提示词
-		systemMessage, err := prompt.GetFirstSystemMessageStruct(promptstr)
+		systemMessage, err := templateSystemMessageStruct(msg.TemplateVars, promptstr)
 		if err != nil {
 			fmt.Println("Error:", err)
 		} else {
@@ -144,7 +143,7 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 			// 注意追加的顺序，确保问题在系统提示词之后
 			// 使用...操作符来展开userhistory切片并追加到history切片
 			// 获取系统级预埋的系统自定义QA对
-			systemHistory, err := prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err := templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmtf.Printf("Error getting system history: %v,promptstr[%v]\n", err, promptstr)
 				return
@@ -152,7 +151,7 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 
 			// 处理增强QA逻辑
 			if config.GetEnhancedQA(promptstr) {
-				systemHistory, err := prompt.GetMessagesExcludingSystem(promptstr)
+				systemHistory, err := templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 				if err != nil {
 					fmt.Printf("Error getting system history: %v\n", err)
 					return
@@ -193,7 +192,7 @@ func (app *App) ChatHandlerHunyuan(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var systemHistory []structs.Message
 		if promptstr != "" {
-			systemHistory, err = prompt.GetMessagesExcludingSystem(promptstr)
+			systemHistory, err = templateMessagesExcludingSystem(msg.TemplateVars, promptstr)
 			if err != nil {
 				fmtf.Printf("prompt.GetMessagesExcludingSystem error: %v\n", err)
 			}
@@ -0,0 +1,433 @@
+package applogic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 知识库目录 每个子目录是一个知识库,子目录名即知识库名
+const knowledgeDir = "knowledge"
+
+// 文件改动后等待多久再重新索引,避免编辑器保存时的多次写入触发多次索引
+const knowledgeReindexDelay = 2 * time.Second
+
+// 知识片段结尾优先选择的断句位置
+const knowledgeBreakRunes = "\n。！？；.!?;"
+
+var (
+	knowledgeTimers   = make(map[string]*time.Timer)
+	knowledgeTimersMu sync.Mutex
+)
+
+// EnsureKnowledgeTableExists 知识库片段表
+func (app *App) EnsureKnowledgeTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS knowledge_chunks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        kb_name TEXT NOT NULL,
+        source_file TEXT NOT NULL,
+        chunk_index INTEGER NOT NULL,
+        text TEXT NOT NULL,
+        vector BLOB NOT NULL,
+        norm FLOAT NOT NULL,
+        file_hash TEXT NOT NULL,
+        model_fingerprint TEXT NOT NULL DEFAULT ''
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating knowledge_chunks table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_kb ON knowledge_chunks(kb_name, source_file);`
+	_, err = app.DB.Exec(createIndexSQL)
+	if err != nil {
+		return fmt.Errorf("error creating index on knowledge_chunks: %w", err)
+	}
+
+	return nil
+}
+
+// ReindexKnowledgeBases 索引knowledge目录下的全部知识库,force为true时忽略文件哈希全部重新计算
+func (app *App) ReindexKnowledgeBases(force bool) error {
+	entries, err := os.ReadDir(knowledgeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading knowledge dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := app.indexKnowledgeBase(entry.Name(), force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKnowledgeBase 增量索引单个知识库,只重新计算内容或向量指纹有变化的文件,并清理已删除文件的片段
+func (app *App) indexKnowledgeBase(kbName string, force bool) error {
+	root := filepath.Join(knowledgeDir, kbName)
+	fingerprint := embeddingFingerprint()
+	seen := make(map[string]bool)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isKnowledgeFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading knowledge file %s: %w", path, err)
+		}
+		sum := sha256.Sum256(data)
+		fileHash := hex.EncodeToString(sum[:])
+
+		if !force {
+			var oldHash, oldFingerprint string
+			row := app.DB.QueryRow("SELECT file_hash, model_fingerprint FROM knowledge_chunks WHERE kb_name = ? AND source_file = ? LIMIT 1", kbName, rel)
+			if row.Scan(&oldHash, &oldFingerprint) == nil && oldHash == fileHash && oldFingerprint == fingerprint {
+				return nil
+			}
+		}
+
+		return app.indexKnowledgeFile(kbName, rel, string(data), fileHash, fingerprint)
+	})
+	if err != nil {
+		return fmt.Errorf("error indexing knowledge base %s: %w", kbName, err)
+	}
+
+	// 清理已经不存在的文件
+	rows, err := app.DB.Query("SELECT DISTINCT source_file FROM knowledge_chunks WHERE kb_name = ?", kbName)
+	if err != nil {
+		return fmt.Errorf("error listing knowledge files: %w", err)
+	}
+	var removed []string
+	for rows.Next() {
+		var sourceFile string
+		if err := rows.Scan(&sourceFile); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning knowledge file: %w", err)
+		}
+		if !seen[sourceFile] {
+			removed = append(removed, sourceFile)
+		}
+	}
+	rows.Close()
+
+	for _, sourceFile := range removed {
+		_, err := app.DB.Exec("DELETE FROM knowledge_chunks WHERE kb_name = ? AND source_file = ?", kbName, sourceFile)
+		if err != nil {
+			return fmt.Errorf("error deleting knowledge chunks: %w", err)
+		}
+		fmtf.Printf("知识库[%s]文件[%s]已删除,已清理对应片段\n", kbName, sourceFile)
+	}
+
+	return nil
+}
+
+// indexKnowledgeFile 切分并计算单个文件的全部片段,全部计算成功后再替换旧片段
+func (app *App) indexKnowledgeFile(kbName, sourceFile, content, fileHash, fingerprint string) error {
+	chunks := chunkKnowledgeText(content, config.GetKnowledgeChunkSize(), config.GetKnowledgeChunkOverlap())
+
+	vectors, err := app.CalculateTextEmbeddings(chunks)
+	if err != nil {
+		return fmt.Errorf("计算知识片段向量时出错 %s: %w", sourceFile, err)
+	}
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM knowledge_chunks WHERE kb_name = ? AND source_file = ?", kbName, sourceFile)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting old knowledge chunks: %w", err)
+	}
+	for i, vector := range vectors {
+		var sum float64
+		for _, v := range vector {
+			sum += v * v
+		}
+		norm := math.Sqrt(sum)
+		_, err = tx.Exec("INSERT INTO knowledge_chunks (kb_name, source_file, chunk_index, text, vector, norm, file_hash, model_fingerprint) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			kbName, sourceFile, i, chunks[i], vectorToBinaryConcurrent(vector), norm, fileHash, fingerprint)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error inserting knowledge chunk: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing knowledge chunks: %w", err)
+	}
+
+	fmtf.Printf("知识库[%s]文件[%s]已索引,片段数:%d\n", kbName, sourceFile, len(chunks))
+	return nil
+}
+
+func isKnowledgeFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".md" || ext == ".txt"
+}
+
+// chunkKnowledgeText 按字数切分文本,相邻片段之间保留overlap个字的重叠,尽量在段落或句子结尾处切分
+func chunkKnowledgeText(text string, size, overlap int) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	runes := []rune(text)
+	if overlap >= size {
+		overlap = size / 2
+	}
+
+	var chunks []string
+	start := 0
+	for start < len(runes) {
+		end := start + size
+		if end >= len(runes) {
+			end = len(runes)
+		} else {
+			// 在片段后半段内寻找最靠后的断句位置
+			for i := end - 1; i > start+size/2; i-- {
+				if strings.ContainsRune(knowledgeBreakRunes, runes[i]) {
+					end = i + 1
+					break
+				}
+			}
+		}
+
+		chunk := strings.TrimSpace(string(runes[start:end]))
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		if end >= len(runes) {
+			break
+		}
+
+		next := end - overlap
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+// searchKnowledge 在指定的知识库中查找与向量最接近的topK个片段
+func (app *App) searchKnowledge(kbNames []string, vector []float64, topK int, threshold int) ([]TextDistance, error) {
+	if len(kbNames) == 0 || topK <= 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(kbNames)), ",")
+	args := make([]interface{}, len(kbNames))
+	for i, name := range kbNames {
+		args[i] = name
+	}
+
+	rows, err := app.DB.Query("SELECT text, vector, model_fingerprint FROM knowledge_chunks WHERE kb_name IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	binaryVector := vectorToBinaryConcurrent(vector)
+	fingerprint := embeddingFingerprint()
+	skipped := 0
+	var results []TextDistance
+	for rows.Next() {
+		var text string
+		var dbVectorBytes []byte
+		var dbFingerprint string
+		if err := rows.Scan(&text, &dbVectorBytes, &dbFingerprint); err != nil {
+			continue
+		}
+		if dbFingerprint != fingerprint {
+			skipped++
+			continue
+		}
+		distance := hammingDistanceOptimized(binaryVector, dbVectorBytes)
+		if threshold > 0 && distance > threshold {
+			continue
+		}
+		results = append(results, TextDistance{Text: text, Distance: distance})
+	}
+
+	if skipped > 0 {
+		fmtf.Printf("知识库中有%d个片段的指纹与当前指纹[%s]不一致,请使用 -reindex-kb 参数重新索引\n", skipped, fingerprint)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+	if len(results) > topK {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+// ApplyKnowledgeBase 将当前提示词所使用知识库中最相关的片段添加到当前的Q后方,vector为空时会计算newmsg的向量
+func (app *App) ApplyKnowledgeBase(promptstr string, newmsg string, vector []float64, requestmsg *string) {
+	kbNames := config.GetKnowledgeBases(promptstr)
+	if len(kbNames) == 0 {
+		return
+	}
+	if simulating {
+		// 提示词中设置的知识库,离线模拟时同样不检索
+		app.traceRule("知识库%v: 离线模拟时不检索", kbNames)
+		return
+	}
+
+	if vector == nil {
+		var err error
+		vector, err = app.CalculateTextEmbedding(newmsg)
+		if err != nil {
+			fmtf.Printf("计算知识库检索向量时出错:%v\n", err)
+			return
+		}
+	}
+
+	results, err := app.searchKnowledge(kbNames, vector, config.GetKnowledgeTopK(promptstr), config.GetKnowledgeThreshold(promptstr))
+	if err != nil {
+		fmtf.Printf("检索知识库时出错:%v\n", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	texts := make([]string, len(results))
+	for i, result := range results {
+		if config.GetPrintHanming() {
+			fmtf.Printf("知识库命中片段,汉明距离:%v,%v\n", result.Distance, result.Text)
+		}
+		texts[i] = result.Text
+	}
+
+	*requestmsg += " (参考资料:\n" + strings.Join(texts, "\n---\n") + ")"
+}
+
+// WatchKnowledgeBases 启动时增量索引全部知识库,并监听knowledge目录,文件变化后重新索引对应的知识库
+func (app *App) WatchKnowledgeBases() error {
+	if _, err := os.Stat(knowledgeDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(knowledgeDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				rel, err := filepath.Rel(knowledgeDir, event.Name)
+				if err != nil || rel == "." {
+					continue
+				}
+				kbName := strings.Split(filepath.ToSlash(rel), "/")[0]
+				// 新建的知识库目录也需要监听
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						watcher.Add(event.Name)
+					}
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					app.scheduleKnowledgeReindex(kbName)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("error:", err)
+			}
+		}
+	}()
+
+	err = watcher.Add(knowledgeDir)
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(knowledgeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != knowledgeDir {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := app.ReindexKnowledgeBases(false); err != nil {
+			fmtf.Printf("索引知识库时出错:%v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// scheduleKnowledgeReindex 合并短时间内的多次改动,只重新索引一次
+func (app *App) scheduleKnowledgeReindex(kbName string) {
+	knowledgeTimersMu.Lock()
+	defer knowledgeTimersMu.Unlock()
+
+	if timer, ok := knowledgeTimers[kbName]; ok {
+		timer.Stop()
+	}
+	knowledgeTimers[kbName] = time.AfterFunc(knowledgeReindexDelay, func() {
+		knowledgeTimersMu.Lock()
+		delete(knowledgeTimers, kbName)
+		knowledgeTimersMu.Unlock()
+
+		info, err := os.Stat(filepath.Join(knowledgeDir, kbName))
+		if os.IsNotExist(err) {
+			_, err := app.DB.Exec("DELETE FROM knowledge_chunks WHERE kb_name = ?", kbName)
+			if err != nil {
+				fmtf.Printf("清理知识库[%s]时出错:%v\n", kbName, err)
+			}
+			return
+		}
+		// knowledge目录下直接放置的文件不属于任何知识库
+		if err != nil || !info.IsDir() {
+			return
+		}
+		if err := app.indexKnowledgeBase(kbName, false); err != nil {
+			fmtf.Printf("重新索引知识库[%s]时出错:%v\n", kbName, err)
+		}
+	})
+}
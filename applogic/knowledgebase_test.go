@@ -0,0 +1,65 @@
+package applogic
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkKnowledgeTextBreaksAtSentenceEnd(t *testing.T) {
+	text := "幻想乡位于日本的深山之中。博丽大结界将它与外界隔开。人间之里是人类居住的村落。"
+	chunks := chunkKnowledgeText(text, 20, 0)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks %q, want one per sentence", len(chunks), chunks)
+	}
+	for _, chunk := range chunks {
+		if !strings.HasSuffix(chunk, "。") {
+			t.Errorf("chunk %q does not end at a sentence", chunk)
+		}
+	}
+	if strings.Join(chunks, "") != text {
+		t.Errorf("chunks without overlap do not rebuild the text: %q", chunks)
+	}
+}
+
+func TestChunkKnowledgeTextOverlap(t *testing.T) {
+	chunks := chunkKnowledgeText("abcdefghij", 4, 1)
+	want := []string{"abcd", "defg", "ghij"}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Fatalf("chunks = %q, want %q", chunks, want)
+	}
+
+	// overlap不小于size时按size的一半重叠,不能原地打转
+	chunks = chunkKnowledgeText("abcdefgh", 4, 4)
+	want = []string{"abcd", "cdef", "efgh"}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Errorf("chunks = %q, want %q", chunks, want)
+	}
+}
+
+func TestChunkKnowledgeTextLongDocument(t *testing.T) {
+	text := strings.Repeat("知识库的内容需要切分成片段。每个片段不超过设置的字数！\r\n", 20)
+	const size = 30
+	chunks := chunkKnowledgeText(text, size, 5)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > size {
+			t.Errorf("chunk %d has %d runes, more than %d", i, n, size)
+		}
+		if strings.Contains(chunk, "\r") {
+			t.Errorf("chunk %d still contains \\r: %q", i, chunk)
+		}
+	}
+	normalized := strings.ReplaceAll(text, "\r\n", "\n")
+	if !strings.HasPrefix(normalized, chunks[0]) || !strings.HasSuffix(strings.TrimSpace(normalized), chunks[len(chunks)-1]) {
+		t.Errorf("chunks do not cover the start and end of the document")
+	}
+}
+
+func TestChunkKnowledgeTextBlank(t *testing.T) {
+	if chunks := chunkKnowledgeText(" \n\n ", 10, 2); len(chunks) != 0 {
+		t.Errorf("blank text produced chunks %q", chunks)
+	}
+}
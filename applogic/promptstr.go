@@ -66,8 +66,11 @@ func (app *App) InsertCustomTableRecord(userID int64, promptStr string, promptSt
 func (app *App) FetchCustomRecord(userID int64, fields ...string) (*structs.CustomRecord, error) {
 	// Default fields now include promptstr_stat
 	queryFields := "user_id, promptstr, promptstr_stat"
-	if len(fields) > 0 {
-		queryFields += ", " + strings.Join(fields, ", ")
+	for _, field := range fields {
+		// 未设置过的str字段为NULL,无法扫描到string
+		if fieldIndex(field) >= 0 {
+			queryFields += fmt.Sprintf(", COALESCE(%s, '')", field)
+		}
 	}
 
 	// Construct the SQL query string
@@ -138,16 +141,11 @@ func (app *App) ProcessPromptMarks(userID int64, QorA string, promptStr *string)
 	for _, mark := range PromptMarks {
 		// 如果没有设置keyword则不处理
 		if len(mark.Keywords) != 0 {
-			// 检查 QorA 是否包含 Keywords 中的任意一个成员
-			matchCount := 0
-			for _, keyword := range mark.Keywords {
-				if strings.Contains(QorA, keyword) {
-					matchCount++
-				}
-			}
+			// 检查 QorA 命中 Keywords 中的几个成员,支持正则、排除词和语义例句
+			matchCount := len(app.matchTriggers(QorA, mark.Keywords, fmt.Sprintf("%s promptMarks %s", *promptStr, mark.BranchName)))
 
-			// 更新找到含有最多匹配项的新 promptStr
-			if matchCount > maxMatchCount {
+			// 更新找到含有最多匹配项的新 promptStr,不满足数值变量条件的分支不切换
+			if matchCount > maxMatchCount && app.storyConditionMet(userID, mark.Condition, fmt.Sprintf("%s promptMarks %s", *promptStr, mark.BranchName)) {
 				maxMatchCount = matchCount
 				bestPromptStr = mark.BranchName
 				bestPromptMarksLength = config.GetPromptMarksLength(bestPromptStr)
@@ -163,6 +161,7 @@ func (app *App) ProcessPromptMarks(userID int64, QorA string, promptStr *string)
 		}
 		// 输出结果
 		fmt.Printf("type1=流转prompt参数: %s, newPromptStrStat: %d\n", bestPromptStr, bestPromptMarksLength)
+		app.traceRule("promptMarks: 切换到%s", bestPromptStr)
 		*promptStr = bestPromptStr
 	}
 }
@@ -0,0 +1,161 @@
+package applogic
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 需要随向量模型变化而重新计算的表
+var reembedTables = []string{"vector_data", "sensitive_words"}
+
+// EnsureReembedProgressTableExists 重新计算向量的进度表,中断后再次运行 -reembed 可以从上次的位置继续
+func (app *App) EnsureReembedProgressTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS reembed_progress (
+        table_name TEXT NOT NULL,
+        fingerprint TEXT NOT NULL,
+        last_id INTEGER NOT NULL DEFAULT 0,
+        processed INTEGER NOT NULL DEFAULT 0,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (table_name, fingerprint)
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating reembed_progress table: %w", err)
+	}
+	return nil
+}
+
+// ReembedVectors 使用当前的向量模型重新计算所有指纹不一致的向量,每批batchSize条,每批完成后记录进度
+func (app *App) ReembedVectors(batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 16
+	}
+
+	err := app.EnsureReembedProgressTableExists()
+	if err != nil {
+		return err
+	}
+
+	fingerprint := embeddingFingerprint()
+	fmtf.Printf("开始重新计算向量,目标指纹:%s,每批:%d条\n", fingerprint, batchSize)
+
+	for _, table := range reembedTables {
+		err := app.reembedTable(table, fingerprint, batchSize)
+		if err != nil {
+			return fmt.Errorf("重新计算%s表的向量时出错: %w", table, err)
+		}
+	}
+
+	fmtf.Printf("全部向量已更新为指纹:%s\n", fingerprint)
+	return nil
+}
+
+// reembedTable 重新计算单个表中指纹不一致的向量
+func (app *App) reembedTable(table string, fingerprint string, batchSize int) error {
+	var lastID int64
+	var processed int
+	query := `SELECT last_id, processed FROM reembed_progress WHERE table_name = ? AND fingerprint = ?`
+	err := app.DB.QueryRow(query, table, fingerprint).Scan(&lastID, &processed)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading reembed progress: %w", err)
+	}
+	if lastID > 0 {
+		fmtf.Printf("[%s]从上次中断的位置继续,last_id:%d,已完成:%d条\n", table, lastID, processed)
+	}
+
+	var remaining int
+	countSQL := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE model_fingerprint != ? AND id > ?", table)
+	err = app.DB.QueryRow(countSQL, fingerprint, lastID).Scan(&remaining)
+	if err != nil {
+		return fmt.Errorf("error counting vectors: %w", err)
+	}
+	fmtf.Printf("[%s]待重新计算的向量:%d条\n", table, remaining)
+
+	selectSQL := fmt.Sprintf("SELECT id, text FROM %s WHERE model_fingerprint != ? AND id > ? ORDER BY id ASC LIMIT ?", table)
+	updateSQL := fmt.Sprintf("UPDATE %s SET vector = ?, norm = ?, group_id = ?, model_fingerprint = ? WHERE id = ?", table)
+
+	for {
+		ids, texts, err := app.selectReembedBatch(selectSQL, fingerprint, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		// 先计算整批向量,全部成功后再写入,避免写入一半的批次
+		vectors, err := app.CalculateTextEmbeddings(texts)
+		if err != nil {
+			return fmt.Errorf("计算文本向量时出错 id:%d-%d: %w", ids[0], ids[len(ids)-1], err)
+		}
+
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return fmt.Errorf("error beginning transaction: %w", err)
+		}
+		for i, vector := range vectors {
+			var sum float64
+			for _, v := range vector {
+				sum += v * v
+			}
+			norm := math.Sqrt(sum)
+			groupID := calculateGroupID(vector)
+			_, err = tx.Exec(updateSQL, vectorToBinaryConcurrent(vector), norm, groupID, fingerprint, ids[i])
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error updating vector id:%d: %w", ids[i], err)
+			}
+		}
+
+		lastID = ids[len(ids)-1]
+		processed += len(ids)
+		upsertSQL := `
+        INSERT INTO reembed_progress (table_name, fingerprint, last_id, processed, updated_at)
+        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT(table_name, fingerprint) DO UPDATE SET
+            last_id = excluded.last_id,
+            processed = excluded.processed,
+            updated_at = excluded.updated_at;`
+		_, err = tx.Exec(upsertSQL, table, fingerprint, lastID, processed)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error saving reembed progress: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing reembed batch: %w", err)
+		}
+
+		fmtf.Printf("[%s]已重新计算%d条向量,last_id:%d\n", table, processed, lastID)
+	}
+
+	return nil
+}
+
+func (app *App) selectReembedBatch(selectSQL string, fingerprint string, lastID int64, batchSize int) ([]int64, []string, error) {
+	rows, err := app.DB.Query(selectSQL, fingerprint, lastID, batchSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error selecting vectors: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var texts []string
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, nil, fmt.Errorf("error scanning vector row: %w", err)
+		}
+		ids = append(ids, id)
+		texts = append(texts, text)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	return ids, texts, nil
+}
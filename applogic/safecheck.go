@@ -24,8 +24,8 @@ type NestedResponse struct {
 	Result float64 `json:"result"`
 }
 
-// checkResponseThreshold 发送消息并根据返回值决定是否超过阈值
-func checkResponseThreshold(msg string) bool {
+// requestInjectionScore 发送消息给antiPromptAttackPath,返回大模型给出的评分
+func requestInjectionScore(msg string) (float64, error) {
 	url := config.GetAntiPromptAttackPath()
 	requestBody, err := json.Marshal(map[string]interface{}{
 		"message":         msg,
@@ -34,28 +34,24 @@ func checkResponseThreshold(msg string) bool {
 		"user_id":         "",
 	})
 	if err != nil {
-		fmtf.Printf("Error marshalling request: %v\n", err)
-		return false
+		return 0, fmt.Errorf("error marshalling request: %w", err)
 	}
 
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(requestBody))
 	if err != nil {
-		fmtf.Printf("Error sending request: %v\n", err)
-		return false
+		return 0, fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmtf.Printf("Error reading response body: %v\n", err)
-		return false
+		return 0, fmt.Errorf("error reading response body: %w", err)
 	}
 	fmtf.Printf("Response: %s\n", string(responseBody))
 
 	var responseData ResponseData
 	if err := json.Unmarshal(responseBody, &responseData); err != nil {
-		fmtf.Printf("Error unmarshalling response data: %v\n", err)
-		return false
+		return 0, fmt.Errorf("error unmarshalling response data: %w", err)
 	}
 
 	var nestedResponse NestedResponse
@@ -75,16 +71,14 @@ func checkResponseThreshold(msg string) bool {
 			jsonFloat := fmt.Sprintf("{\"result\":%s}", preprocessedResponse)
 			err = json.Unmarshal([]byte(jsonFloat), &nestedResponse)
 			if err != nil {
-				// 如果仍然失败，则记录错误并返回
-				fmt.Printf("Error unmarshalling adjusted response data: %v\n", err)
-				return false
+				// 如果仍然失败，则返回错误
+				return 0, fmt.Errorf("error unmarshalling adjusted response data: %w", err)
 			}
 		} else {
-			// 如果不是纯浮点数，也不是正确的JSON格式，则记录原始错误并返回
-			fmt.Printf("Error unmarshalling nested response data: %v\n", err)
-			return false
+			// 如果不是纯浮点数，也不是正确的JSON格式，则返回原始错误
+			return 0, fmt.Errorf("error unmarshalling nested response data: %w", err)
 		}
 	}
 	fmtf.Printf("大模型agent安全检查结果: %v\n", nestedResponse.Result)
-	return nestedResponse.Result > config.GetAntiPromptLimit()
+	return nestedResponse.Result, nil
 }
@@ -0,0 +1,514 @@
+package applogic
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 向量安全词文件,启动时由ProcessSensitiveWords读取,运行时的增删也同步写入
+const vectorSensitiveFile = "vector_sensitive.txt"
+
+// 列表每页的数量,测试时显示的最近安全词数量
+const (
+	sensitiveListPageSize = 20
+	sensitiveTestTopN     = 5
+)
+
+// 向量安全词指令的种类
+const (
+	sensitiveCommandNone = iota
+	sensitiveCommandAdd
+	sensitiveCommandRemove
+	sensitiveCommandList
+	sensitiveCommandTest
+	sensitiveCommandThreshold
+)
+
+// sensitiveNearest 测试时与句子比较的一条安全词,只有同一norm分组中的安全词会被实际比较和拦截
+type sensitiveNearest struct {
+	Text       string `json:"text"`
+	Distance   int    `json:"distance"`
+	Bucket     int64  `json:"bucket"`
+	SameBucket bool   `json:"same_bucket"`
+}
+
+// sensitiveEntry 一条向量安全词,-v 参数会为同一文本保存多条向量,Count为向量数量
+type sensitiveEntry struct {
+	ID    int64  `json:"id"`
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+var (
+	sensitiveThresholds   = make(map[string]int) // 群号 -> 汉明距离阈值
+	sensitiveThresholdsMu sync.RWMutex
+)
+
+// EnsureSensitiveThresholdTableExists 各群单独设置的向量安全词阈值
+func (app *App) EnsureSensitiveThresholdTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS sensitive_thresholds (
+        group_id TEXT PRIMARY KEY,
+        threshold INTEGER NOT NULL
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating sensitive_thresholds table: %w", err)
+	}
+
+	rows, err := app.DB.Query("SELECT group_id, threshold FROM sensitive_thresholds")
+	if err != nil {
+		return fmt.Errorf("error loading sensitive_thresholds: %w", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]int)
+	for rows.Next() {
+		var groupID string
+		var threshold int
+		if err := rows.Scan(&groupID, &threshold); err != nil {
+			return fmt.Errorf("error scanning sensitive_thresholds: %w", err)
+		}
+		loaded[groupID] = threshold
+	}
+
+	sensitiveThresholdsMu.Lock()
+	sensitiveThresholds = loaded
+	sensitiveThresholdsMu.Unlock()
+	return rows.Err()
+}
+
+// isPrivateThresholdKey 私聊没有群号,不能单独设置阈值,否则会作用于全部私聊
+func isPrivateThresholdKey(groupID string) bool {
+	return groupID == "" || groupID == "0"
+}
+
+// sensitiveThreshold 群单独设置的阈值,没有设置时或私聊时使用vertorSensitiveThreshold
+func sensitiveThreshold(groupID string) int {
+	if isPrivateThresholdKey(groupID) {
+		return config.GetVertorSensitiveThreshold()
+	}
+	sensitiveThresholdsMu.RLock()
+	threshold, ok := sensitiveThresholds[groupID]
+	sensitiveThresholdsMu.RUnlock()
+	if ok {
+		return threshold
+	}
+	return config.GetVertorSensitiveThreshold()
+}
+
+// SetSensitiveThreshold 设置群的阈值,threshold小于等于0时恢复为vertorSensitiveThreshold
+func (app *App) SetSensitiveThreshold(groupID string, threshold int) error {
+	if isPrivateThresholdKey(groupID) {
+		return fmt.Errorf("私聊不能单独设置阈值")
+	}
+	if threshold <= 0 {
+		if _, err := app.DB.Exec("DELETE FROM sensitive_thresholds WHERE group_id = ?", groupID); err != nil {
+			return fmt.Errorf("error deleting sensitive_thresholds: %w", err)
+		}
+		sensitiveThresholdsMu.Lock()
+		delete(sensitiveThresholds, groupID)
+		sensitiveThresholdsMu.Unlock()
+		return nil
+	}
+
+	if _, err := app.DB.Exec("INSERT OR REPLACE INTO sensitive_thresholds (group_id, threshold) VALUES (?, ?)", groupID, threshold); err != nil {
+		return fmt.Errorf("error saving sensitive_thresholds: %w", err)
+	}
+	sensitiveThresholdsMu.Lock()
+	sensitiveThresholds[groupID] = threshold
+	sensitiveThresholdsMu.Unlock()
+	return nil
+}
+
+// AddSensitiveEntry 计算向量并加入向量安全词,同时写入vector_sensitive.txt
+func (app *App) AddSensitiveEntry(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, fmt.Errorf("安全词不能为空")
+	}
+	exists, err := app.textExistsInDatabase(text)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, fmt.Errorf("安全词已存在")
+	}
+
+	vector, err := app.CalculateTextEmbedding(text)
+	if err != nil {
+		return 0, fmt.Errorf("计算向量时出错: %w", err)
+	}
+	id, err := app.insertVectorDataSensitive(text, vector)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(vectorSensitiveFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return id, fmt.Errorf("写入 %s 时出错: %w", vectorSensitiveFile, err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text + "\n"); err != nil {
+		return id, fmt.Errorf("写入 %s 时出错: %w", vectorSensitiveFile, err)
+	}
+	return id, nil
+}
+
+// RemoveSensitiveEntry 按编号或原文删除向量安全词的全部向量,同时从vector_sensitive.txt中移除,返回被删除的原文
+func (app *App) RemoveSensitiveEntry(arg string) (string, error) {
+	text := strings.TrimSpace(arg)
+	if id, err := strconv.ParseInt(text, 10, 64); err == nil {
+		var byID string
+		err := app.DB.QueryRow("SELECT text FROM sensitive_words WHERE id = ?", id).Scan(&byID)
+		if err == nil {
+			text = byID
+		} else if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	result, err := app.DB.Exec("DELETE FROM sensitive_words WHERE text = ?", text)
+	if err != nil {
+		return "", fmt.Errorf("error deleting sensitive_words: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return "", fmt.Errorf("没有找到安全词%s", arg)
+	}
+
+	data, err := os.ReadFile(vectorSensitiveFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return text, nil
+		}
+		return text, fmt.Errorf("读取 %s 时出错: %w", vectorSensitiveFile, err)
+	}
+	var kept []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.TrimRight(line, "\r") != text {
+			kept = append(kept, line)
+		}
+	}
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := os.WriteFile(vectorSensitiveFile, []byte(content), 0644); err != nil {
+		return text, fmt.Errorf("写入 %s 时出错: %w", vectorSensitiveFile, err)
+	}
+	return text, nil
+}
+
+// ListSensitiveEntries 分页列出向量安全词,返回当前页和总数
+func (app *App) ListSensitiveEntries(offset int, limit int) ([]sensitiveEntry, int, error) {
+	var total int
+	if err := app.DB.QueryRow("SELECT COUNT(DISTINCT text) FROM sensitive_words").Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting sensitive_words: %w", err)
+	}
+
+	rows, err := app.DB.Query("SELECT MIN(id), text, COUNT(*) FROM sensitive_words GROUP BY text ORDER BY MIN(id) LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing sensitive_words: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []sensitiveEntry
+	for rows.Next() {
+		var entry sensitiveEntry
+		if err := rows.Scan(&entry.ID, &entry.Text, &entry.Count); err != nil {
+			return nil, 0, fmt.Errorf("error scanning sensitive_words: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+// NearestSensitiveEntries 返回与文本最接近的向量安全词和汉明距离,以及文本所在的norm分组,用于调整阈值
+// 会列出其他分组的安全词,但拦截时只比较同一分组,SameBucket为false的安全词不会拦截该文本
+func (app *App) NearestSensitiveEntries(text string, n int) ([]sensitiveNearest, int64, error) {
+	vector, err := app.CalculateTextEmbedding(text)
+	if err != nil {
+		return nil, 0, fmt.Errorf("计算向量时出错: %w", err)
+	}
+	binaryVector := vectorToBinaryConcurrent(vector)
+	bucket := calculateGroupID(vector)
+	fingerprint := embeddingFingerprint()
+
+	rows, err := app.DB.Query("SELECT text, vector, group_id, model_fingerprint FROM sensitive_words")
+	if err != nil {
+		return nil, bucket, err
+	}
+	defer rows.Close()
+
+	// 同一文本有多条向量时只保留一条,同一分组的优先,其次是最近的距离
+	nearest := make(map[string]sensitiveNearest)
+	for rows.Next() {
+		var entry sensitiveNearest
+		var dbVectorBytes []byte
+		var dbFingerprint string
+		if err := rows.Scan(&entry.Text, &dbVectorBytes, &entry.Bucket, &dbFingerprint); err != nil {
+			continue
+		}
+		if dbFingerprint != fingerprint {
+			continue
+		}
+		entry.Distance = hammingDistanceOptimized(binaryVector, dbVectorBytes)
+		entry.SameBucket = entry.Bucket == bucket
+		current, ok := nearest[entry.Text]
+		if !ok || (entry.SameBucket && !current.SameBucket) ||
+			(entry.SameBucket == current.SameBucket && entry.Distance < current.Distance) {
+			nearest[entry.Text] = entry
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, bucket, err
+	}
+
+	results := make([]sensitiveNearest, 0, len(nearest))
+	for _, entry := range nearest {
+		results = append(results, entry)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance == results[j].Distance {
+			return results[i].Text < results[j].Text
+		}
+		return results[i].Distance < results[j].Distance
+	})
+	if len(results) > n {
+		results = results[:n]
+	}
+	return results, bucket, nil
+}
+
+// MatchSensitiveCommand 判断是否是管理员发出的向量安全词指令,返回指令种类和指令后面的参数
+func MatchSensitiveCommand(checkResetCommand string, userID string) (int, string) {
+	if !isAdmin(userID) {
+		return sensitiveCommandNone, ""
+	}
+
+	commands := []struct {
+		kind     int
+		commands []string
+	}{
+		{sensitiveCommandList, config.GetSensitiveListCommand()},
+		{sensitiveCommandTest, config.GetSensitiveTestCommand()},
+		{sensitiveCommandThreshold, config.GetSensitiveThresholdCommand()},
+		{sensitiveCommandRemove, config.GetSensitiveRemoveCommand()},
+		{sensitiveCommandAdd, config.GetSensitiveAddCommand()},
+	}
+	for _, group := range commands {
+		for _, command := range group.commands {
+			if command != "" && strings.HasPrefix(checkResetCommand, command) {
+				return group.kind, strings.TrimSpace(strings.TrimPrefix(checkResetCommand, command))
+			}
+		}
+	}
+	return sensitiveCommandNone, ""
+}
+
+// buildSensitiveResponse 执行向量安全词指令并组合回复
+func (app *App) buildSensitiveResponse(kind int, arg string, groupID string) string {
+	switch kind {
+	case sensitiveCommandAdd:
+		if arg == "" {
+			return "请在指令后输入要添加的安全词"
+		}
+		id, err := app.AddSensitiveEntry(arg)
+		if err != nil {
+			fmtf.Printf("添加向量安全词时出错:%v\n", err)
+			return "添加失败:" + err.Error()
+		}
+		return fmt.Sprintf("已添加安全词[%d] %s", id, arg)
+
+	case sensitiveCommandRemove:
+		if arg == "" {
+			return "请在指令后输入要删除的安全词编号或原文"
+		}
+		text, err := app.RemoveSensitiveEntry(arg)
+		if err != nil {
+			fmtf.Printf("删除向量安全词时出错:%v\n", err)
+			return "删除失败:" + err.Error()
+		}
+		return "已删除安全词 " + text
+
+	case sensitiveCommandList:
+		page, err := strconv.Atoi(arg)
+		if err != nil || page < 1 {
+			page = 1
+		}
+		entries, total, err := app.ListSensitiveEntries((page-1)*sensitiveListPageSize, sensitiveListPageSize)
+		if err != nil {
+			fmtf.Printf("获取向量安全词时出错:%v\n", err)
+			return "获取失败,请稍后再试"
+		}
+		if total == 0 {
+			return "还没有向量安全词"
+		}
+		pages := (total + sensitiveListPageSize - 1) / sensitiveListPageSize
+		var builder strings.Builder
+		builder.WriteString(fmt.Sprintf("向量安全词 第%d/%d页 共%d条:", page, pages, total))
+		for _, entry := range entries {
+			builder.WriteString(fmt.Sprintf("\n[%d] %s", entry.ID, entry.Text))
+		}
+		return builder.String()
+
+	case sensitiveCommandTest:
+		if arg == "" {
+			return "请在指令后输入要测试的句子"
+		}
+		results, bucket, err := app.NearestSensitiveEntries(arg, sensitiveTestTopN)
+		if err != nil {
+			fmtf.Printf("测试向量安全词时出错:%v\n", err)
+			return "测试失败:" + err.Error()
+		}
+		threshold := sensitiveThreshold(groupID)
+		if len(results) == 0 {
+			return fmt.Sprintf("没有可比较的安全词,当前阈值%d", threshold)
+		}
+		var builder strings.Builder
+		builder.WriteString(fmt.Sprintf("最接近的安全词(当前阈值%d,句子在分组%d,同一分组中距离小于等于阈值会被拦截):", threshold, bucket))
+		for _, result := range results {
+			mark := ""
+			if !result.SameBucket {
+				mark = fmt.Sprintf(" 分组%d,不比较", result.Bucket)
+			} else if result.Distance <= threshold {
+				mark = " 拦截"
+			}
+			builder.WriteString(fmt.Sprintf("\n%d %s%s", result.Distance, result.Text, mark))
+		}
+		return builder.String()
+
+	case sensitiveCommandThreshold:
+		if isPrivateThresholdKey(groupID) {
+			return fmt.Sprintf("私聊使用默认阈值%d,请在群中设置本群阈值", config.GetVertorSensitiveThreshold())
+		}
+		if arg == "" {
+			return fmt.Sprintf("当前阈值%d,在指令后输入数字设置本群阈值,输入0恢复默认值%d", sensitiveThreshold(groupID), config.GetVertorSensitiveThreshold())
+		}
+		threshold, err := strconv.Atoi(arg)
+		if err != nil {
+			return "阈值需要是数字"
+		}
+		if err := app.SetSensitiveThreshold(groupID, threshold); err != nil {
+			fmtf.Printf("设置向量安全词阈值时出错:%v\n", err)
+			return "设置失败,请稍后再试"
+		}
+		return fmt.Sprintf("本群阈值已设置为%d", sensitiveThreshold(groupID))
+	}
+	return ""
+}
+
+// handleSensitiveCommand 处理管理员的向量安全词指令
+func (app *App) handleSensitiveCommand(msg structs.OnebotGroupMessage, kind int, arg string, promptstr string) {
+	app.sendMemoryResponse(msg, app.buildSensitiveResponse(kind, arg, strconv.FormatInt(msg.GroupID, 10)), promptstr)
+}
+
+// handleSensitiveCommandSP 处理管理员的向量安全词指令
+func (app *App) handleSensitiveCommandSP(msg structs.OnebotGroupMessageS, kind int, arg string, promptstr string) {
+	app.sendMemoryResponseSP(msg, app.buildSensitiveResponse(kind, arg, msg.GroupID), promptstr)
+}
+
+// writeJSON 管理接口的JSON回复
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(value)
+}
+
+// SensitiveEntriesHandler 向量安全词管理接口 GET=列表(offset limit) POST=添加(text) DELETE=删除(id或text)
+func (app *App) SensitiveEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !moderation.Authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		entries, total, err := app.ListSensitiveEntries(offset, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"total": total, "entries": entries})
+
+	case http.MethodPost:
+		id, err := app.AddSensitiveEntry(r.FormValue("text"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"id": id})
+
+	case http.MethodDelete:
+		arg := query.Get("id")
+		if arg == "" {
+			arg = query.Get("text")
+		}
+		text, err := app.RemoveSensitiveEntry(arg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"removed": text})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SensitiveTestHandler 测试句子与向量安全词的距离 text=句子 group_id=群号 n=数量
+// POST时设置群的阈值 group_id=群号 threshold=阈值,0恢复默认
+func (app *App) SensitiveTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !moderation.Authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	groupID := r.FormValue("group_id")
+
+	if r.Method == http.MethodPost {
+		threshold, err := strconv.Atoi(r.FormValue("threshold"))
+		if err != nil {
+			http.Error(w, "bad threshold", http.StatusBadRequest)
+			return
+		}
+		if isPrivateThresholdKey(groupID) {
+			http.Error(w, "group_id required", http.StatusBadRequest)
+			return
+		}
+		if err := app.SetSensitiveThreshold(groupID, threshold); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"group_id": groupID, "threshold": sensitiveThreshold(groupID)})
+		return
+	}
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		n = sensitiveTestTopN
+	}
+	results, bucket, err := app.NearestSensitiveEntries(r.FormValue("text"), n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"threshold": sensitiveThreshold(groupID), "bucket": bucket, "nearest": results})
+}
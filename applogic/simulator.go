@@ -0,0 +1,358 @@
+package applogic
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+	"github.com/hoshinonyaruko/gensokyo-llm/utils"
+)
+
+// 离线剧情模拟:在内存数据库中运行完整的GensokyoHandler,conversation端点和onebot接口都由本地模拟,不请求大模型也不发送消息
+
+// SimulationDSN 模拟时使用的内存数据库,cache=shared使连接池中的连接共用同一个库
+const SimulationDSN = "file:simulation?mode=memory&cache=shared"
+
+// simulating 离线模拟时为true,此时不请求向量接口
+var simulating bool
+
+// errSimulationEmbedding 离线模拟时计算向量返回的错误
+var errSimulationEmbedding = errors.New("离线模拟时不计算向量")
+
+// 模拟消息的发送者,剧情存档的ID为两者之和
+const (
+	simulationUserID int64 = 10000
+	simulationSelfID int64 = 1
+)
+
+// simulationTrace 一轮模拟中发生的事情
+type simulationTrace struct {
+	mu       sync.Mutex
+	rules    []string
+	requests []simulationRequest
+	sent     []string
+}
+
+// simulationRequest 一次对conversation端点的请求
+type simulationRequest struct {
+	promptstr string
+	round     int
+	text      string
+	reply     string
+}
+
+// traceRule 记录本轮应用的剧情规则,只在离线模拟时生效
+func (app *App) traceRule(format string, args ...interface{}) {
+	trace := app.trace.Load()
+	if trace == nil {
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.rules = append(trace.rules, fmt.Sprintf(format, args...))
+}
+
+// PrepareSimulation 关闭需要外部服务的功能,在建表和载入词库之前调用
+// 向量接口同样不请求,知识库不检索,~语义触发词按未命中处理
+func PrepareSimulation() {
+	simulating = true
+	config.OverrideSettings(func(settings *structs.Settings) {
+		settings.Savelogs = false
+		settings.UseCache = 0
+		settings.VectorSensitiveFilter = false
+		settings.InjectionDetect = false
+		settings.AntiPromptAttackPath = ""
+		settings.UserFacts = false
+		settings.KnowledgeBases = nil
+		settings.UseAIPromptkeyboard = false
+		settings.Lotus = ""
+		settings.HttpPaths = nil
+		settings.IPWhiteList = []string{"127.0.0.1"}
+	})
+}
+
+// 一轮结束后,模拟接口持续该时间没有收到请求才开始下一轮,等待GensokyoHandler中异步发送的消息
+const (
+	simulationIdle    = 100 * time.Millisecond
+	simulationMaxWait = 5 * time.Second
+)
+
+// simulationMock 模拟的conversation端点和onebot接口,/gensokyo为真实的GensokyoHandler
+type simulationMock struct {
+	app      *App
+	mu       sync.Mutex
+	replies  []string // 按顺序使用的模拟回复,用完后原样返回请求内容
+	next     int
+	active   atomic.Int32 // 正在处理的conversation和发送消息请求
+	lastSeen atomic.Int64 // 最后一次收到请求的时间
+}
+
+func (m *simulationMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/gensokyo" {
+		m.app.GensokyoHandler(w, r)
+		return
+	}
+	m.active.Add(1)
+	defer func() {
+		m.lastSeen.Store(time.Now().UnixNano())
+		m.active.Add(-1)
+	}()
+	m.lastSeen.Store(time.Now().UnixNano())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	// onebot的发送消息接口
+	if strings.HasPrefix(r.URL.Path, "/send_") {
+		var request struct {
+			Message interface{} `json:"message"`
+		}
+		json.Unmarshal(body, &request)
+		text, ok := request.Message.(string)
+		if !ok {
+			text = string(body)
+		}
+		if trace := m.app.trace.Load(); trace != nil {
+			trace.mu.Lock()
+			trace.sent = append(trace.sent, text)
+			trace.mu.Unlock()
+		}
+		w.Write([]byte(`{"status":"ok","retcode":0,"data":{"message_id":1}}`))
+		return
+	}
+
+	// 其余路径都视为conversation端点,与真实端点一样保存QA,使上下文和存档可以正常使用
+	var msg structs.Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return
+	}
+	if msg.ConversationID == "" {
+		msg.ConversationID = utils.GenerateUUID()
+		m.app.createConversation(msg.ConversationID)
+	}
+	msg.Role = "user"
+	userMessageID, err := m.app.addMessage(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reply := m.reply(msg.Text)
+	assistantMessageID, err := m.app.addMessage(structs.Message{
+		ConversationID:  msg.ConversationID,
+		ParentMessageID: userMessageID,
+		Text:            reply,
+		Role:            "assistant",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 提示词以GensokyoHandler实际请求的为准,轮次来自剧情存档
+	promptstr := r.URL.Query().Get("prompt")
+	_, round := m.app.simulationState()
+	if trace := m.app.trace.Load(); trace != nil {
+		trace.mu.Lock()
+		trace.requests = append(trace.requests, simulationRequest{promptstr: promptstr, round: round, text: msg.Text, reply: reply})
+		trace.mu.Unlock()
+	}
+
+	// 以一行json返回,useSse为2时GensokyoHandler按行读取也能解析
+	response, _ := json.Marshal(map[string]interface{}{
+		"response":       reply,
+		"conversationId": msg.ConversationID,
+		"messageId":      assistantMessageID,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(response, '\n'))
+}
+
+// waitIdle 等待本轮异步发送的消息全部到达,使其记录在本轮中
+func (m *simulationMock) waitIdle() {
+	deadline := time.Now().Add(simulationMaxWait)
+	for time.Now().Before(deadline) {
+		time.Sleep(simulationIdle / 5)
+		if m.active.Load() == 0 && time.Since(time.Unix(0, m.lastSeen.Load())) >= simulationIdle {
+			return
+		}
+	}
+}
+
+func (m *simulationMock) reply(text string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.next < len(m.replies) {
+		m.next++
+		return m.replies[m.next-1]
+	}
+	return text
+}
+
+// simulationState 模拟用户当前的提示词和轮次,没有剧情存档时返回空的提示词
+func (app *App) simulationState() (string, int) {
+	record, err := app.FetchCustomRecord(simulationUserID + simulationSelfID)
+	if err != nil || record == nil {
+		return "", 1
+	}
+	return record.PromptStr, config.GetPromptMarksLength(record.PromptStr) - record.PromptStrStat + 1
+}
+
+// readSimulationLines 按行读取脚本,忽略空行和#开头的注释
+func readSimulationLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// RunSimulation 从promptstr开始,逐行发送scriptPath中的用户消息,输出每轮的提示词、轮次、应用的规则和最终的请求内容
+// repliesPath中为按顺序使用的模拟回复,为空或用完后原样返回请求内容,verbose为false时不输出运行日志
+func (app *App) RunSimulation(promptstr string, scriptPath string, repliesPath string, verbose bool) error {
+	lines, err := readSimulationLines(scriptPath)
+	if err != nil {
+		return fmt.Errorf("error reading simulation script: %w", err)
+	}
+	var replies []string
+	if repliesPath != "" {
+		replies, err = readSimulationLines(repliesPath)
+		if err != nil {
+			return fmt.Errorf("error reading simulation replies: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error starting simulation server: %w", err)
+	}
+	mock := &simulationMock{app: app, replies: replies}
+	server := &http.Server{Handler: mock}
+	go server.Serve(listener)
+	defer server.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	baseURL := fmt.Sprintf("http://127.0.0.1:%d", port)
+	config.OverrideSettings(func(settings *structs.Settings) {
+		settings.Port = port
+		settings.HttpPath = baseURL
+	})
+
+	out := os.Stdout
+	if !verbose {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			os.Stdout = devNull
+			log.SetOutput(io.Discard)
+			defer func() {
+				os.Stdout = out
+				log.SetOutput(os.Stderr)
+				devNull.Close()
+			}()
+		}
+	}
+
+	target := baseURL + "/gensokyo"
+	if promptstr != "" {
+		target += "?prompt=" + url.QueryEscape(promptstr)
+	}
+	defer app.trace.Store(nil)
+
+	for i, line := range lines {
+		trace := &simulationTrace{}
+		app.trace.Store(trace)
+
+		message := structs.OnebotGroupMessage{
+			RawMessage:  line,
+			MessageID:   i + 1,
+			MessageType: "private",
+			PostType:    "message",
+			SelfID:      simulationSelfID,
+			Sender:      structs.Sender{Nickname: "模拟用户", UserID: simulationUserID},
+			SubType:     "friend",
+			Time:        time.Now().Unix(),
+			Message:     line,
+			UserID:      simulationUserID,
+		}
+		body, _ := json.Marshal(message)
+		resp, err := http.Post(target, "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			return fmt.Errorf("error sending simulation message: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mock.waitIdle()
+
+		trace.mu.Lock()
+		fmt.Fprintf(out, "[%d] Q: %s\n", i+1, line)
+		for _, rule := range trace.rules {
+			fmt.Fprintf(out, "    规则: %s\n", rule)
+		}
+		if len(trace.requests) == 0 {
+			fmt.Fprintf(out, "    未请求conversation端点\n")
+		}
+		for _, request := range trace.requests {
+			fmt.Fprintf(out, "    提示词: %s 第%d轮\n", displayPromptstr(request.promptstr), request.round)
+			fmt.Fprintf(out, "    请求: %s\n", request.text)
+			fmt.Fprintf(out, "    回复: %s\n", request.reply)
+		}
+		for _, sent := range trace.sent {
+			fmt.Fprintf(out, "    发送: %s\n", sent)
+		}
+		trace.mu.Unlock()
+
+		promptstrNow, round := app.simulationState()
+		state := fmt.Sprintf("%s 第%d轮", displayPromptstr(promptstrNow), round)
+		if promptstrNow == "" {
+			state = "没有剧情存档"
+		}
+		if vars, err := app.GetStoryVars(simulationUserID + simulationSelfID); err == nil && len(vars) > 0 {
+			names := make([]string, 0, len(vars))
+			for name := range vars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				state += fmt.Sprintf(" %s=%s", name, formatStoryVar(vars[name]))
+			}
+		}
+		fmt.Fprintf(out, "    之后: %s\n", state)
+	}
+	return nil
+}
+
+// displayPromptstr 默认提示词显示为config.yml
+func displayPromptstr(promptstr string) string {
+	if promptstr == "" {
+		return "config.yml"
+	}
+	return promptstr
+}
@@ -0,0 +1,56 @@
+package applogic
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
+)
+
+// 剧情图页面,使用mermaid在浏览器中渲染
+const storyGraphPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>剧情图</title>
+<style>body{font-family:sans-serif;margin:16px}a{margin-right:12px}</style>
+</head>
+<body>
+<div><a href="?format=dot">DOT</a><a href="?format=mermaid">Mermaid</a></div>
+<pre class="mermaid">
+%s
+</pre>
+<script type="module">
+import mermaid from "https://cdn.jsdelivr.net/npm/mermaid@10/dist/mermaid.esm.min.mjs";
+mermaid.initialize({ startOnLoad: true, maxTextSize: 1000000 });
+</script>
+</body>
+</html>
+`
+
+// StoryGraphHandler 每次请求时重新解析提示词目录,format=dot或mermaid时返回文本,否则返回HTML页面
+func StoryGraphHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	graph, err := prompt.BuildGraph(config.GetSettings())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.Write([]byte(graph.DOT()))
+	case "mermaid":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(graph.Mermaid()))
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(fmt.Sprintf(storyGraphPage, html.EscapeString(graph.Mermaid()))))
+	}
+}
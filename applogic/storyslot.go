@@ -0,0 +1,343 @@
+package applogic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 剧情存档指令的种类
+const (
+	storySlotCommandNone = iota
+	storySlotCommandSave
+	storySlotCommandLoad
+	storySlotCommandList
+	storySlotCommandDelete
+)
+
+// 存档名的最大长度
+const storySlotNameMax = 32
+
+var errStorySlotFull = errors.New("story slots full")
+
+// StorySlot 一个剧情存档,同时保存对话的位置和custom_table中的剧情进度
+type StorySlot struct {
+	Name            string
+	ConversationID  string
+	ParentMessageID string
+	PromptStr       string // 为空时代表存档时没有剧情进度
+	PromptStrStat   int
+	Strs            [10]string
+	Vars            string // 数值变量,json格式
+	CreatedAt       time.Time
+}
+
+// EnsureStorySlotsTableExists 剧情存档表,user_id与custom_table一致
+func (app *App) EnsureStorySlotsTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS story_slots (
+        user_id INTEGER NOT NULL,
+        slot_name TEXT NOT NULL,
+        conversation_id TEXT NOT NULL,
+        parent_message_id TEXT,
+        promptstr TEXT NOT NULL DEFAULT '',
+        promptstr_stat INTEGER NOT NULL DEFAULT 0,
+        str1 TEXT, str2 TEXT, str3 TEXT, str4 TEXT, str5 TEXT,
+        str6 TEXT, str7 TEXT, str8 TEXT, str9 TEXT, str10 TEXT,
+        vars TEXT NOT NULL DEFAULT '',
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (user_id, slot_name)
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating story_slots table: %w", err)
+	}
+	return nil
+}
+
+// MatchStorySlotCommand 判断是否是剧情存档指令,返回指令种类和指令后面的存档名
+func MatchStorySlotCommand(checkResetCommand string) (int, string) {
+	// 先匹配列表,避免 存档列表 被 存档 误匹配
+	for _, command := range config.GetStoryListCommand() {
+		if checkResetCommand == command {
+			return storySlotCommandList, ""
+		}
+	}
+	for _, group := range []struct {
+		kind     int
+		commands []string
+	}{
+		{storySlotCommandDelete, config.GetStoryDeleteCommand()},
+		{storySlotCommandLoad, config.GetStoryLoadCommand()},
+		{storySlotCommandSave, config.GetStorySaveCommand()},
+	} {
+		for _, command := range group.commands {
+			if command != "" && strings.HasPrefix(checkResetCommand, command) {
+				arg := strings.TrimSpace(strings.TrimPrefix(checkResetCommand, command))
+				if group.kind == storySlotCommandLoad && arg == "" {
+					return storySlotCommandList, ""
+				}
+				return group.kind, arg
+			}
+		}
+	}
+	return storySlotCommandNone, ""
+}
+
+// GetStorySlots 用户的全部存档,最新的在前
+func (app *App) GetStorySlots(userID int64) ([]StorySlot, error) {
+	rows, err := app.DB.Query(`
+    SELECT slot_name, conversation_id, COALESCE(parent_message_id, ''), promptstr, promptstr_stat,
+        COALESCE(str1, ''), COALESCE(str2, ''), COALESCE(str3, ''), COALESCE(str4, ''), COALESCE(str5, ''),
+        COALESCE(str6, ''), COALESCE(str7, ''), COALESCE(str8, ''), COALESCE(str9, ''), COALESCE(str10, ''),
+        vars, created_at
+    FROM story_slots WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying story_slots: %w", err)
+	}
+	defer rows.Close()
+
+	var slots []StorySlot
+	for rows.Next() {
+		var slot StorySlot
+		scanArgs := []interface{}{&slot.Name, &slot.ConversationID, &slot.ParentMessageID, &slot.PromptStr, &slot.PromptStrStat}
+		for i := range slot.Strs {
+			scanArgs = append(scanArgs, &slot.Strs[i])
+		}
+		scanArgs = append(scanArgs, &slot.Vars, &slot.CreatedAt)
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, fmt.Errorf("error scanning story_slots: %w", err)
+		}
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
+
+// findStorySlot 优先完全匹配,其次按名字开头匹配最新的存档
+func findStorySlot(slots []StorySlot, name string) *StorySlot {
+	for i := range slots {
+		if slots[i].Name == name {
+			return &slots[i]
+		}
+	}
+	for i := range slots {
+		if strings.HasPrefix(slots[i].Name, name) {
+			return &slots[i]
+		}
+	}
+	return nil
+}
+
+// SaveStorySlot 保存当前的对话位置和剧情进度,同名存档覆盖,新存档超过storySlotLimit时返回errStorySlotFull
+func (app *App) SaveStorySlot(userID int64, name string, conversationID string, parentMessageID string) error {
+	slots, err := app.GetStorySlots(userID)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, slot := range slots {
+		if slot.Name == name {
+			exists = true
+			break
+		}
+	}
+	if !exists && len(slots) >= config.GetStorySlotLimit() {
+		return errStorySlotFull
+	}
+
+	slot := StorySlot{Name: name, ConversationID: conversationID, ParentMessageID: parentMessageID, CreatedAt: time.Now()}
+	record, err := app.FetchCustomRecord(userID, templateRecordFields...)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		slot.PromptStr = record.PromptStr
+		slot.PromptStrStat = record.PromptStrStat
+		slot.Strs = record.Strs
+	}
+	vars, err := app.GetStoryVars(userID)
+	if err != nil {
+		return err
+	}
+	slot.Vars = encodeStoryVars(vars)
+
+	params := []interface{}{userID, slot.Name, slot.ConversationID, slot.ParentMessageID, slot.PromptStr, slot.PromptStrStat}
+	for _, str := range slot.Strs {
+		params = append(params, str)
+	}
+	params = append(params, slot.Vars, slot.CreatedAt)
+	_, err = app.DB.Exec(`
+    INSERT OR REPLACE INTO story_slots (user_id, slot_name, conversation_id, parent_message_id, promptstr, promptstr_stat,
+        str1, str2, str3, str4, str5, str6, str7, str8, str9, str10, vars, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, params...)
+	if err != nil {
+		return fmt.Errorf("error saving story slot: %w", err)
+	}
+	return nil
+}
+
+// LoadStorySlot 在同一个事务中恢复对话位置、剧情进度和数值变量,存档时没有剧情进度则清除当前进度
+func (app *App) LoadStorySlot(userID int64, slot StorySlot) error {
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE user_context SET conversation_id = ?, parent_message_id = ? WHERE user_id = ?`,
+		slot.ConversationID, slot.ParentMessageID, userID)
+	if err != nil {
+		return fmt.Errorf("error updating user context: %w", err)
+	}
+
+	if slot.PromptStr == "" {
+		_, err = tx.Exec(`DELETE FROM custom_table WHERE user_id = ?`, userID)
+	} else {
+		params := []interface{}{userID, slot.PromptStr, slot.PromptStrStat}
+		for _, str := range slot.Strs {
+			params = append(params, str)
+		}
+		_, err = tx.Exec(`
+    INSERT OR REPLACE INTO custom_table (user_id, promptstr, promptstr_stat, str1, str2, str3, str4, str5, str6, str7, str8, str9, str10)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, params...)
+	}
+	if err != nil {
+		return fmt.Errorf("error restoring custom_table: %w", err)
+	}
+	if err := replaceStoryVars(tx, userID, slot.Vars); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteStorySlot 删除存档,返回是否存在
+func (app *App) DeleteStorySlot(userID int64, name string) (bool, error) {
+	result, err := app.DB.Exec(`DELETE FROM story_slots WHERE user_id = ? AND slot_name = ?`, userID, name)
+	if err != nil {
+		return false, fmt.Errorf("error deleting story slot: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// storySlotSummary 存档的说明,如 森林 第2轮 10-18 19:00
+func storySlotSummary(slot StorySlot) string {
+	progress := "无剧情"
+	if slot.PromptStr != "" {
+		round := config.GetPromptMarksLength(slot.PromptStr) - slot.PromptStrStat + 1
+		if round < 1 {
+			round = 1
+		}
+		progress = fmt.Sprintf("%s 第%d轮", slot.PromptStr, round)
+	}
+	return fmt.Sprintf("%s - %s %s", slot.Name, progress, slot.CreatedAt.Format("01-02 15:04"))
+}
+
+// firstCommand 指令列表中的第一个,用于提示和按钮
+func firstCommand(commands []string, fallback string) string {
+	if len(commands) > 0 && commands[0] != "" {
+		return commands[0]
+	}
+	return fallback
+}
+
+// handleStorySlotCommand 处理存档、读档、存档列表和删档指令
+func (app *App) handleStorySlotCommand(msg structs.OnebotGroupMessage, kind int, arg string, conversationID string, parentMessageID string, promptstr string) {
+	userID := storyUserID(&msg)
+	loadCommand := firstCommand(config.GetStoryLoadCommand(), "未设置读档指令")
+
+	switch kind {
+	case storySlotCommandSave:
+		name := arg
+		if name == "" {
+			name = time.Now().Format("01-02 15:04")
+		}
+		if len([]rune(name)) > storySlotNameMax {
+			name = string([]rune(name)[:storySlotNameMax])
+		}
+		err := app.SaveStorySlot(userID, name, conversationID, parentMessageID)
+		if errors.Is(err, errStorySlotFull) {
+			response := fmt.Sprintf("存档已满(最多%d个),请先发送 %s 名字 删除旧的存档", config.GetStorySlotLimit(), firstCommand(config.GetStoryDeleteCommand(), "未设置删档指令"))
+			app.sendMemoryResponse(msg, response, promptstr)
+			return
+		}
+		if err != nil {
+			fmtf.Printf("保存剧情存档出错:%v\n", err)
+			app.sendMemoryResponse(msg, "存档失败", promptstr)
+			return
+		}
+		app.sendMemoryResponseWithkeyBoard(msg, fmt.Sprintf("已存档:%s", name), []string{loadCommand + " " + name}, promptstr)
+
+	case storySlotCommandLoad:
+		slots, err := app.GetStorySlots(userID)
+		if err != nil {
+			fmtf.Printf("读取剧情存档出错:%v\n", err)
+			app.sendMemoryResponse(msg, "获取存档失败", promptstr)
+			return
+		}
+		slot := findStorySlot(slots, arg)
+		if slot == nil {
+			app.sendMemoryResponse(msg, "未找到匹配的存档", promptstr)
+			return
+		}
+		if err := app.LoadStorySlot(userID, *slot); err != nil {
+			fmtf.Printf("载入剧情存档出错:%v\n", err)
+			app.sendMemoryResponse(msg, "读档失败", promptstr)
+			return
+		}
+		app.sendMemoryResponse(msg, fmt.Sprintf("已读档:%s", acnode.CheckWordOUT(storySlotSummary(*slot))), promptstr)
+
+	case storySlotCommandList:
+		slots, err := app.GetStorySlots(userID)
+		if err != nil {
+			fmtf.Printf("读取剧情存档出错:%v\n", err)
+			app.sendMemoryResponse(msg, "获取存档失败", promptstr)
+			return
+		}
+		var responseBuilder strings.Builder
+		responseBuilder.WriteString(fmt.Sprintf("当前存档(%d/%d)：\n", len(slots), config.GetStorySlotLimit()))
+		var keyboard []string
+		for _, slot := range slots {
+			slot.Name = acnode.CheckWordOUT(slot.Name)
+			if config.GetMemoryListMD() == 0 {
+				responseBuilder.WriteString(storySlotSummary(slot) + "\n")
+			}
+			keyboard = append(keyboard, loadCommand+" "+slot.Name)
+		}
+		if config.GetMemoryListMD() == 0 {
+			responseBuilder.WriteString(fmt.Sprintf("提示：发送 %s 存档名即可读档", loadCommand))
+		} else if len(keyboard) == 0 {
+			responseBuilder.WriteString(fmt.Sprintf("目前还没有存档...发送 %s 名字 保存当前进度吧", firstCommand(config.GetStorySaveCommand(), "未设置存档指令")))
+		} else {
+			responseBuilder.WriteString("点击蓝色文字读档")
+		}
+		app.sendMemoryResponseByline(msg, responseBuilder.String(), keyboard, promptstr)
+
+	case storySlotCommandDelete:
+		if arg == "" {
+			app.sendMemoryResponse(msg, "请在指令后加上要删除的存档名", promptstr)
+			return
+		}
+		deleted, err := app.DeleteStorySlot(userID, arg)
+		if err != nil {
+			fmtf.Printf("删除剧情存档出错:%v\n", err)
+			app.sendMemoryResponse(msg, "删除存档失败", promptstr)
+			return
+		}
+		if !deleted {
+			app.sendMemoryResponse(msg, "未找到该存档", promptstr)
+			return
+		}
+		app.sendMemoryResponse(msg, fmt.Sprintf("已删除存档:%s", arg), promptstr)
+	}
+}
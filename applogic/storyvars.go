@@ -0,0 +1,194 @@
+package applogic
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// EnsureStoryVarsTableExists 剧情数值变量表,user_id与custom_table一致
+func (app *App) EnsureStoryVarsTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS story_vars (
+        user_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        value REAL NOT NULL DEFAULT 0,
+        PRIMARY KEY (user_id, name)
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating story_vars table: %w", err)
+	}
+	return nil
+}
+
+// GetStoryVars 用户的全部数值变量,未设置过的变量不在其中,按0处理
+func (app *App) GetStoryVars(userID int64) (map[string]float64, error) {
+	rows, err := app.DB.Query(`SELECT name, value FROM story_vars WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying story_vars: %w", err)
+	}
+	defer rows.Close()
+
+	vars := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("error scanning story_vars: %w", err)
+		}
+		vars[name] = value
+	}
+	return vars, rows.Err()
+}
+
+// changeStoryVar 修改数值变量并返回修改后的值
+func (app *App) changeStoryVar(userID int64, name string, change prompt.VarChange) (float64, error) {
+	sqlStr := `INSERT INTO story_vars (user_id, name, value) VALUES (?, ?, ?)
+    ON CONFLICT(user_id, name) DO UPDATE SET value = value + excluded.value`
+	if change.Set {
+		sqlStr = `INSERT INTO story_vars (user_id, name, value) VALUES (?, ?, ?)
+    ON CONFLICT(user_id, name) DO UPDATE SET value = excluded.value`
+	}
+	if _, err := app.DB.Exec(sqlStr, userID, name, change.Value); err != nil {
+		return 0, fmt.Errorf("error changing %s in story_vars: %w", name, err)
+	}
+
+	var value float64
+	err := app.DB.QueryRow(`SELECT value FROM story_vars WHERE user_id = ? AND name = ?`, userID, name).Scan(&value)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s from story_vars: %w", name, err)
+	}
+	return value, nil
+}
+
+// deleteStoryVars 重置和退出剧情时清空数值变量
+func (app *App) deleteStoryVars(userID int64) error {
+	_, err := app.DB.Exec(`DELETE FROM story_vars WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting records from story_vars: %w", err)
+	}
+	return nil
+}
+
+// encodeStoryVars 存档时保存的数值变量
+func encodeStoryVars(vars map[string]float64) string {
+	if len(vars) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// replaceStoryVars 读档时在事务中替换全部数值变量
+func replaceStoryVars(tx *sql.Tx, userID int64, encoded string) error {
+	vars := make(map[string]float64)
+	if encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &vars); err != nil {
+			return fmt.Errorf("error decoding story vars: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM story_vars WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("error deleting records from story_vars: %w", err)
+	}
+	for name, value := range vars {
+		if _, err := tx.Exec(`INSERT INTO story_vars (user_id, name, value) VALUES (?, ?, ?)`, userID, name, value); err != nil {
+			return fmt.Errorf("error restoring story_vars: %w", err)
+		}
+	}
+	return nil
+}
+
+// formatStoryVar 数值变量在模板中的写法,整数不带小数点
+func formatStoryVar(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// storyConditionMet 判断数值变量条件是否成立,未设置条件时总是成立,无效的条件视为不成立
+func (app *App) storyConditionMet(userID int64, condition string, rule string) bool {
+	if condition == "" {
+		return true
+	}
+	parsed, err := prompt.ParseCondition(condition)
+	if err != nil {
+		fmtf.Printf("条件[%s]无效:%v\n", rule, err)
+		return false
+	}
+	vars, err := app.GetStoryVars(userID)
+	if err != nil {
+		fmtf.Printf("读取数值变量出错:%v\n", err)
+		return false
+	}
+	met := parsed.Eval(vars)
+	fmtf.Printf("条件[%s] %s:%v,当前变量:%v\n", rule, condition, met, vars)
+	return met
+}
+
+// availablePromptMarks 满足条件的promptMarks分支
+func (app *App) availablePromptMarks(userID int64, promptstr string) []structs.BranchConfig {
+	var marks []structs.BranchConfig
+	for _, mark := range config.GetPromptMarks(promptstr) {
+		if app.storyConditionMet(userID, mark.Condition, fmt.Sprintf("%s promptMarks %s", promptstr, mark.BranchName)) {
+			marks = append(marks, mark)
+		}
+	}
+	return marks
+}
+
+// applyChangeVars 在当前轮次命中关键词时修改数值变量,多条命中的规则依次生效
+func (app *App) applyChangeVars(changeVars []structs.PromptChangeVar, text string, promptstr string, message *structs.OnebotGroupMessage) {
+	if len(changeVars) == 0 {
+		return
+	}
+	userID := storyUserID(message)
+	round, _ := strconv.Atoi(app.messageTemplateVars(message, promptstr)["round"])
+
+	for _, changeVar := range changeVars {
+		if changeVar.Round != 0 && changeVar.Round != round {
+			continue
+		}
+		if len(changeVar.Keywords) != 0 {
+			rule := fmt.Sprintf("%s changeVars %s", promptstr, changeVar.Var)
+			if len(app.matchTriggers(text, changeVar.Keywords, rule)) == 0 {
+				continue
+			}
+		}
+
+		if !prompt.ValidVarName(changeVar.Var) {
+			fmtf.Printf("数值变量名%q无效\n", changeVar.Var)
+			continue
+		}
+		change, err := prompt.ParseVarChange(changeVar.Change)
+		if err != nil {
+			fmtf.Printf("数值变量%s的修改无效:%v\n", changeVar.Var, err)
+			continue
+		}
+		value, err := app.changeStoryVar(userID, changeVar.Var, change)
+		if err != nil {
+			fmtf.Printf("修改数值变量时出错:%v\n", err)
+			continue
+		}
+		fmtf.Printf("数值变量%s %s,当前为:%s\n", changeVar.Var, changeVar.Change, formatStoryVar(value))
+		app.traceRule("changeVars %s %s = %s", changeVar.Var, changeVar.Change, formatStoryVar(value))
+	}
+}
+
+// ApplyChangeVarsQ 用户的Q命中changeVarsQ的关键词时修改数值变量
+func (app *App) ApplyChangeVarsQ(promptstr string, requestmsg string, message *structs.OnebotGroupMessage) {
+	app.applyChangeVars(config.GetChangeVarsQ(promptstr), requestmsg, promptstr, message)
+}
+
+// ApplyChangeVarsA 模型的A命中changeVarsA的关键词时修改数值变量
+func (app *App) ApplyChangeVarsA(promptstr string, response string, message *structs.OnebotGroupMessage) {
+	app.applyChangeVars(config.GetChangeVarsA(promptstr), response, promptstr, message)
+}
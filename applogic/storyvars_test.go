@@ -0,0 +1,93 @@
+package applogic
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newStoryVarsApp 使用内存数据库,只有一个连接,避免每个连接各自一个库
+func newStoryVarsApp(t *testing.T) *App {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open error: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	app := &App{DB: db}
+	if err := app.EnsureStoryVarsTableExists(); err != nil {
+		t.Fatalf("EnsureStoryVarsTableExists error: %v", err)
+	}
+	return app
+}
+
+func mustChangeStoryVar(t *testing.T, app *App, userID int64, name string, change string) float64 {
+	t.Helper()
+	parsed, err := prompt.ParseVarChange(change)
+	if err != nil {
+		t.Fatalf("ParseVarChange(%q) error: %v", change, err)
+	}
+	value, err := app.changeStoryVar(userID, name, parsed)
+	if err != nil {
+		t.Fatalf("changeStoryVar(%d, %q, %q) error: %v", userID, name, change, err)
+	}
+	return value
+}
+
+func TestChangeStoryVarStartsFromZero(t *testing.T) {
+	app := newStoryVarsApp(t)
+
+	if got := mustChangeStoryVar(t, app, 1, "affection", "+5"); got != 5 {
+		t.Errorf("first +5 = %v, want 5", got)
+	}
+	if got := mustChangeStoryVar(t, app, 1, "gold", "-3"); got != -3 {
+		t.Errorf("first -3 = %v, want -3", got)
+	}
+	if got := mustChangeStoryVar(t, app, 1, "trust", "=10"); got != 10 {
+		t.Errorf("first =10 = %v, want 10", got)
+	}
+}
+
+func TestChangeStoryVarAccumulatesAndSets(t *testing.T) {
+	app := newStoryVarsApp(t)
+
+	mustChangeStoryVar(t, app, 1, "affection", "+5")
+	if got := mustChangeStoryVar(t, app, 1, "affection", "+0.5"); got != 5.5 {
+		t.Errorf("+5 then +0.5 = %v, want 5.5", got)
+	}
+	if got := mustChangeStoryVar(t, app, 1, "affection", "=2"); got != 2 {
+		t.Errorf("=2 = %v, want 2", got)
+	}
+	if got := mustChangeStoryVar(t, app, 1, "affection", "-3"); got != -1 {
+		t.Errorf("=2 then -3 = %v, want -1", got)
+	}
+}
+
+func TestChangeStoryVarPerUser(t *testing.T) {
+	app := newStoryVarsApp(t)
+
+	mustChangeStoryVar(t, app, 1, "affection", "+5")
+	mustChangeStoryVar(t, app, 2, "affection", "+1")
+
+	vars, err := app.GetStoryVars(1)
+	if err != nil {
+		t.Fatalf("GetStoryVars error: %v", err)
+	}
+	if vars["affection"] != 5 || len(vars) != 1 {
+		t.Errorf("GetStoryVars(1) = %v, want map[affection:5]", vars)
+	}
+
+	if err := app.deleteStoryVars(1); err != nil {
+		t.Fatalf("deleteStoryVars error: %v", err)
+	}
+	if vars, _ := app.GetStoryVars(1); len(vars) != 0 {
+		t.Errorf("GetStoryVars(1) after delete = %v, want empty", vars)
+	}
+	if vars, _ := app.GetStoryVars(2); vars["affection"] != 1 {
+		t.Errorf("GetStoryVars(2) after deleting user 1 = %v, want map[affection:1]", vars)
+	}
+}
@@ -0,0 +1,30 @@
+package applogic
+
+import (
+	"sync"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+)
+
+// 每个流式回复的敏感词过滤器,key与groupUserMessages相同
+var streamFilters sync.Map
+
+// streamFilterPush 输出也进行过滤时,经过流式过滤器,返回可以发送的部分,末尾可能组成敏感词的部分会保留到下一次
+func streamFilterPush(key string, text string, promptstr string) string {
+	if config.GetSensitiveModeType() != 1 {
+		return text
+	}
+	value, _ := streamFilters.LoadOrStore(key, acnode.NewStreamFilter(config.GetSensitiveDicts(promptstr)))
+	return value.(*acnode.StreamFilter).Push(text)
+}
+
+// streamFilterFinish 流结束时调用,返回最后一段文本和过滤器中保留的全部文本
+func streamFilterFinish(key string, text string) string {
+	value, ok := streamFilters.LoadAndDelete(key)
+	if !ok {
+		return text
+	}
+	filter := value.(*acnode.StreamFilter)
+	return filter.Push(text) + filter.Flush()
+}
@@ -0,0 +1,166 @@
+package applogic
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+	"github.com/hoshinonyaruko/gensokyo-llm/utils"
+)
+
+// 剧情存档中可以作为模板变量的字段
+var templateRecordFields = []string{"str1", "str2", "str3", "str4", "str5", "str6", "str7", "str8", "str9", "str10"}
+
+// storyUserID 剧情存档的ID,与flow.go一致,群上下文时整个群共用
+func storyUserID(message *structs.OnebotGroupMessage) int64 {
+	if config.GetGroupContext() == 2 && message.MessageType != "private" {
+		return message.GroupID + message.SelfID
+	}
+	return message.UserID + message.SelfID
+}
+
+// messageTemplateVars 消息的模板变量,加上剧情存档中的轮次{{round}}、str1到str10和数值变量
+func (app *App) messageTemplateVars(message *structs.OnebotGroupMessage, promptstr string) map[string]string {
+	vars := utils.MessageTemplateVars(*message, promptstr)
+
+	record, err := app.FetchCustomRecord(storyUserID(message), templateRecordFields...)
+	if err != nil {
+		fmtf.Printf("读取模板变量时出错:%v\n", err)
+	}
+	round := 1
+	if record != nil {
+		round = config.GetPromptMarksLength(promptstr) - record.PromptStrStat + 1
+		for i, field := range templateRecordFields {
+			vars[field] = record.Strs[i]
+		}
+	} else {
+		for _, field := range templateRecordFields {
+			vars[field] = ""
+		}
+	}
+	vars["round"] = strconv.Itoa(round)
+
+	// 数值变量,与内置变量同名时以内置变量为准
+	storyVars, err := app.GetStoryVars(storyUserID(message))
+	if err != nil {
+		fmtf.Printf("读取数值变量时出错:%v\n", err)
+	}
+	for name, value := range storyVars {
+		if _, ok := vars[name]; !ok {
+			vars[name] = formatStoryVar(value)
+		}
+	}
+	return vars
+}
+
+// renderMessageTemplate 用消息的模板变量渲染replaceText、envContents和固定回复
+func (app *App) renderMessageTemplate(text string, message *structs.OnebotGroupMessage, promptstr string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	return utils.RenderTemplate(text, app.messageTemplateVars(message, promptstr))
+}
+
+// renderConversationTemplate conversation端点渲染提示词,vars为请求中携带的模板变量
+// 同一个对话可能由群里的不同成员发起,变量随每次请求传递,不按对话保存
+// 没有携带变量的请求(如直接调用conversation端点)只有日期时间等变量
+func renderConversationTemplate(vars map[string]string, promptstr string, text string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	if vars == nil {
+		vars = utils.TemplateVars("", "", "", "", promptstr)
+	}
+	return utils.RenderTemplate(text, vars)
+}
+
+// templateSystemMessageStruct 渲染后的第一条系统提示词
+func templateSystemMessageStruct(vars map[string]string, promptstr string) (structs.Message, error) {
+	message, err := prompt.GetFirstSystemMessageStruct(promptstr)
+	if err != nil {
+		return message, err
+	}
+	// ||的随机选择在渲染前进行,变量的值中可能含有||
+	if strings.Contains(message.Text, "||") {
+		contents := strings.Split(message.Text, "||")
+		message.Text = contents[rand.Intn(len(contents))]
+	}
+	message.Text = renderConversationTemplate(vars, promptstr, message.Text)
+	return message, nil
+}
+
+// templateMessagesExcludingSystem 渲染后的系统QA
+func templateMessagesExcludingSystem(vars map[string]string, promptstr string) ([]structs.Message, error) {
+	history, err := prompt.GetMessagesExcludingSystem(promptstr)
+	for i := range history {
+		history[i].Text = renderConversationTemplate(vars, promptstr, history[i].Text)
+	}
+	return history, err
+}
+
+// setStoryVar 设置剧情存档中的变量,没有存档时以当前提示词创建,初始状态与GensokyoHandler一致
+func (app *App) setStoryVar(userID int64, promptstr string, field string, value string) error {
+	if fieldIndex(field) < 0 {
+		return fmt.Errorf("unknown story var: %s", field)
+	}
+	stat := 1
+	if config.GetPromptMarksLength(promptstr) > 1000 {
+		stat = config.GetPromptMarksLength(promptstr)
+	}
+	sqlStr := fmt.Sprintf(`INSERT INTO custom_table (user_id, promptstr, promptstr_stat, %s) VALUES (?, ?, ?, ?)
+    ON CONFLICT(user_id) DO UPDATE SET %s = excluded.%s`, field, field, field)
+	_, err := app.DB.Exec(sqlStr, userID, promptstr, stat, value)
+	if err != nil {
+		return fmt.Errorf("error setting %s in custom_table: %w", field, err)
+	}
+	return nil
+}
+
+// applySetVars 在当前轮次命中关键词时设置剧情变量,同一变量以最后一条命中的规则为准
+func (app *App) applySetVars(setVars []structs.PromptSetVar, text string, promptstr string, message *structs.OnebotGroupMessage) {
+	if len(setVars) == 0 {
+		return
+	}
+	userID := storyUserID(message)
+	vars := app.messageTemplateVars(message, promptstr)
+	round, _ := strconv.Atoi(vars["round"])
+
+	for _, setVar := range setVars {
+		if setVar.Round != 0 && setVar.Round != round {
+			continue
+		}
+		match := ""
+		if len(setVar.Keywords) != 0 {
+			matched := app.matchTriggers(text, setVar.Keywords, fmt.Sprintf("%s setVars %s", promptstr, setVar.Var))
+			if len(matched) == 0 {
+				continue
+			}
+			match = matched[0]
+		}
+
+		vars["match"] = match
+		value := utils.RenderTemplate(setVar.Value, vars)
+		if err := app.setStoryVar(userID, promptstr, setVar.Var, value); err != nil {
+			fmtf.Printf("设置剧情变量时出错:%v\n", err)
+			continue
+		}
+		vars[setVar.Var] = value
+		fmtf.Printf("剧情变量%s设置为:%s\n", setVar.Var, value)
+		app.traceRule("setVars %s = %s", setVar.Var, value)
+	}
+}
+
+// ApplySetVarsQ 用户的Q命中setVarsQ的关键词时设置剧情变量
+func (app *App) ApplySetVarsQ(promptstr string, requestmsg string, message *structs.OnebotGroupMessage) {
+	app.applySetVars(config.GetSetVarsQ(promptstr), requestmsg, promptstr, message)
+}
+
+// ApplySetVarsA 模型的A命中setVarsA的关键词时设置剧情变量
+func (app *App) ApplySetVarsA(promptstr string, response string, message *structs.OnebotGroupMessage) {
+	app.applySetVars(config.GetSetVarsA(promptstr), response, promptstr, message)
+}
@@ -0,0 +1,144 @@
+package applogic
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 剧情触发词的写法,没有前缀时与原来一样按包含匹配
+// re:正则 !排除词(可与re:和~组合,如!re:不想.*) ~语义例句(与例句的向量余弦相似度达到semanticTriggerThreshold即命中)
+const (
+	triggerRegexPrefix    = "re:"
+	triggerNegatePrefix   = "!"
+	triggerSemanticPrefix = "~"
+)
+
+// 编译过的正则,无效的正则保存为nil
+var triggerRegexps sync.Map
+
+// matchTriggers 返回文本命中的触发词,命中任意一个排除词时整条规则不命中
+// 返回值为命中的内容:包含匹配为触发词本身,正则为匹配到的文本,语义为例句,rule用于日志
+func (app *App) matchTriggers(text string, keywords []string, rule string) []string {
+	var matched []string
+	var reasons []string
+	var vector []float64
+	embed := func() []float64 {
+		if vector == nil {
+			var err error
+			vector, err = app.CalculateTextEmbedding(text)
+			if err != nil {
+				fmtf.Printf("触发词[%s]计算语义向量出错:%v\n", rule, err)
+				vector = []float64{}
+			}
+		}
+		return vector
+	}
+
+	for _, keyword := range keywords {
+		negate := strings.HasPrefix(keyword, triggerNegatePrefix)
+		value, reason, ok := app.matchTrigger(text, strings.TrimPrefix(keyword, triggerNegatePrefix), embed)
+		if !ok {
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
+			continue
+		}
+		if negate {
+			fmtf.Printf("触发词[%s]未命中:%s,被排除词%q排除\n", rule, reason, keyword)
+			return nil
+		}
+		matched = append(matched, value)
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) > 0 {
+		if len(matched) > 0 {
+			fmtf.Printf("触发词[%s]命中:%s\n", rule, strings.Join(reasons, ";"))
+		} else {
+			fmtf.Printf("触发词[%s]未命中:%s\n", rule, strings.Join(reasons, ";"))
+		}
+	}
+	return matched
+}
+
+// matchTrigger 匹配单个触发词,未命中时的reason只记录语义匹配的相似度等有助于调试的信息
+func (app *App) matchTrigger(text string, keyword string, embed func() []float64) (string, string, bool) {
+	switch {
+	case strings.HasPrefix(keyword, triggerRegexPrefix):
+		pattern := strings.TrimPrefix(keyword, triggerRegexPrefix)
+		re := triggerRegexp(pattern)
+		if re == nil {
+			return "", "", false
+		}
+		value := re.FindString(text)
+		if value == "" && !re.MatchString(text) {
+			return "", "", false
+		}
+		return value, fmt.Sprintf("正则%q匹配%q", pattern, value), true
+
+	case strings.HasPrefix(keyword, triggerSemanticPrefix):
+		example := strings.TrimPrefix(keyword, triggerSemanticPrefix)
+		if simulating {
+			app.traceRule("语义触发词%q: 离线模拟时按未命中处理", example)
+			return "", fmt.Sprintf("语义%q离线模拟时不匹配", example), false
+		}
+		vector := embed()
+		if len(vector) == 0 {
+			return "", "", false
+		}
+		exampleVector, err := app.CalculateTextEmbedding(example)
+		if err != nil {
+			fmtf.Printf("计算语义例句%q的向量出错:%v\n", example, err)
+			return "", "", false
+		}
+		threshold := config.GetSemanticTriggerThreshold()
+		similarity := cosineSimilarity(vector, exampleVector)
+		if similarity < threshold {
+			return "", fmt.Sprintf("语义%q相似度%.3f<%.3f", example, similarity, threshold), false
+		}
+		return example, fmt.Sprintf("语义%q相似度%.3f>=%.3f", example, similarity, threshold), true
+
+	default:
+		if keyword == "" || !strings.Contains(text, keyword) {
+			return "", "", false
+		}
+		return keyword, fmt.Sprintf("包含%q", keyword), true
+	}
+}
+
+// triggerRegexp 编译并缓存触发词中的正则
+func triggerRegexp(pattern string) *regexp.Regexp {
+	if cached, ok := triggerRegexps.Load(pattern); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmtf.Printf("触发词中的正则%q无效:%v\n", pattern, err)
+		re = nil
+	}
+	triggerRegexps.Store(pattern, re)
+	return re
+}
+
+// cosineSimilarity 两个向量的余弦相似度,长度不同或为零向量时返回0
+func cosineSimilarity(a []float64, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
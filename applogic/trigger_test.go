@@ -0,0 +1,72 @@
+package applogic
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMatchTriggersKeywords(t *testing.T) {
+	app := &App{}
+
+	// 没有前缀的触发词与原来一样按包含匹配,返回全部命中的触发词
+	if got := app.matchTriggers("我想去森林和城堡", []string{"森林", "城堡", "海边"}, "switchOnQ"); !reflect.DeepEqual(got, []string{"森林", "城堡"}) {
+		t.Errorf("matched %q, want 森林 and 城堡", got)
+	}
+	if got := app.matchTriggers("我想去海边", []string{"森林", ""}, "switchOnQ"); got != nil {
+		t.Errorf("matched %q, want nothing", got)
+	}
+}
+
+func TestMatchTriggersRegex(t *testing.T) {
+	app := &App{}
+
+	// 正则返回匹配到的文本
+	if got := app.matchTriggers("我要买三把剑", []string{`re:买.把`}, "switchOnQ"); !reflect.DeepEqual(got, []string{"买三把"}) {
+		t.Errorf("matched %q, want 买三把", got)
+	}
+	if got := app.matchTriggers("我要卖剑", []string{`re:买.把`}, "switchOnQ"); got != nil {
+		t.Errorf("matched %q, want nothing", got)
+	}
+	// 无效的正则视为未命中,不影响同一规则中的其他触发词
+	if got := app.matchTriggers("abc", []string{"re:(", "abc"}, "switchOnQ"); !reflect.DeepEqual(got, []string{"abc"}) {
+		t.Errorf("matched %q, want abc", got)
+	}
+}
+
+func TestMatchTriggersNegation(t *testing.T) {
+	app := &App{}
+
+	// 排除词的位置不影响结果,也可以是正则
+	for _, keywords := range [][]string{{"森林", "!不想"}, {"!不想", "森林"}, {"森林", "!re:不.*去"}} {
+		if got := app.matchTriggers("我一点也不想去森林", keywords, "switchOnQ"); got != nil {
+			t.Errorf("%q matched %q, want excluded", keywords, got)
+		}
+	}
+	if got := app.matchTriggers("我想去森林", []string{"森林", "!不想"}, "switchOnQ"); !reflect.DeepEqual(got, []string{"森林"}) {
+		t.Errorf("matched %q, want 森林", got)
+	}
+	// 只有排除词的规则不会命中
+	if got := app.matchTriggers("随便说点什么", []string{"!不想"}, "switchOnQ"); got != nil {
+		t.Errorf("matched %q, want nothing", got)
+	}
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	if got := cosineSimilarity([]float64{1, 2, 3}, []float64{2, 4, 6}); math.Abs(got-1) > 1e-9 {
+		t.Errorf("parallel vectors: %v, want 1", got)
+	}
+	if got := cosineSimilarity([]float64{1, 0}, []float64{0, 1}); got != 0 {
+		t.Errorf("orthogonal vectors: %v, want 0", got)
+	}
+	if got := cosineSimilarity([]float64{1, 1}, []float64{-1, -1}); math.Abs(got+1) > 1e-9 {
+		t.Errorf("opposite vectors: %v, want -1", got)
+	}
+	// 计算向量失败或换了向量模型时长度不同,按不相似处理
+	if got := cosineSimilarity([]float64{1, 2}, []float64{1, 2, 3}); got != 0 {
+		t.Errorf("different lengths: %v, want 0", got)
+	}
+	if got := cosineSimilarity([]float64{0, 0}, []float64{1, 2}); got != 0 {
+		t.Errorf("zero vector: %v, want 0", got)
+	}
+}
@@ -0,0 +1,397 @@
+package applogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/promptkb"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 单条事实的最大长度(字),超过的视为提取失败的输出
+const userFactMaxLength = 100
+
+// UserFact 关于用户的一条长期记忆
+type UserFact struct {
+	ID   int64
+	Fact string
+}
+
+// EnsureUserFactsTableExists 用户事实表,保存从对话中提取的关于用户的短句和向量
+func (app *App) EnsureUserFactsTableExists() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS user_facts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        fact TEXT NOT NULL,
+        vector BLOB NOT NULL,
+        norm FLOAT NOT NULL,
+        model_fingerprint TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	_, err := app.DB.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating user_facts table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_user_facts_user_id ON user_facts(user_id);`
+	_, err = app.DB.Exec(createIndexSQL)
+	if err != nil {
+		return fmt.Errorf("error creating index on user_facts: %w", err)
+	}
+
+	return nil
+}
+
+// ExtractUserFacts 请你从这段对话中提取关于用户的事实,一行一条
+func ExtractUserFacts(qa string) ([]string, error) {
+	baseurl := config.GetAIPromptkeyboardPath()
+	// 使用net/url包来构建和编码URL
+	urlParams := url.Values{}
+	urlParams.Add("prompt", config.GetUserFactsPrompt())
+	fullURL := baseurl + "?" + urlParams.Encode()
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"message":         qa,
+		"conversationId":  "",
+		"parentMessageId": "",
+		"user_id":         "",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling request: %w", err)
+	}
+
+	resp, err := http.Post(fullURL, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var responseData promptkb.ResponseDataPromptKeyboard
+	if err := json.Unmarshal(responseBody, &responseData); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response data: %w[%v]", err, string(responseBody))
+	}
+
+	return parseUserFacts(responseData.Response), nil
+}
+
+// parseUserFacts 解析模型输出,去除序号和列表符号,"无"代表没有可以提取的事实
+func parseUserFacts(response string) []string {
+	var facts []string
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimLeft(line, "-*•0123456789.、) ")
+		line = strings.TrimSpace(line)
+		if line == "" || line == "无" || strings.EqualFold(line, "none") {
+			continue
+		}
+		if len([]rune(line)) > userFactMaxLength {
+			continue
+		}
+		facts = append(facts, line)
+	}
+	return facts
+}
+
+// LearnUserFacts 回复完成后调用,从本轮问答中提取事实并保存,相近的旧事实会被新事实替换
+func (app *App) LearnUserFacts(userKey string, question string, answer string) {
+	if !config.GetUserFacts() {
+		return
+	}
+
+	facts, err := ExtractUserFacts("Q:" + question + "\nA:" + answer)
+	if err != nil {
+		fmtf.Printf("提取用户事实时出错:%v\n", err)
+		return
+	}
+
+	for _, fact := range facts {
+		if err := app.saveUserFact(userKey, fact); err != nil {
+			fmtf.Printf("保存用户事实时出错:%v\n", err)
+			return
+		}
+		fmtf.Printf("记住了关于[%s]的事实:%s\n", userKey, fact)
+	}
+
+	if len(facts) > 0 {
+		if err := app.trimUserFacts(userKey, config.GetUserFactsMax()); err != nil {
+			fmtf.Printf("清理用户事实时出错:%v\n", err)
+		}
+	}
+}
+
+// saveUserFact 保存一条事实,与已有事实的汉明距离不超过userFactsDedupThreshold时视为同一事实并更新
+func (app *App) saveUserFact(userKey string, fact string) error {
+	vector, err := app.CalculateTextEmbedding(fact)
+	if err != nil {
+		return fmt.Errorf("error calculating fact embedding: %w", err)
+	}
+	var sum float64
+	for _, v := range vector {
+		sum += v * v
+	}
+	norm := math.Sqrt(sum)
+	binaryVector := vectorToBinaryConcurrent(vector)
+	fingerprint := embeddingFingerprint()
+
+	// 阈值为0时只合并文字完全相同的事实
+	var existingID int64
+	dedupThreshold := config.GetUserFactsDedupThreshold()
+	if dedupThreshold > 0 {
+		matches, err := app.searchUserFacts(userKey, vector, 1, dedupThreshold)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			existingID = matches[0].ID
+		}
+	} else {
+		app.DB.QueryRow("SELECT id FROM user_facts WHERE user_id = ? AND fact = ?", userKey, fact).Scan(&existingID)
+	}
+
+	if existingID != 0 {
+		_, err := app.DB.Exec("UPDATE user_facts SET fact = ?, vector = ?, norm = ?, model_fingerprint = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			fact, binaryVector, norm, fingerprint, existingID)
+		if err != nil {
+			return fmt.Errorf("error updating user fact: %w", err)
+		}
+		return nil
+	}
+
+	_, err = app.DB.Exec("INSERT INTO user_facts (user_id, fact, vector, norm, model_fingerprint) VALUES (?, ?, ?, ?, ?)",
+		userKey, fact, binaryVector, norm, fingerprint)
+	if err != nil {
+		return fmt.Errorf("error inserting user fact: %w", err)
+	}
+	return nil
+}
+
+// trimUserFacts 每个用户最多保留max条事实,超出时删除最久没有更新的
+func (app *App) trimUserFacts(userKey string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	_, err := app.DB.Exec(`
+    DELETE FROM user_facts WHERE user_id = ? AND id NOT IN (
+        SELECT id FROM user_facts WHERE user_id = ? ORDER BY updated_at DESC, id DESC LIMIT ?
+    )`, userKey, userKey, max)
+	if err != nil {
+		return fmt.Errorf("error trimming user facts: %w", err)
+	}
+	return nil
+}
+
+type userFactDistance struct {
+	ID       int64
+	Fact     string
+	Distance int
+}
+
+// searchUserFacts 查找与向量最接近的topK条事实,threshold为0时不限制汉明距离
+func (app *App) searchUserFacts(userKey string, vector []float64, topK int, threshold int) ([]userFactDistance, error) {
+	rows, err := app.DB.Query("SELECT id, fact, vector FROM user_facts WHERE user_id = ? AND model_fingerprint = ?", userKey, embeddingFingerprint())
+	if err != nil {
+		return nil, fmt.Errorf("error querying user facts: %w", err)
+	}
+	defer rows.Close()
+
+	binaryVector := vectorToBinaryConcurrent(vector)
+	var results []userFactDistance
+	for rows.Next() {
+		var result userFactDistance
+		var dbVectorBytes []byte
+		if err := rows.Scan(&result.ID, &result.Fact, &dbVectorBytes); err != nil {
+			continue
+		}
+		result.Distance = hammingDistanceOptimized(binaryVector, dbVectorBytes)
+		if threshold > 0 && result.Distance > threshold {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+	if len(results) > topK {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+// ApplyUserFacts 将与本次提问最相关的用户事实添加到当前的Q后方,vector为空时会计算newmsg的向量
+func (app *App) ApplyUserFacts(userKey string, newmsg string, vector []float64, requestmsg *string) {
+	if !config.GetUserFacts() {
+		return
+	}
+
+	if vector == nil {
+		var err error
+		vector, err = app.CalculateTextEmbedding(newmsg)
+		if err != nil {
+			fmtf.Printf("计算用户事实检索向量时出错:%v\n", err)
+			return
+		}
+	}
+
+	results, err := app.searchUserFacts(userKey, vector, config.GetUserFactsTopK(), config.GetUserFactsThreshold())
+	if err != nil {
+		fmtf.Printf("检索用户事实时出错:%v\n", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	facts := make([]string, len(results))
+	for i, result := range results {
+		if config.GetPrintHanming() {
+			fmtf.Printf("用户事实命中,汉明距离:%v,%v\n", result.Distance, result.Fact)
+		}
+		facts[i] = result.Fact
+	}
+
+	*requestmsg += " (关于用户:" + strings.Join(facts, ";") + ")"
+}
+
+// GetUserFactList 按记住的先后顺序列出用户的全部事实
+func (app *App) GetUserFactList(userKey string) ([]UserFact, error) {
+	rows, err := app.DB.Query("SELECT id, fact FROM user_facts WHERE user_id = ? ORDER BY id ASC", userKey)
+	if err != nil {
+		return nil, fmt.Errorf("error querying user facts: %w", err)
+	}
+	defer rows.Close()
+
+	var facts []UserFact
+	for rows.Next() {
+		var fact UserFact
+		if err := rows.Scan(&fact.ID, &fact.Fact); err != nil {
+			return nil, fmt.Errorf("error scanning user fact: %w", err)
+		}
+		facts = append(facts, fact)
+	}
+	return facts, rows.Err()
+}
+
+// MatchFactCommand 判断是否是事实列表指令或忘记指令,忘记指令返回指令后面的参数
+// 未开启userFacts时不处理,忘记指令后面必须是序号或全部,避免把"忘记带伞了"之类的普通对话当作指令
+func MatchFactCommand(checkResetCommand string) (isList bool, isForget bool, arg string) {
+	if !config.GetUserFacts() {
+		return false, false, ""
+	}
+	for _, command := range config.GetFactListCommand() {
+		if checkResetCommand == command {
+			return true, false, ""
+		}
+	}
+	for _, command := range config.GetFactForgetCommand() {
+		if command == "" || !strings.HasPrefix(checkResetCommand, command) {
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(checkResetCommand, command))
+		if _, err := strconv.Atoi(arg); err == nil || arg == "全部" || strings.EqualFold(arg, "all") {
+			return false, true, arg
+		}
+	}
+	return false, false, ""
+}
+
+// buildFactListResponse 组合事实列表的回复
+func (app *App) buildFactListResponse(userKey string) string {
+	facts, err := app.GetUserFactList(userKey)
+	if err != nil {
+		fmtf.Printf("获取用户事实时出错:%v\n", err)
+		return "获取失败,请稍后再试"
+	}
+	if len(facts) == 0 {
+		return "我还没有记住关于你的事情"
+	}
+
+	var forgetCommand string
+	forgetCommands := config.GetFactForgetCommand()
+	if len(forgetCommands) > 0 {
+		forgetCommand = forgetCommands[0]
+	} else {
+		forgetCommand = "未设置忘记指令"
+	}
+
+	var responseBuilder strings.Builder
+	responseBuilder.WriteString("我记住的关于你的事：\n")
+	for i, fact := range facts {
+		responseBuilder.WriteString(fmt.Sprintf("%d. %s\n", i+1, acnode.CheckWordOUT(fact.Fact)))
+	}
+	responseBuilder.WriteString(fmt.Sprintf("提示：发送 %s 序号 忘记一条,发送 %s 全部 忘记所有", forgetCommand, forgetCommand))
+	return responseBuilder.String()
+}
+
+// buildFactForgetResponse 按序号忘记一条事实,或忘记全部事实
+func (app *App) buildFactForgetResponse(userKey string, arg string) string {
+	if arg == "全部" || strings.EqualFold(arg, "all") {
+		result, err := app.DB.Exec("DELETE FROM user_facts WHERE user_id = ?", userKey)
+		if err != nil {
+			fmtf.Printf("删除用户事实时出错:%v\n", err)
+			return "忘记失败,请稍后再试"
+		}
+		count, _ := result.RowsAffected()
+		return fmt.Sprintf("已经忘记了关于你的%d件事", count)
+	}
+
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return "请在指令后面加上序号,或者加上 全部"
+	}
+	facts, err := app.GetUserFactList(userKey)
+	if err != nil {
+		fmtf.Printf("获取用户事实时出错:%v\n", err)
+		return "忘记失败,请稍后再试"
+	}
+	if index < 1 || index > len(facts) {
+		return fmt.Sprintf("没有序号为%d的记录", index)
+	}
+
+	fact := facts[index-1]
+	_, err = app.DB.Exec("DELETE FROM user_facts WHERE id = ? AND user_id = ?", fact.ID, userKey)
+	if err != nil {
+		fmtf.Printf("删除用户事实时出错:%v\n", err)
+		return "忘记失败,请稍后再试"
+	}
+	return "已经忘记了：" + acnode.CheckWordOUT(fact.Fact)
+}
+
+// handleFactCommand 处理事实列表和忘记指令
+func (app *App) handleFactCommand(msg structs.OnebotGroupMessage, isList bool, arg string, promptstr string) {
+	userKey := strconv.FormatInt(msg.UserID+msg.SelfID, 10)
+	if isList {
+		app.sendMemoryResponse(msg, app.buildFactListResponse(userKey), promptstr)
+		return
+	}
+	app.sendMemoryResponse(msg, app.buildFactForgetResponse(userKey, arg), promptstr)
+}
+
+// handleFactCommandSP 处理事实列表和忘记指令
+func (app *App) handleFactCommandSP(msg structs.OnebotGroupMessageS, isList bool, arg string, promptstr string) {
+	userKey := msg.UserID
+	if isList {
+		app.sendMemoryResponseSP(msg, app.buildFactListResponse(userKey), promptstr)
+		return
+	}
+	app.sendMemoryResponseSP(msg, app.buildFactForgetResponse(userKey, arg), promptstr)
+}
@@ -6,9 +6,11 @@ import (
 	"math"
 	"os"
 	"sort"
+	"strconv"
 
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
 	"github.com/hoshinonyaruko/gensokyo-llm/utils"
 )
@@ -34,7 +36,7 @@ func (app *App) insertVectorDataSensitive(text string, vector []float64) (int64,
 		fmtf.Printf("groupid : %v\n", groupID)
 	}
 
-	result, err := app.DB.Exec("INSERT INTO sensitive_words (text, vector, norm, group_id) VALUES (?, ?, ?, ?)", text, binaryVector, norm, groupID)
+	result, err := app.DB.Exec("INSERT INTO sensitive_words (text, vector, norm, group_id, model_fingerprint) VALUES (?, ?, ?, ?, ?)", text, binaryVector, norm, groupID, embeddingFingerprint())
 	if err != nil {
 		return 0, err
 	}
@@ -52,8 +54,10 @@ func (app *App) searchSimilarTextSensitive(vector []float64, threshold int, targ
 	binaryVector := vectorToBinaryConcurrent(vector) // 二值化查询向量
 	var results []TextDistance
 	var ids []int
+	fingerprint := embeddingFingerprint()
+	skipped := 0
 
-	rows, err := app.DB.Query("SELECT id, text, vector FROM sensitive_words WHERE group_id = ?", targetGroupID)
+	rows, err := app.DB.Query("SELECT id, text, vector, model_fingerprint FROM sensitive_words WHERE group_id = ?", targetGroupID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -63,7 +67,13 @@ func (app *App) searchSimilarTextSensitive(vector []float64, threshold int, targ
 		var id int
 		var text string
 		var dbVectorBytes []byte
-		if err := rows.Scan(&id, &text, &dbVectorBytes); err != nil {
+		var dbFingerprint string
+		if err := rows.Scan(&id, &text, &dbVectorBytes, &dbFingerprint); err != nil {
+			continue
+		}
+		// 不同指纹的向量来自不同的模型或二值化阈值,比较汉明距离没有意义
+		if dbFingerprint != fingerprint {
+			skipped++
 			continue
 		}
 		//fmtf.Printf("二值一,%v,二值二,%v", binaryVector, dbVectorBytes)
@@ -77,6 +87,10 @@ func (app *App) searchSimilarTextSensitive(vector []float64, threshold int, targ
 		}
 	}
 
+	if skipped > 0 {
+		fmtf.Printf("sensitive_words中有%d条向量的指纹与当前指纹[%s]不一致,已拒绝比较,请使用 -reembed 参数重新计算向量\n", skipped, fingerprint)
+	}
+
 	// 根据汉明距离对结果进行排序，并保持ids数组与results数组的一致性
 	sort.SliceStable(results, func(i, j int) bool {
 		return results[i].Distance < results[j].Distance
@@ -92,7 +106,7 @@ func (app *App) searchSimilarTextSensitive(vector []float64, threshold int, targ
 }
 
 // searchForSingleVector函数根据单个向量搜索并返回按相似度排序的文本数组
-func (app *App) searchForSingleVectorSensitive(vector []float64, threshold int) ([]string, []int, error) {
+func (app *App) searchForSingleVectorSensitive(vector []float64, threshold int) ([]TextDistance, []int, error) {
 	// 计算目标组ID
 	targetGroupID := calculateGroupID(vector)
 
@@ -102,14 +116,8 @@ func (app *App) searchForSingleVectorSensitive(vector []float64, threshold int)
 		return nil, nil, err
 	}
 
-	// 从TextDistance数组中提取文本
-	var similarTexts []string
-	for _, td := range textDistances {
-		similarTexts = append(similarTexts, td.Text)
-	}
-
-	// 返回相似的文本数组和对应的ID数组
-	return similarTexts, ids, nil
+	// 返回按距离排序的相似文本数组和对应的ID数组
+	return textDistances, ids, nil
 }
 
 func (app *App) ProcessSensitiveWords() error {
@@ -135,9 +143,16 @@ func (app *App) ProcessSensitiveWords() error {
 	}
 	defer file.Close()
 
+	// 先找出数据库中还没有的敏感词,再批量计算向量
+	var texts []string
+	seen := make(map[string]bool)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		text := scanner.Text()
+		if seen[text] {
+			continue
+		}
+		seen[text] = true
 
 		// 检查文本是否已存在于数据库中
 		exists, err := app.textExistsInDatabase(text)
@@ -150,25 +165,33 @@ func (app *App) ProcessSensitiveWords() error {
 			continue
 		}
 
-		// 文本在数据库中不存在，计算其向量
-		fmtf.Printf("计算向量的敏感词：%s\n", text)
-		vector, err := app.CalculateTextEmbedding(text)
-		if err != nil {
-			return fmt.Errorf("计算文本向量时出错 '%s': %w", text, err)
-		}
+		texts = append(texts, text)
+	}
 
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("扫描 vector_sensitive.txt 文件时出错: %w", err)
+	}
+
+	if len(texts) == 0 {
+		return nil
+	}
+
+	// 文本在数据库中不存在，计算其向量
+	fmtf.Printf("计算向量的敏感词：%d条\n", len(texts))
+	vectors, err := app.CalculateTextEmbeddings(texts)
+	if err != nil {
+		return fmt.Errorf("计算敏感词向量时出错: %w", err)
+	}
+
+	for i, text := range texts {
 		// 将新的向量数据插入数据库
-		id, err := app.insertVectorDataSensitive(text, vector)
+		id, err := app.insertVectorDataSensitive(text, vectors[i])
 		if err != nil {
 			return fmt.Errorf("将敏感词向量数据插入数据库时出错: %w", err)
 		}
 		fmt.Printf("成功插入敏感词，ID为：%d\n", id)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("扫描 vector_sensitive.txt 文件时出错: %w", err)
-	}
-
 	return nil
 }
 
@@ -193,7 +216,8 @@ func (app *App) ProcessSensitiveWordsV2() error {
 		// 对每个敏感词重复计算向量10次
 		for i := 0; i < 10; i++ {
 			fmt.Printf("计算向量的敏感词：%s，尝试 #%d\n", text, i+1)
-			vector, err := app.CalculateTextEmbedding(text)
+			// 这里需要每次都真实请求接口,不使用记录过的向量
+			vector, err := app.calculateTextEmbeddingDirect(text)
 			if err != nil {
 				return fmt.Errorf("计算文本向量时出错 '%s': %w", text, err)
 			}
@@ -258,9 +282,9 @@ func (app *App) textExistsInDatabase(text string) (bool, error) {
 	return exists, nil
 }
 
-func (app *App) InterceptSensitiveContent(vector []float64, message structs.OnebotGroupMessage, selfid string, promptstr string) (int, string, error) {
-	// 自定义阈值
-	Threshold := config.GetVertorSensitiveThreshold()
+func (app *App) InterceptSensitiveContent(vector []float64, newmsg string, message structs.OnebotGroupMessage, selfid string, promptstr string) (int, string, error) {
+	// 自定义阈值,群单独设置的阈值优先
+	Threshold := sensitiveThreshold(strconv.FormatInt(message.GroupID, 10))
 
 	// 进行搜索
 	results, _, err := app.searchForSingleVectorSensitive(vector, Threshold)
@@ -277,7 +301,18 @@ func (app *App) InterceptSensitiveContent(vector []float64, message structs.Oneb
 		fmt.Println("Sensitive content detected!")
 
 		// 获取安全词响应
-		saveresponse := config.GetRandomSaveResponse()
+		saveresponse := app.renderMessageTemplate(config.GetRandomSaveResponse(), &message, promptstr)
+
+		// 记录最接近的安全词和汉明距离,没有安全词响应时不拦截
+		event := utils.ModerationEvent(message, selfid, promptstr, moderation.StageVectorSensitive)
+		event.Rule = results[0].Text
+		event.Score = float64(results[0].Distance)
+		event.Original = newmsg
+		event.Final = saveresponse
+		if saveresponse == "" {
+			event.Final = newmsg
+		}
+		moderation.Record(event)
 
 		// 根据消息类型和配置，决定如何响应
 		if saveresponse != "" {
@@ -39,6 +39,15 @@ func LoadConfig(path string) (*Config, error) {
 	return instance, nil
 }
 
+// OverrideSettings 在内存中修改当前配置,不写入config.yml,配置文件重新载入后失效
+func OverrideSettings(override func(settings *structs.Settings)) {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		override(&instance.Settings)
+	}
+}
+
 func loadConfigFromFile(path string) (*Config, error) {
 	configData, err := os.ReadFile(path)
 	if err != nil {
@@ -786,6 +795,16 @@ func GetSensitiveMode() bool {
 	return false
 }
 
+// 获取SensitiveNormalize
+func GetSensitiveNormalize() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveNormalize
+	}
+	return false
+}
+
 // 获取SensitiveModeType
 func GetSensitiveModeType() int {
 	mu.Lock()
@@ -3572,3 +3591,800 @@ func GetGroupNoKeyboard() bool {
 	}
 	return false
 }
+
+// 获取KnowledgeBases
+func GetKnowledgeBases(options ...string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return getKnowledgeBasesInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getKnowledgeBasesInternal(options ...string) []string {
+	// 检查是否有参数传递进来，以及是否为空字符串
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.KnowledgeBases
+		}
+		return nil
+	}
+
+	// 使用传入的 basename
+	basename := options[0]
+	knowledgeBasesInterface, err := prompt.GetSettingFromFilename(basename, "KnowledgeBases")
+	if err != nil {
+		log.Println("Error retrieving KnowledgeBases:", err)
+		return getKnowledgeBasesInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	knowledgeBases, ok := knowledgeBasesInterface.([]string)
+	if !ok { // 检查是否断言失败
+		log.Println("Type assertion failed for KnowledgeBases, fetching default")
+		return getKnowledgeBasesInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	return knowledgeBases
+}
+
+// 获取KnowledgeTopK
+func GetKnowledgeTopK(options ...string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	return getKnowledgeTopKInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getKnowledgeTopKInternal(options ...string) int {
+	// 检查是否有参数传递进来，以及是否为空字符串
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil && instance.Settings.KnowledgeTopK != 0 {
+			return instance.Settings.KnowledgeTopK
+		}
+		return 3 // 默认注入3个片段
+	}
+
+	// 使用传入的 basename
+	basename := options[0]
+	topKInterface, err := prompt.GetSettingFromFilename(basename, "KnowledgeTopK")
+	if err != nil {
+		log.Println("Error retrieving KnowledgeTopK:", err)
+		return getKnowledgeTopKInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	topK, ok := topKInterface.(int)
+	if !ok || topK == 0 { // 检查是否断言失败 或者是0
+		return getKnowledgeTopKInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	return topK
+}
+
+// 获取KnowledgeThreshold
+func GetKnowledgeThreshold(options ...string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	return getKnowledgeThresholdInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getKnowledgeThresholdInternal(options ...string) int {
+	// 检查是否有参数传递进来，以及是否为空字符串
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.KnowledgeThreshold
+		}
+		return 0
+	}
+
+	// 使用传入的 basename
+	basename := options[0]
+	thresholdInterface, err := prompt.GetSettingFromFilename(basename, "KnowledgeThreshold")
+	if err != nil {
+		log.Println("Error retrieving KnowledgeThreshold:", err)
+		return getKnowledgeThresholdInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	threshold, ok := thresholdInterface.(int)
+	if !ok || threshold == 0 { // 检查是否断言失败 或者是0
+		return getKnowledgeThresholdInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	return threshold
+}
+
+// 获取KnowledgeChunkSize
+func GetKnowledgeChunkSize() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.KnowledgeChunkSize > 0 {
+		return instance.Settings.KnowledgeChunkSize
+	}
+	return 300
+}
+
+// 获取KnowledgeChunkOverlap
+func GetKnowledgeChunkOverlap() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.KnowledgeChunkOverlap > 0 {
+		return instance.Settings.KnowledgeChunkOverlap
+	}
+	return 50
+}
+
+// 获取UserFacts
+func GetUserFacts() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.UserFacts
+	}
+	return false
+}
+
+// 获取UserFactsPrompt
+func GetUserFactsPrompt() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.UserFactsPrompt != "" {
+		return instance.Settings.UserFactsPrompt
+	}
+	return "facts"
+}
+
+// 获取UserFactsTopK
+func GetUserFactsTopK() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.UserFactsTopK > 0 {
+		return instance.Settings.UserFactsTopK
+	}
+	return 3
+}
+
+// 获取UserFactsThreshold
+func GetUserFactsThreshold() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.UserFactsThreshold
+	}
+	return 0
+}
+
+// 获取UserFactsDedupThreshold
+func GetUserFactsDedupThreshold() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.UserFactsDedupThreshold
+	}
+	return 0
+}
+
+// 获取UserFactsMax
+func GetUserFactsMax() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.UserFactsMax > 0 {
+		return instance.Settings.UserFactsMax
+	}
+	return 50
+}
+
+// 获取FactListCommand
+func GetFactListCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.FactListCommand
+	}
+	return nil
+}
+
+// 获取FactForgetCommand
+func GetFactForgetCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.FactForgetCommand
+	}
+	return nil
+}
+
+// 获取NoEmbeddingMemo
+func GetNoEmbeddingMemo() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.NoEmbeddingMemo
+	}
+	return false
+}
+
+// 获取EmbeddingMemoSize
+func GetEmbeddingMemoSize() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.EmbeddingMemoSize > 0 {
+		return instance.Settings.EmbeddingMemoSize
+	}
+	return 4096
+}
+
+// 获取EmbeddingMemoRows
+func GetEmbeddingMemoRows() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.EmbeddingMemoRows > 0 {
+		return instance.Settings.EmbeddingMemoRows
+	}
+	return 20000
+}
+
+// 获取EmbeddingBatchSize
+func GetEmbeddingBatchSize() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.EmbeddingBatchSize > 0 {
+		return instance.Settings.EmbeddingBatchSize
+	}
+	return 16
+}
+
+// 获取SensitiveDicts
+func GetSensitiveDicts(options ...string) []structs.SensitiveDict {
+	mu.Lock()
+	defer mu.Unlock()
+	return getSensitiveDictsInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getSensitiveDictsInternal(options ...string) []structs.SensitiveDict {
+	// 检查是否有参数传递进来，以及是否为空字符串
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.SensitiveDicts
+		}
+		return nil
+	}
+
+	// 使用传入的 basename
+	basename := options[0]
+	sensitiveDictsInterface, err := prompt.GetSettingFromFilename(basename, "SensitiveDicts")
+	if err != nil {
+		log.Println("Error retrieving SensitiveDicts:", err)
+		return getSensitiveDictsInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	sensitiveDicts, ok := sensitiveDictsInterface.([]structs.SensitiveDict)
+	if !ok { // 检查是否断言失败
+		log.Println("Type assertion failed for SensitiveDicts, fetching default")
+		return getSensitiveDictsInternal() // 递归调用内部函数，不传递任何参数
+	}
+
+	if len(sensitiveDicts) == 0 {
+		return getSensitiveDictsInternal()
+	}
+
+	return sensitiveDicts
+}
+
+// 获取NoModerationLog
+func GetNoModerationLog() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.NoModerationLog
+	}
+	return false
+}
+
+// 获取ModerationApiToken
+func GetModerationApiToken() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.ModerationApiToken
+	}
+	return ""
+}
+
+// 获取StrikeWeights
+func GetStrikeWeights() []structs.StrikeWeight {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && len(instance.Settings.StrikeWeights) > 0 {
+		return instance.Settings.StrikeWeights
+	}
+	return []structs.StrikeWeight{{Stage: "injection", Weight: 3}, {Stage: "vector_sensitive", Weight: 2}}
+}
+
+// 获取StrikeHalfLife
+func GetStrikeHalfLife() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.StrikeHalfLife > 0 {
+		return instance.Settings.StrikeHalfLife
+	}
+	return 1440
+}
+
+// 获取StrikeThreshold
+func GetStrikeThreshold() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StrikeThreshold
+	}
+	return 0
+}
+
+// 获取StrikeGroupThreshold
+func GetStrikeGroupThreshold() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StrikeGroupThreshold
+	}
+	return 0
+}
+
+// 获取StrikeBanMinutes
+func GetStrikeBanMinutes() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.StrikeBanMinutes > 0 {
+		return instance.Settings.StrikeBanMinutes
+	}
+	return 60
+}
+
+// 获取BlacklistAdmins
+func GetBlacklistAdmins() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.BlacklistAdmins
+	}
+	return nil
+}
+
+// 获取BlacklistAddCommand
+func GetBlacklistAddCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.BlacklistAddCommand
+	}
+	return nil
+}
+
+// 获取BlacklistRemoveCommand
+func GetBlacklistRemoveCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.BlacklistRemoveCommand
+	}
+	return nil
+}
+
+// 获取BlacklistListCommand
+func GetBlacklistListCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.BlacklistListCommand
+	}
+	return nil
+}
+
+// 获取InjectionDetect
+func GetInjectionDetect() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.InjectionDetect
+	}
+	return false
+}
+
+// 获取InjectionPatterns
+func GetInjectionPatterns() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.InjectionPatterns
+	}
+	return nil
+}
+
+// 获取InjectionCorpusThreshold
+func GetInjectionCorpusThreshold() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.InjectionCorpusThreshold > 0 {
+		return instance.Settings.InjectionCorpusThreshold
+	}
+	return 200
+}
+
+// 获取InjectionFailClosed
+func GetInjectionFailClosed() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.InjectionFailClosed
+	}
+	return false
+}
+
+// 获取InjectionCacheSize
+func GetInjectionCacheSize() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.InjectionCacheSize > 0 {
+		return instance.Settings.InjectionCacheSize
+	}
+	return 2048
+}
+
+// 获取SensitiveAddCommand
+func GetSensitiveAddCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveAddCommand
+	}
+	return nil
+}
+
+// 获取SensitiveRemoveCommand
+func GetSensitiveRemoveCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveRemoveCommand
+	}
+	return nil
+}
+
+// 获取SensitiveListCommand
+func GetSensitiveListCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveListCommand
+	}
+	return nil
+}
+
+// 获取SensitiveTestCommand
+func GetSensitiveTestCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveTestCommand
+	}
+	return nil
+}
+
+// 获取SensitiveThresholdCommand
+func GetSensitiveThresholdCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.SensitiveThresholdCommand
+	}
+	return nil
+}
+
+// 获取PIIRedactMode
+func GetPIIRedactMode() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.PIIRedactMode
+	}
+	return 0
+}
+
+// 获取PIIDetectors
+func GetPIIDetectors() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && len(instance.Settings.PIIDetectors) > 0 {
+		return instance.Settings.PIIDetectors
+	}
+	return []string{"phone", "idcard", "email", "qq"}
+}
+
+// 获取PIIPatterns
+func GetPIIPatterns() []structs.PIIPattern {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.PIIPatterns
+	}
+	return nil
+}
+
+// 获取 SetVarsQ
+func GetSetVarsQ(options ...string) []structs.PromptSetVar {
+	mu.Lock()
+	defer mu.Unlock()
+	return getSetVarsQInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getSetVarsQInternal(options ...string) []structs.PromptSetVar {
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.SetVarsQ
+		}
+		return nil
+	}
+
+	basename := options[0]
+	setVarsInterface, err := prompt.GetSettingFromFilename(basename, "SetVarsQ")
+	if err != nil {
+		log.Println("Error retrieving SetVarsQ:", err)
+		return getSetVarsQInternal()
+	}
+
+	setVars, ok := setVarsInterface.([]structs.PromptSetVar)
+	if !ok {
+		log.Println("Type assertion failed for SetVarsQ, fetching default")
+		return getSetVarsQInternal()
+	}
+
+	return setVars
+}
+
+// 获取 SetVarsA
+func GetSetVarsA(options ...string) []structs.PromptSetVar {
+	mu.Lock()
+	defer mu.Unlock()
+	return getSetVarsAInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getSetVarsAInternal(options ...string) []structs.PromptSetVar {
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.SetVarsA
+		}
+		return nil
+	}
+
+	basename := options[0]
+	setVarsInterface, err := prompt.GetSettingFromFilename(basename, "SetVarsA")
+	if err != nil {
+		log.Println("Error retrieving SetVarsA:", err)
+		return getSetVarsAInternal()
+	}
+
+	setVars, ok := setVarsInterface.([]structs.PromptSetVar)
+	if !ok {
+		log.Println("Type assertion failed for SetVarsA, fetching default")
+		return getSetVarsAInternal()
+	}
+
+	return setVars
+}
+
+// 获取 ChangeVarsQ
+func GetChangeVarsQ(options ...string) []structs.PromptChangeVar {
+	mu.Lock()
+	defer mu.Unlock()
+	return getChangeVarsQInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getChangeVarsQInternal(options ...string) []structs.PromptChangeVar {
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.ChangeVarsQ
+		}
+		return nil
+	}
+
+	basename := options[0]
+	changeVarsInterface, err := prompt.GetSettingFromFilename(basename, "ChangeVarsQ")
+	if err != nil {
+		log.Println("Error retrieving ChangeVarsQ:", err)
+		return getChangeVarsQInternal()
+	}
+
+	changeVars, ok := changeVarsInterface.([]structs.PromptChangeVar)
+	if !ok {
+		log.Println("Type assertion failed for ChangeVarsQ, fetching default")
+		return getChangeVarsQInternal()
+	}
+
+	return changeVars
+}
+
+// 获取 ChangeVarsA
+func GetChangeVarsA(options ...string) []structs.PromptChangeVar {
+	mu.Lock()
+	defer mu.Unlock()
+	return getChangeVarsAInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getChangeVarsAInternal(options ...string) []structs.PromptChangeVar {
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.ChangeVarsA
+		}
+		return nil
+	}
+
+	basename := options[0]
+	changeVarsInterface, err := prompt.GetSettingFromFilename(basename, "ChangeVarsA")
+	if err != nil {
+		log.Println("Error retrieving ChangeVarsA:", err)
+		return getChangeVarsAInternal()
+	}
+
+	changeVars, ok := changeVarsInterface.([]structs.PromptChangeVar)
+	if !ok {
+		log.Println("Type assertion failed for ChangeVarsA, fetching default")
+		return getChangeVarsAInternal()
+	}
+
+	return changeVars
+}
+
+// 获取 BotName
+func GetBotName(options ...string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return getBotNameInternal(options...)
+}
+
+// 内部逻辑执行函数，不处理锁，可以安全地递归调用
+func getBotNameInternal(options ...string) string {
+	if len(options) == 0 || options[0] == "" {
+		if instance != nil {
+			return instance.Settings.BotName
+		}
+		return ""
+	}
+
+	basename := options[0]
+	botNameInterface, err := prompt.GetSettingFromFilename(basename, "BotName")
+	if err != nil {
+		log.Println("Error retrieving BotName:", err)
+		return getBotNameInternal()
+	}
+
+	botName, ok := botNameInterface.(string)
+	if !ok || botName == "" {
+		return getBotNameInternal()
+	}
+
+	return botName
+}
+
+// 获取StoryGraphPage
+func GetStoryGraphPage() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StoryGraphPage
+	}
+	return false
+}
+
+// 获取config.yml的全部设置,用于需要整体读取剧情配置的场景
+func GetSettings() structs.Settings {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings
+	}
+	return structs.Settings{}
+}
+
+// 获取PromptsPath
+func GetPromptsPath() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.PromptsPath != "" {
+		return instance.Settings.PromptsPath
+	}
+	return "prompts"
+}
+
+// 获取SemanticTriggerThreshold
+func GetSemanticTriggerThreshold() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.SemanticTriggerThreshold > 0 {
+		return instance.Settings.SemanticTriggerThreshold
+	}
+	return 0.85
+}
+
+// 获取StorySaveCommand
+func GetStorySaveCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StorySaveCommand
+	}
+	return nil
+}
+
+// 获取StoryLoadCommand
+func GetStoryLoadCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StoryLoadCommand
+	}
+	return nil
+}
+
+// 获取StoryListCommand
+func GetStoryListCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StoryListCommand
+	}
+	return nil
+}
+
+// 获取StoryDeleteCommand
+func GetStoryDeleteCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.StoryDeleteCommand
+	}
+	return nil
+}
+
+// 获取StorySlotLimit
+func GetStorySlotLimit() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil && instance.Settings.StorySlotLimit > 0 {
+		return instance.Settings.StorySlotLimit
+	}
+	return 5
+}
+
+// 获取Experiments
+func GetExperiments() []structs.Experiment {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.Experiments
+	}
+	return nil
+}
+
+// 获取FeedbackGoodCommand
+func GetFeedbackGoodCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.FeedbackGoodCommand
+	}
+	return nil
+}
+
+// 获取FeedbackBadCommand
+func GetFeedbackBadCommand() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		return instance.Settings.FeedbackBadCommand
+	}
+	return nil
+}
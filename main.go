@@ -10,18 +10,23 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3" // 只导入，作为驱动
 
+	"github.com/hoshinonyaruko/gensokyo-llm/acnode"
 	"github.com/hoshinonyaruko/gensokyo-llm/applogic"
 	oneclient "github.com/hoshinonyaruko/gensokyo-llm/common/client"
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/controller"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
 	"github.com/hoshinonyaruko/gensokyo-llm/hunyuan"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
+	"github.com/hoshinonyaruko/gensokyo-llm/prompt"
 	"github.com/hoshinonyaruko/gensokyo-llm/server"
 	"github.com/hoshinonyaruko/gensokyo-llm/template"
 	"github.com/hoshinonyaruko/gensokyo-llm/utils"
@@ -32,6 +37,22 @@ func main() {
 	ymlPath := flag.String("yml", "", "指定config.yml的路径")
 	vFlag := flag.Bool("v", false, "Run ProcessSensitiveWordsV2")
 	tidyFlag := flag.Bool("tidy", false, "Run tidylog")
+	reembedFlag := flag.Bool("reembed", false, "更换embeddingType或vToBThreshold后,重新计算数据库中的全部向量")
+	reembedBatch := flag.Int("reembed-batch", 16, "-reembed 每批重新计算的向量数量")
+	reindexKbFlag := flag.Bool("reindex-kb", false, "重新索引knowledge目录下的全部知识库")
+	moderationReportFlag := flag.Bool("moderation-report", false, "输出拦截记录统计")
+	moderationSince := flag.Duration("moderation-since", 24*time.Hour, "-moderation-report 统计的时间范围,如24h")
+	moderationStage := flag.String("moderation-stage", "", "-moderation-report 只统计该阶段,如vector_sensitive")
+	lintPromptsFlag := flag.Bool("lint-prompts", false, "检查prompts文件夹中的剧情配置,有错误时以非0状态退出")
+	lintEntry := flag.String("lint-entry", "", "-lint-prompts 剧情的入口提示词,逗号分隔,不设置时没有被引用的提示词都视为入口")
+	storyGraphFormat := flag.String("story-graph", "", "输出prompts文件夹中的剧情图,dot或mermaid")
+	storyGraphOut := flag.String("story-graph-out", "", "-story-graph 写入的文件,不设置时输出到控制台")
+	experimentReportFlag := flag.Bool("experiment-report", false, "输出提示词A/B实验各变体的统计")
+	experimentName := flag.String("experiment-name", "", "-experiment-report 只输出该实验,不设置时输出config.yml中的全部实验")
+	simulateScript := flag.String("simulate", "", "离线模拟剧情,参数为用户消息脚本,一行一条,使用内存数据库和模拟的大模型")
+	simulatePrompt := flag.String("simulate-prompt", "", "-simulate 起始的提示词名,不设置时使用config.yml")
+	simulateReplies := flag.String("simulate-replies", "", "-simulate 按顺序使用的模拟回复,一行一条,不设置或用完后原样返回请求内容")
+	simulateVerbose := flag.Bool("simulate-verbose", false, "-simulate 同时输出运行日志")
 	flag.Parse()
 
 	// 如果用户指定了-yml参数
@@ -55,8 +76,20 @@ func main() {
 		log.Fatalf("error: %v", err)
 	}
 
-	// 设置配置文件监视器
-	go setupConfigWatcher(configFilePath)
+	// 提示词目录
+	if err := prompt.SetPromptsDir(config.GetPromptsPath()); err != nil {
+		log.Fatalf("Failed to load prompts from %s: %v", config.GetPromptsPath(), err)
+	}
+
+	// 离线模拟时关闭需要外部服务的功能
+	if *simulateScript != "" {
+		applogic.PrepareSimulation()
+	}
+
+	// 设置配置文件监视器,离线模拟时不监视,重新载入会丢失模拟对设置的修改
+	if *simulateScript == "" {
+		go setupConfigWatcher(configFilePath)
+	}
 
 	// 日志落地
 	if config.GetSavelogs() {
@@ -72,6 +105,52 @@ func main() {
 		}
 		return // 退出程序
 	}
+	// 根据-lint-prompts参数检查提示词,完成后退出
+	if *lintPromptsFlag {
+		var entries []string
+		if *lintEntry != "" {
+			entries = strings.Split(*lintEntry, ",")
+		}
+		issues := prompt.Lint(conf.Settings, entries, config.GetUseAIPromptkeyboard())
+		errorCount := 0
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if issue.Level == prompt.LintError {
+				errorCount++
+			}
+		}
+		fmt.Printf("检查完毕,共%d个错误,%d个警告\n", errorCount, len(issues)-errorCount)
+		if errorCount > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	// 根据-story-graph参数输出剧情图,完成后退出
+	if *storyGraphFormat != "" {
+		graph, err := prompt.BuildGraph(conf.Settings)
+		if err != nil {
+			log.Fatalf("Error building story graph: %v", err)
+		}
+		var output string
+		switch *storyGraphFormat {
+		case "dot":
+			output = graph.DOT()
+		case "mermaid":
+			output = graph.Mermaid()
+		default:
+			log.Fatalf("未知的剧情图格式:%s,可选dot或mermaid", *storyGraphFormat)
+		}
+		if *storyGraphOut == "" {
+			fmt.Print(output)
+			return
+		}
+		if err := os.WriteFile(*storyGraphOut, []byte(output), 0644); err != nil {
+			log.Fatalf("Error writing story graph: %v", err)
+		}
+		fmt.Printf("剧情图已写入%s\n", *storyGraphOut)
+		return
+	}
+
 	// Deprecated
 	secretId := conf.Settings.SecretId
 	secretKey := conf.Settings.SecretKey
@@ -83,7 +162,11 @@ func main() {
 		fmtf.Printf("创建hunyuanapi出错:%v", err)
 	}
 
-	db, err := sql.Open("sqlite3", "file:mydb.sqlite?cache=shared&mode=rwc")
+	dataSourceName := "file:mydb.sqlite?cache=shared&mode=rwc"
+	if *simulateScript != "" {
+		dataSourceName = applogic.SimulationDSN
+	}
+	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -116,6 +199,12 @@ func main() {
 		log.Fatalf("Failed to ensure EmbeddingsTable table exists: %v", err)
 	}
 
+	// 确保 向量记录表 存在
+	err = app.EnsureEmbeddingMemoTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure EmbeddingMemoTable table exists: %v", err)
+	}
+
 	// 确保 QA缓存表 存在
 	err = app.EnsureQATableExist()
 	if err != nil {
@@ -148,12 +237,107 @@ func main() {
 		log.Fatalf("Failed to ensure UserMemoriesTableExists table exists: %v", err)
 	}
 
+	// 用户事实表
+	err = app.EnsureUserFactsTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure UserFactsTableExists table exists: %v", err)
+	}
+
+	// 知识库片段表
+	err = app.EnsureKnowledgeTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure KnowledgeTableExists table exists: %v", err)
+	}
+
+	// 剧情存档表
+	err = app.EnsureStorySlotsTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure StorySlotsTableExists table exists: %v", err)
+	}
+
+	// 剧情数值变量表
+	err = app.EnsureStoryVarsTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure StoryVarsTableExists table exists: %v", err)
+	}
+
+	// 提示词A/B实验的分配和事件表
+	err = app.EnsureExperimentTablesExist()
+	if err != nil {
+		log.Fatalf("Failed to ensure ExperimentTablesExist table exists: %v", err)
+	}
+
+	// 各群的向量安全词阈值表
+	err = app.EnsureSensitiveThresholdTableExists()
+	if err != nil {
+		log.Fatalf("Failed to ensure SensitiveThresholdTableExists table exists: %v", err)
+	}
+
+	// 拦截记录表
+	err = moderation.Init(db)
+	if err != nil {
+		log.Fatalf("Failed to ensure ModerationEventsTable table exists: %v", err)
+	}
+
+	// 根据-moderation-report参数输出拦截统计,完成后退出
+	if *moderationReportFlag {
+		err := moderation.PrintReport(db, *moderationSince, *moderationStage)
+		if err != nil {
+			log.Fatalf("Failed to PrintReport: %v", err)
+		}
+		return
+	}
+
+	// 根据-experiment-report参数输出实验统计,完成后退出
+	if *experimentReportFlag {
+		err := app.PrintExperimentReport(*experimentName)
+		if err != nil {
+			log.Fatalf("Failed to PrintExperimentReport: %v", err)
+		}
+		return
+	}
+
+	// 根据-reembed参数重新计算向量,完成后退出
+	if *reembedFlag {
+		err := app.ReembedVectors(*reembedBatch)
+		if err != nil {
+			log.Fatalf("Failed to ReembedVectors: %v", err)
+		}
+		fmtf.Println("向量重新计算完毕")
+		return
+	}
+
+	// 根据-reindex-kb参数重新索引全部知识库,完成后退出
+	if *reindexKbFlag {
+		err := app.ReindexKnowledgeBases(true)
+		if err != nil {
+			log.Fatalf("Failed to ReindexKnowledgeBases: %v", err)
+		}
+		fmtf.Println("知识库索引完毕")
+		return
+	}
+
 	// 加载 拦截词
 	err = app.ProcessSensitiveWords()
 	if err != nil {
 		log.Fatalf("Failed to ProcessSensitiveWords: %v", err)
 	}
 
+	// 加载 提示词注入样本
+	err = app.LoadInjectionCorpus()
+	if err != nil {
+		log.Fatalf("Failed to LoadInjectionCorpus: %v", err)
+	}
+
+	// 根据-simulate参数离线模拟剧情,完成后退出
+	if *simulateScript != "" {
+		err := app.RunSimulation(*simulatePrompt, *simulateScript, *simulateReplies, *simulateVerbose)
+		if err != nil {
+			log.Fatalf("Failed to RunSimulation: %v", err)
+		}
+		return
+	}
+
 	apiType := config.GetApiType() // 调用配置包的函数获取API类型
 
 	switch apiType {
@@ -253,6 +437,14 @@ func main() {
 	// 启动黑名单文件变动监听
 	go utils.WatchBlacklist(blacklistPath)
 
+	// 启动敏感词和白名单文件变动监听
+	go acnode.WatchWordsFiles()
+
+	// 增量索引知识库并启动知识库文件变动监听
+	if err := app.WatchKnowledgeBases(); err != nil {
+		log.Fatalf("Failed to watch knowledge bases: %v", err)
+	}
+
 	// 根据-v参数决定是否运行ProcessSensitiveWordsV2
 	if *vFlag {
 		err := app.ProcessSensitiveWordsV2()
@@ -276,6 +468,18 @@ func main() {
 		http.HandleFunc("/gensokyo", app.GensokyoHandlerSP)
 	}
 
+	// 剧情图页面
+	if config.GetStoryGraphPage() {
+		http.HandleFunc("/story/graph", applogic.StoryGraphHandler)
+	}
+
+	// 拦截记录查询和向量安全词管理接口,设置了token才开放
+	if config.GetModerationApiToken() != "" {
+		http.HandleFunc("/moderation/events", moderation.EventsHandler(db))
+		http.HandleFunc("/sensitive/entries", app.SensitiveEntriesHandler)
+		http.HandleFunc("/sensitive/test", app.SensitiveTestHandler)
+	}
+
 	var wspath string
 	if conf.Settings.WSPath == "nil" {
 		wspath = "/"
@@ -344,6 +548,9 @@ func setupConfigWatcher(configFilePath string) {
 					fmt.Println("检测到配置文件变动:", event.Name)
 					//fileLoader.LoadConfigF(configFilePath)
 					config.LoadConfig(configFilePath)
+					if err := prompt.SetPromptsDir(config.GetPromptsPath()); err != nil {
+						log.Println("切换提示词目录失败:", err)
+					}
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -0,0 +1,216 @@
+package moderation
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 黑名单条目的范围
+const (
+	ScopeUser   = "user"   // 用户,在所有群和私聊中生效
+	ScopeGroup  = "group"  // 群或频道
+	ScopeMember = "member" // 某个群中的某个用户
+)
+
+// Entry 一条黑名单,SelfID为空时对所有机器人生效,ExpiresAt为零值时永久有效
+type Entry struct {
+	ID        int64     `json:"id"`
+	Scope     string    `json:"scope"`
+	UserID    string    `json:"user_id"`
+	GroupID   string    `json:"group_id"`
+	SelfID    string    `json:"self_id"`
+	Reason    string    `json:"reason"`
+	AddedBy   string    `json:"added_by"` // 添加者的用户ID,自动封禁为strike
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Expired 条目是否已经到期
+func (e Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// Matches 条目是否适用于该消息
+func (e Entry) Matches(userID string, groupID string, selfID string) bool {
+	if e.SelfID != "" && e.SelfID != selfID {
+		return false
+	}
+	switch e.Scope {
+	case ScopeUser:
+		return e.UserID == userID
+	case ScopeGroup:
+		return e.GroupID == groupID
+	case ScopeMember:
+		return e.UserID == userID && e.GroupID == groupID
+	}
+	return false
+}
+
+// Target 条目针对的对象,用于日志和列表
+func (e Entry) Target() string {
+	var target string
+	switch e.Scope {
+	case ScopeUser:
+		target = "用户" + e.UserID
+	case ScopeGroup:
+		target = "群" + e.GroupID
+	case ScopeMember:
+		target = "群" + e.GroupID + "的用户" + e.UserID
+	default:
+		target = e.Scope
+	}
+	if e.SelfID != "" {
+		target += "(仅机器人" + e.SelfID + ")"
+	}
+	return target
+}
+
+var (
+	entries   []Entry // 未到期的黑名单,拦截时只查内存
+	entriesMu sync.RWMutex
+)
+
+// ensureBlacklistTable 创建黑名单表,并载入未到期的条目
+func ensureBlacklistTable() error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS blacklist_entries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        scope TEXT NOT NULL,
+        user_id TEXT NOT NULL DEFAULT '',
+        group_id TEXT NOT NULL DEFAULT '',
+        self_id TEXT NOT NULL DEFAULT '',
+        reason TEXT NOT NULL DEFAULT '',
+        added_by TEXT NOT NULL DEFAULT '',
+        expires_at TIMESTAMP,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("error creating blacklist_entries table: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT id, scope, user_id, group_id, self_id, reason, added_by, expires_at, created_at
+        FROM blacklist_entries WHERE expires_at IS NULL OR expires_at > ? ORDER BY id`, dbTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error loading blacklist_entries: %w", err)
+	}
+	defer rows.Close()
+
+	var loaded []Entry
+	for rows.Next() {
+		var entry Entry
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&entry.ID, &entry.Scope, &entry.UserID, &entry.GroupID, &entry.SelfID,
+			&entry.Reason, &entry.AddedBy, &expiresAt, &entry.CreatedAt); err != nil {
+			return fmt.Errorf("error scanning blacklist_entries: %w", err)
+		}
+		if expiresAt.Valid {
+			entry.ExpiresAt = expiresAt.Time
+		}
+		loaded = append(loaded, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	entriesMu.Lock()
+	entries = loaded
+	entriesMu.Unlock()
+	return nil
+}
+
+// AddEntry 添加一条黑名单,返回带有编号的条目
+func AddEntry(entry Entry) (Entry, error) {
+	if db == nil {
+		return entry, fmt.Errorf("moderation not initialized")
+	}
+	switch entry.Scope {
+	case ScopeUser, ScopeGroup, ScopeMember:
+	default:
+		return entry, fmt.Errorf("unknown blacklist scope: %s", entry.Scope)
+	}
+
+	entry.CreatedAt = time.Now()
+	var expiresAt interface{}
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt = dbTime(entry.ExpiresAt)
+	}
+	result, err := db.Exec(`INSERT INTO blacklist_entries (scope, user_id, group_id, self_id, reason, added_by, expires_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Scope, entry.UserID, entry.GroupID, entry.SelfID, entry.Reason, entry.AddedBy, expiresAt, dbTime(entry.CreatedAt))
+	if err != nil {
+		return entry, fmt.Errorf("error inserting blacklist_entries: %w", err)
+	}
+	if entry.ID, err = result.LastInsertId(); err != nil {
+		return entry, fmt.Errorf("error getting blacklist entry id: %w", err)
+	}
+
+	entriesMu.Lock()
+	entries = append(entries, entry)
+	entriesMu.Unlock()
+	return entry, nil
+}
+
+// RemoveEntry 按编号删除黑名单,返回被删除的条目
+func RemoveEntry(id int64) (Entry, bool, error) {
+	entriesMu.Lock()
+	var removed Entry
+	found := false
+	for i, entry := range entries {
+		if entry.ID == id {
+			removed = entry
+			found = true
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	entriesMu.Unlock()
+
+	if db == nil {
+		return removed, found, nil
+	}
+	result, err := db.Exec("DELETE FROM blacklist_entries WHERE id = ?", id)
+	if err != nil {
+		return removed, found, fmt.Errorf("error deleting blacklist_entries: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		found = true
+	}
+	return removed, found, nil
+}
+
+// ListEntries 返回全部未到期的黑名单
+func ListEntries() []Entry {
+	pruneEntries()
+	entriesMu.RLock()
+	defer entriesMu.RUnlock()
+	return append([]Entry(nil), entries...)
+}
+
+// MatchBlacklist 检查消息是否命中黑名单
+func MatchBlacklist(userID string, groupID string, selfID string) (Entry, bool) {
+	now := time.Now()
+	entriesMu.RLock()
+	defer entriesMu.RUnlock()
+	for _, entry := range entries {
+		if !entry.Expired(now) && entry.Matches(userID, groupID, selfID) {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// pruneEntries 从内存中移除到期的条目,数据库中的记录保留用于查询
+func pruneEntries() {
+	now := time.Now()
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	active := entries[:0]
+	for _, entry := range entries {
+		if !entry.Expired(now) {
+			active = append(active, entry)
+		}
+	}
+	entries = active
+}
@@ -0,0 +1,228 @@
+package moderation
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 拦截发生的阶段
+const (
+	StageBlacklist       = "blacklist"        // 黑名单
+	StageLanguage        = "language"         // 语言拦截
+	StageLength          = "length"           // 字数拦截
+	StageVectorSensitive = "vector_sensitive" // 向量安全词
+	StageInjection       = "injection"        // 提示词安全检查
+	StageWordIn          = "word_in"          // 敏感词 用户输入
+	StageWordOut         = "word_out"         // 敏感词 模型输出
+)
+
+// Event 一次拦截或替换的记录
+type Event struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	GroupID   string    `json:"group_id"`
+	SelfID    string    `json:"self_id"`
+	Prompt    string    `json:"prompt"`
+	Stage     string    `json:"stage"`
+	Rule      string    `json:"rule"`  // 命中的规则或词
+	Score     float64   `json:"score"` // 相似度或评分,没有时为0
+	Original  string    `json:"original"`
+	Final     string    `json:"final"` // 处理后的文本,整条拦截时为空或拦截回复
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Filter 查询条件,为空的条件不限制
+type Filter struct {
+	UserID  string
+	GroupID string
+	Stage   string
+	Prompt  string
+	Since   time.Time
+	Limit   int
+}
+
+// 写入队列长度,队列满时丢弃新的记录,不阻塞消息处理
+const queueSize = 1024
+
+var (
+	db      *sql.DB
+	queue   chan Event
+	initMu  sync.Mutex
+	started bool
+)
+
+// Init 创建拦截记录、违规记录和黑名单表,并启动后台写入
+func Init(database *sql.DB) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS moderation_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL DEFAULT '',
+        group_id TEXT NOT NULL DEFAULT '',
+        self_id TEXT NOT NULL DEFAULT '',
+        prompt TEXT NOT NULL DEFAULT '',
+        stage TEXT NOT NULL,
+        rule TEXT NOT NULL DEFAULT '',
+        score REAL NOT NULL DEFAULT 0,
+        original_text TEXT NOT NULL DEFAULT '',
+        final_text TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`
+	if _, err := database.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("error creating moderation_events table: %w", err)
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_moderation_events_stage ON moderation_events (stage, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_events_user ON moderation_events (user_id, created_at);",
+	}
+	for _, index := range indexes {
+		if _, err := database.Exec(index); err != nil {
+			return fmt.Errorf("error creating moderation_events index: %w", err)
+		}
+	}
+
+	db = database
+	if err := ensureStrikeTables(); err != nil {
+		return err
+	}
+	if err := ensureBlacklistTable(); err != nil {
+		return err
+	}
+	if !started {
+		queue = make(chan Event, queueSize)
+		go writeLoop()
+		started = true
+	}
+	return nil
+}
+
+// Record 记录一次拦截或替换,异步写入数据库并计入违规分数
+func Record(event Event) {
+	if queue == nil {
+		return
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	select {
+	case queue <- event:
+	default:
+		fmtf.Printf("拦截记录队列已满,丢弃记录:%s %s\n", event.Stage, event.Rule)
+	}
+}
+
+func writeLoop() {
+	for event := range queue {
+		// 关闭拦截记录时仍然计入违规分数
+		if !config.GetNoModerationLog() {
+			_, err := db.Exec(`INSERT INTO moderation_events
+            (user_id, group_id, self_id, prompt, stage, rule, score, original_text, final_text, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				event.UserID, event.GroupID, event.SelfID, event.Prompt, event.Stage, event.Rule,
+				event.Score, event.Original, event.Final, dbTime(event.CreatedAt))
+			if err != nil {
+				log.Printf("写入拦截记录失败：%v", err)
+			}
+		}
+		applyStrike(event)
+	}
+}
+
+// where 根据查询条件生成WHERE子句和参数
+func (f Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(column string, value string) {
+		if value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	add("user_id", f.UserID)
+	add("group_id", f.GroupID)
+	add("stage", f.Stage)
+	add("prompt", f.Prompt)
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, dbTime(f.Since))
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Query 按条件查询拦截记录,按时间倒序
+func Query(database *sql.DB, filter Filter) ([]Event, error) {
+	where, args := filter.where()
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	args = append(args, limit)
+
+	rows, err := database.Query(`SELECT id, user_id, group_id, self_id, prompt, stage, rule, score, original_text, final_text, created_at
+        FROM moderation_events`+where+` ORDER BY id DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying moderation_events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.UserID, &event.GroupID, &event.SelfID, &event.Prompt, &event.Stage,
+			&event.Rule, &event.Score, &event.Original, &event.Final, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning moderation_events: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Summary 按阶段和规则统计的结果,用于调整阈值
+type Summary struct {
+	Stage    string  `json:"stage"`
+	Rule     string  `json:"rule"`
+	Count    int     `json:"count"`
+	MinScore float64 `json:"min_score"`
+	AvgScore float64 `json:"avg_score"`
+	MaxScore float64 `json:"max_score"`
+}
+
+// Summarize 按阶段和规则统计拦截次数和评分分布
+func Summarize(database *sql.DB, filter Filter) ([]Summary, error) {
+	where, args := filter.where()
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	args = append(args, limit)
+
+	rows, err := database.Query(`SELECT stage, rule, COUNT(*), MIN(score), AVG(score), MAX(score)
+        FROM moderation_events`+where+` GROUP BY stage, rule ORDER BY COUNT(*) DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error summarizing moderation_events: %w", err)
+	}
+	defer rows.Close()
+
+	var summaries []Summary
+	for rows.Next() {
+		var summary Summary
+		if err := rows.Scan(&summary.Stage, &summary.Rule, &summary.Count, &summary.MinScore, &summary.AvgScore, &summary.MaxScore); err != nil {
+			return nil, fmt.Errorf("error scanning moderation_events summary: %w", err)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
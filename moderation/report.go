@@ -0,0 +1,107 @@
+package moderation
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// parseFilter 从请求参数中读取查询条件,since为时长,如24h
+func parseFilter(r *http.Request) (Filter, error) {
+	query := r.URL.Query()
+	filter := Filter{
+		UserID:  query.Get("user_id"),
+		GroupID: query.Get("group_id"),
+		Stage:   query.Get("stage"),
+		Prompt:  query.Get("prompt"),
+	}
+	if since := query.Get("since"); since != "" {
+		duration, err := time.ParseDuration(since)
+		if err != nil {
+			return filter, err
+		}
+		filter.Since = time.Now().Add(-duration)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return filter, err
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// Authorized 检查管理接口的token,未设置moderationApiToken时全部拒绝
+func Authorized(r *http.Request) bool {
+	token := config.GetModerationApiToken()
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) == 1
+}
+
+// EventsHandler 查询拦截记录,summary=1时返回按阶段和规则的统计
+func EventsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, err := parseFilter(r)
+		if err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var result interface{}
+		if r.URL.Query().Get("summary") == "1" {
+			result, err = Summarize(database, filter)
+		} else {
+			result, err = Query(database, filter)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// PrintReport 输出一段时间内的拦截统计和最近的记录,用于 -moderation-report
+func PrintReport(database *sql.DB, since time.Duration, stage string) error {
+	filter := Filter{Stage: stage, Since: time.Now().Add(-since)}
+
+	summaries, err := Summarize(database, filter)
+	if err != nil {
+		return err
+	}
+	fmtf.Printf("最近%v的拦截统计:\n", since)
+	if len(summaries) == 0 {
+		fmtf.Println("没有拦截记录")
+		return nil
+	}
+	for _, summary := range summaries {
+		fmtf.Printf("[%s] %s 次数:%d 评分:最低%.4f 平均%.4f 最高%.4f\n",
+			summary.Stage, summary.Rule, summary.Count, summary.MinScore, summary.AvgScore, summary.MaxScore)
+	}
+
+	filter.Limit = 20
+	events, err := Query(database, filter)
+	if err != nil {
+		return err
+	}
+	fmtf.Println("最近的拦截记录:")
+	for _, event := range events {
+		fmtf.Printf("%s [%s] user:%s group:%s prompt:%s rule:%s score:%.4f\n原文:%s\n结果:%s\n",
+			event.CreatedAt.Local().Format(timeLayout), event.Stage, event.UserID, event.GroupID,
+			event.Prompt, event.Rule, event.Score, event.Original, event.Final)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package moderation
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+)
+
+// 数据库中时间的保存格式,与CURRENT_TIMESTAMP一致
+const timeLayout = "2006-01-02 15:04:05"
+
+func targetKey(kind string, id string) string {
+	return kind + ":" + id
+}
+
+func dbTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// ensureStrikeTables 创建违规记录表
+func ensureStrikeTables() error {
+	createStrikesSQL := `
+    CREATE TABLE IF NOT EXISTS moderation_strikes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        target TEXT NOT NULL,
+        stage TEXT NOT NULL,
+        weight REAL NOT NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`
+	if _, err := db.Exec(createStrikesSQL); err != nil {
+		return fmt.Errorf("error creating moderation_strikes table: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_moderation_strikes_target ON moderation_strikes (target, created_at);"); err != nil {
+		return fmt.Errorf("error creating moderation_strikes index: %w", err)
+	}
+	return nil
+}
+
+// strikeWeight 返回该阶段的拦截计入的违规分数
+func strikeWeight(stage string) float64 {
+	for _, weight := range config.GetStrikeWeights() {
+		if weight.Stage == stage {
+			return weight.Weight
+		}
+	}
+	return 0
+}
+
+// applyStrike 按拦截记录为用户和群计入违规分数,超过阈值时临时封禁
+func applyStrike(event Event) {
+	weight := strikeWeight(event.Stage)
+	if weight <= 0 {
+		return
+	}
+
+	if threshold := config.GetStrikeThreshold(); threshold > 0 && event.UserID != "" {
+		addStrike(ScopeUser, event.UserID, event.Stage, weight, threshold)
+	}
+	if threshold := config.GetStrikeGroupThreshold(); threshold > 0 && event.GroupID != "" && event.GroupID != "0" {
+		addStrike(ScopeGroup, event.GroupID, event.Stage, weight, threshold)
+	}
+}
+
+// addStrike 记录一次违规,按半衰期计算当前分数,达到阈值时加入临时黑名单并清空该对象的违规记录
+func addStrike(scope string, id string, stage string, weight float64, threshold float64) {
+	target := targetKey(scope, id)
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO moderation_strikes (target, stage, weight, created_at) VALUES (?, ?, ?, ?)",
+		target, stage, weight, dbTime(now)); err != nil {
+		log.Printf("写入违规记录失败：%v", err)
+		return
+	}
+
+	// 超过10个半衰期的记录分数不足千分之一,不再计算
+	halfLife := time.Duration(config.GetStrikeHalfLife()) * time.Minute
+	rows, err := db.Query("SELECT weight, created_at FROM moderation_strikes WHERE target = ? AND created_at > ?",
+		target, dbTime(now.Add(-10*halfLife)))
+	if err != nil {
+		log.Printf("读取违规记录失败：%v", err)
+		return
+	}
+	score := 0.0
+	for rows.Next() {
+		var w float64
+		var createdAt time.Time
+		if err := rows.Scan(&w, &createdAt); err != nil {
+			log.Printf("读取违规记录失败：%v", err)
+			continue
+		}
+		score += w * math.Pow(0.5, now.Sub(createdAt).Minutes()/halfLife.Minutes())
+	}
+	rows.Close()
+	// 保留两位小数,刚刚发生的违规衰减极小,不应因此差一点达不到阈值
+	score = math.Round(score*100) / 100
+
+	fmtf.Printf("%s 因%s计入违规分数%.2f,当前分数%.2f,阈值%.2f\n", target, stage, weight, score, threshold)
+	if score < threshold {
+		return
+	}
+
+	entry := Entry{
+		Scope:     scope,
+		Reason:    fmt.Sprintf("违规分数%.2f达到阈值%.2f,最后一次:%s", score, threshold, stage),
+		AddedBy:   "strike",
+		ExpiresAt: now.Add(time.Duration(config.GetStrikeBanMinutes()) * time.Minute),
+	}
+	if scope == ScopeUser {
+		entry.UserID = id
+	} else {
+		entry.GroupID = id
+	}
+	if _, err := AddEntry(entry); err != nil {
+		log.Printf("临时封禁%s失败：%v", target, err)
+		return
+	}
+	fmtf.Printf("%s 已被临时封禁至%s,原因:%s\n", entry.Target(), entry.ExpiresAt.Format(timeLayout), entry.Reason)
+	if _, err := db.Exec("DELETE FROM moderation_strikes WHERE target = ?", target); err != nil {
+		log.Printf("清空违规记录失败：%v", err)
+	}
+}
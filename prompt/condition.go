@@ -0,0 +1,130 @@
+package prompt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 条件中的比较符,两个字符的写在前面
+var conditionOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// Condition 剧情数值变量的条件,如 affection >= 50 && gold < 10,||的优先级低于&&,未设置过的变量为0
+type Condition struct {
+	anyOf [][]conditionClause
+}
+
+type conditionClause struct {
+	name  string
+	op    string
+	value float64
+}
+
+// ParseCondition 解析条件,空字符串为总是成立的条件
+func ParseCondition(expr string) (Condition, error) {
+	var condition Condition
+	if strings.TrimSpace(expr) == "" {
+		return condition, nil
+	}
+	for _, part := range strings.Split(expr, "||") {
+		var clauses []conditionClause
+		for _, text := range strings.Split(part, "&&") {
+			clause, err := parseConditionClause(strings.TrimSpace(text))
+			if err != nil {
+				return Condition{}, err
+			}
+			clauses = append(clauses, clause)
+		}
+		condition.anyOf = append(condition.anyOf, clauses)
+	}
+	return condition, nil
+}
+
+func parseConditionClause(text string) (conditionClause, error) {
+	for _, op := range conditionOperators {
+		index := strings.Index(text, op)
+		if index < 0 {
+			continue
+		}
+		name := strings.TrimSpace(text[:index])
+		valueText := strings.TrimSpace(text[index+len(op):])
+		if !validVarName(name) {
+			return conditionClause{}, fmt.Errorf("条件%q中的变量名无效", text)
+		}
+		value, err := strconv.ParseFloat(valueText, 64)
+		if err != nil {
+			return conditionClause{}, fmt.Errorf("条件%q中的%q不是数字", text, valueText)
+		}
+		return conditionClause{name: name, op: op, value: value}, nil
+	}
+	return conditionClause{}, fmt.Errorf("条件%q中没有比较符,可用>= <= == != > <", text)
+}
+
+// validVarName 变量名不能为空、含有空白或比较符,也不能是数字
+func validVarName(name string) bool {
+	if name == "" || strings.ContainsAny(name, " \t<>=!&|+-*/{}") {
+		return false
+	}
+	_, err := strconv.ParseFloat(name, 64)
+	return err != nil
+}
+
+// Eval 用变量的当前值判断条件是否成立
+func (c Condition) Eval(vars map[string]float64) bool {
+	if len(c.anyOf) == 0 {
+		return true
+	}
+	for _, clauses := range c.anyOf {
+		met := true
+		for _, clause := range clauses {
+			if !clause.eval(vars[clause.name]) {
+				met = false
+				break
+			}
+		}
+		if met {
+			return true
+		}
+	}
+	return false
+}
+
+func (c conditionClause) eval(value float64) bool {
+	switch c.op {
+	case ">=":
+		return value >= c.value
+	case "<=":
+		return value <= c.value
+	case "==":
+		return value == c.value
+	case "!=":
+		return value != c.value
+	case ">":
+		return value > c.value
+	default:
+		return value < c.value
+	}
+}
+
+// VarChange 数值变量的修改,+5 -3 为增减,=10 为设置
+type VarChange struct {
+	Set   bool
+	Value float64
+}
+
+// ParseVarChange 解析change的写法,没有符号的数字视为增加
+func ParseVarChange(change string) (VarChange, error) {
+	text := strings.TrimSpace(change)
+	set := strings.HasPrefix(text, "=")
+	text = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(text, "="), "+"))
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return VarChange{}, fmt.Errorf("change %q 无效,可用+5 -3 =10", change)
+	}
+	return VarChange{Set: set, Value: value}, nil
+}
+
+// ValidVarName 数值变量的名字是否可用
+func ValidVarName(name string) bool {
+	return validVarName(name)
+}
@@ -0,0 +1,103 @@
+package prompt
+
+import "testing"
+
+func TestConditionEval(t *testing.T) {
+	vars := map[string]float64{"affection": 50, "gold": 3}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"affection >= 50", true},
+		{"affection > 50", false},
+		{"affection<=50", true},
+		{"affection == 50", true},
+		{"affection != 50", false},
+		{"gold < 10 && affection >= 50", true},
+		{"gold >= 10 && affection >= 50", false},
+		{"gold >= 10 || affection >= 50", true},
+		// &&优先于||
+		{"gold >= 10 && affection >= 50 || gold == 3", true},
+		{"gold == 3 || gold >= 10 && affection > 100", true},
+		{"gold == 4 || gold >= 10 && affection > 0", false},
+		// 未设置过的变量为0
+		{"unknown == 0", true},
+		{"unknown > -1.5", true},
+	}
+	for _, tt := range tests {
+		condition, err := ParseCondition(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCondition(%q) error: %v", tt.expr, err)
+		}
+		if got := condition.Eval(vars); got != tt.want {
+			t.Errorf("ParseCondition(%q).Eval = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseConditionInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"affection",
+		"affection >= ",
+		"affection >= abc",
+		">= 5",
+		"5 >= 5",
+		"my var > 1",
+		"affection > 1 &&",
+	} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Errorf("ParseCondition(%q) expected error", expr)
+		}
+	}
+}
+
+func TestParseVarChange(t *testing.T) {
+	tests := []struct {
+		change string
+		want   VarChange
+	}{
+		{"+5", VarChange{Value: 5}},
+		{"-3", VarChange{Value: -3}},
+		{"5", VarChange{Value: 5}},
+		{"=10", VarChange{Set: true, Value: 10}},
+		{" = -2 ", VarChange{Set: true, Value: -2}},
+		{"+0.5", VarChange{Value: 0.5}},
+	}
+	for _, tt := range tests {
+		change, err := ParseVarChange(tt.change)
+		if err != nil {
+			t.Fatalf("ParseVarChange(%q) error: %v", tt.change, err)
+		}
+		if change != tt.want {
+			t.Errorf("ParseVarChange(%q) = %+v, want %+v", tt.change, change, tt.want)
+		}
+	}
+
+	for _, change := range []string{"", "+", "abc", "=x", "5%"} {
+		if _, err := ParseVarChange(change); err == nil {
+			t.Errorf("ParseVarChange(%q) expected error", change)
+		}
+	}
+}
+
+func TestValidVarName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"affection", true},
+		{"好感度", true},
+		{"gold_2", true},
+		{"", false},
+		{"12", false},
+		{"a b", false},
+		{"a>b", false},
+		{"a-b", false},
+	}
+	for _, tt := range tests {
+		if got := ValidVarName(tt.name); got != tt.want {
+			t.Errorf("ValidVarName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package prompt
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// extendsMode 的取值
+const (
+	ExtendsPrepend  = "prepend"  // 默认,父提示词的QA在前,两者的第一条系统提示词合并为一条
+	ExtendsOverride = "override" // 子提示词有Prompt时完全替换父提示词的Prompt
+)
+
+var (
+	resolvedMu    sync.Mutex
+	resolvedCache = make(map[string]PromptFile) // 文件名 -> 解析extends后的PromptFile
+)
+
+// loadable 是否会被载入,没有Prompt但设置了extends的文件从父提示词继承Prompt
+func (p PromptFile) loadable() bool {
+	return len(p.Prompts) > 0 || p.Extends != ""
+}
+
+// extendsFilename extends的值可以带或不带.yml
+func extendsFilename(extends string) string {
+	return strings.TrimSuffix(extends, ".yml") + ".yml"
+}
+
+// invalidateResolved 缓存中的任何提示词变化时清空,调用时需持有lock的写锁
+func invalidateResolved() {
+	resolvedMu.Lock()
+	resolvedCache = make(map[string]PromptFile)
+	resolvedMu.Unlock()
+}
+
+// resolvedPromptFile 返回解析extends后的提示词,调用时需持有lock的读锁
+func resolvedPromptFile(filename string) (PromptFile, bool) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	if promptFile, ok := resolvedCache[filename]; ok {
+		return promptFile, true
+	}
+	if _, ok := promptsCache[filename]; !ok {
+		return PromptFile{}, false
+	}
+	promptFile, err := ResolveExtends(filename, promptsCache)
+	if err != nil {
+		log.Printf("解析%s的extends出错:%v", filename, err)
+	}
+	resolvedCache[filename] = promptFile
+	return promptFile, true
+}
+
+// ResolveExtends 沿extends链合并提示词,files的键为文件名
+// 出现循环或父提示词不存在时返回错误,以及在该处断开后合并的结果
+func ResolveExtends(filename string, files map[string]PromptFile) (PromptFile, error) {
+	var chain []PromptFile
+	visited := make(map[string]bool)
+	var resolveErr error
+	for name := filename; ; {
+		promptFile, ok := files[name]
+		if !ok {
+			resolveErr = fmt.Errorf("%s 不存在", name)
+			break
+		}
+		visited[name] = true
+		chain = append(chain, promptFile)
+		if promptFile.Extends == "" {
+			break
+		}
+		parent := extendsFilename(promptFile.Extends)
+		if visited[parent] {
+			resolveErr = fmt.Errorf("extends出现循环:%s -> %s", name, parent)
+			break
+		}
+		name = parent
+	}
+	if len(chain) == 0 {
+		return PromptFile{}, resolveErr
+	}
+
+	// 从最上层的父提示词开始合并
+	merged := chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		merged = mergePromptFile(merged, chain[i])
+	}
+	return merged, resolveErr
+}
+
+// presentSettingKeys 文件中settings下写出的键,写成false或0的项也算作已设置
+func presentSettingKeys(data []byte) map[string]bool {
+	keys := make(map[string]bool)
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return keys
+	}
+	document := root.Content[0]
+	if document.Kind != yaml.MappingNode {
+		return keys
+	}
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		settings := document.Content[i+1]
+		if document.Content[i].Value != "settings" || settings.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(settings.Content); j += 2 {
+			keys[settings.Content[j].Value] = true
+		}
+	}
+	return keys
+}
+
+// mergePromptFile 子提示词的settings逐项覆盖父提示词,子提示词中没有写出的项继承父提示词
+// 不是从文件解析的提示词没有记录写出的键,按非零值视为已设置
+func mergePromptFile(parent PromptFile, child PromptFile) PromptFile {
+	merged := PromptFile{Extends: child.Extends, ExtendsMode: child.ExtendsMode, settingKeys: make(map[string]bool)}
+
+	mergedSettings := reflect.ValueOf(&merged.Settings).Elem()
+	parentSettings := reflect.ValueOf(parent.Settings)
+	childSettings := reflect.ValueOf(child.Settings)
+	settingsType := mergedSettings.Type()
+	for i := 0; i < mergedSettings.NumField(); i++ {
+		if !mergedSettings.Field(i).CanSet() {
+			continue
+		}
+		key := yamlKey(settingsType.Field(i))
+		childSet := child.settingKeys[key]
+		if child.settingKeys == nil {
+			childSet = !childSettings.Field(i).IsZero()
+		}
+		if childSet {
+			mergedSettings.Field(i).Set(childSettings.Field(i))
+		} else {
+			mergedSettings.Field(i).Set(parentSettings.Field(i))
+		}
+		if childSet || parent.settingKeys[key] {
+			merged.settingKeys[key] = true
+		}
+	}
+
+	switch {
+	case len(child.Prompts) == 0:
+		merged.Prompts = append([]Prompt{}, parent.Prompts...)
+	case child.ExtendsMode == ExtendsOverride:
+		merged.Prompts = append([]Prompt{}, child.Prompts...)
+	default:
+		merged.Prompts = prependPrompts(parent.Prompts, child.Prompts)
+	}
+	return merged
+}
+
+// prependPrompts 父提示词的第一条系统提示词作为前言加在子提示词的系统提示词之前,其余QA按父、子的顺序排列
+func prependPrompts(parent []Prompt, child []Prompt) []Prompt {
+	parentSystem, parentRest := splitFirstSystem(parent)
+	childSystem, childRest := splitFirstSystem(child)
+
+	var merged []Prompt
+	switch {
+	case parentSystem != nil && childSystem != nil:
+		merged = append(merged, Prompt{Role: childSystem.Role, Content: joinSystemContent(parentSystem.Content, childSystem.Content)})
+	case parentSystem != nil:
+		merged = append(merged, *parentSystem)
+	case childSystem != nil:
+		merged = append(merged, *childSystem)
+	}
+	merged = append(merged, parentRest...)
+	return append(merged, childRest...)
+}
+
+// joinSystemContent 换行连接父、子提示词的系统提示词
+// 任一方用||写了多个候选时展开为全部组合,读取时按||随机选中一个组合,相当于两边各自随机选择
+func joinSystemContent(parent string, child string) string {
+	var combined []string
+	for _, p := range strings.Split(parent, "||") {
+		for _, c := range strings.Split(child, "||") {
+			combined = append(combined, p+"\n"+c)
+		}
+	}
+	return strings.Join(combined, "||")
+}
+
+// splitFirstSystem 取出第一条系统提示词
+func splitFirstSystem(prompts []Prompt) (*Prompt, []Prompt) {
+	for i, prompt := range prompts {
+		if prompt.Role == "system" || prompt.Role == "System" {
+			system := prompt
+			rest := append(append([]Prompt{}, prompts[:i]...), prompts[i+1:]...)
+			return &system, rest
+		}
+	}
+	return nil, prompts
+}
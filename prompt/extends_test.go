@@ -0,0 +1,172 @@
+package prompt
+
+import (
+	"strings"
+	"testing"
+)
+
+// decodePromptFiles 按文件名解析测试用的提示词
+func decodePromptFiles(t *testing.T, sources map[string]string) map[string]PromptFile {
+	t.Helper()
+	files := make(map[string]PromptFile)
+	for name, source := range sources {
+		promptFile, err := decodePromptFile([]byte(source))
+		if err != nil {
+			t.Fatalf("decode %s: %v", name, err)
+		}
+		files[name] = promptFile
+	}
+	return files
+}
+
+// promptLines 把Prompt写成 role:content,方便比较
+func promptLines(prompts []Prompt) string {
+	var lines []string
+	for _, p := range prompts {
+		lines = append(lines, p.Role+":"+p.Content)
+	}
+	return strings.Join(lines, "|")
+}
+
+const baseStory = `Prompt:
+- role: system
+  content: 世界观
+- role: user
+  content: 你是谁
+- role: assistant
+  content: 我是向导
+settings:
+  useSse: 2
+  promptMarksLength: 5
+`
+
+func TestResolveExtendsChain(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"base.yml":    baseStory,
+		"chapter.yml": "extends: base\nsettings:\n  promptMarksLength: 3\n",
+		"scene.yml":   "extends: chapter.yml\nsettings:\n  enhancedQA: true\n",
+	})
+
+	scene, err := ResolveExtends("scene.yml", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每一层只覆盖自己设置的项
+	if scene.Settings.UseSse != 2 || scene.Settings.PromptMarksLength != 3 || !scene.Settings.EnhancedQA {
+		t.Errorf("settings = useSse %d, promptMarksLength %d, enhancedQA %v; want 2, 3, true",
+			scene.Settings.UseSse, scene.Settings.PromptMarksLength, scene.Settings.EnhancedQA)
+	}
+	// 没有Prompt的子提示词使用父提示词的Prompt
+	if got := promptLines(scene.Prompts); got != "system:世界观|user:你是谁|assistant:我是向导" {
+		t.Errorf("prompts = %s", got)
+	}
+	if !files["chapter.yml"].loadable() {
+		t.Errorf("chapter.yml has extends but is not loadable")
+	}
+}
+
+func TestResolveExtendsPrepend(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"base.yml": baseStory,
+		"forest.yml": `extends: base
+Prompt:
+- role: system
+  content: 你在森林里
+- role: user
+  content: 往哪走
+`,
+	})
+
+	forest, err := ResolveExtends("forest.yml", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "system:世界观\n你在森林里|user:你是谁|assistant:我是向导|user:往哪走"
+	if got := promptLines(forest.Prompts); got != want {
+		t.Errorf("prompts = %q, want %q", got, want)
+	}
+}
+
+func TestResolveExtendsOverride(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"base.yml": baseStory,
+		"ending.yml": `extends: base
+extendsMode: override
+Prompt:
+- role: system
+  content: 故事结束了
+`,
+	})
+
+	ending, err := ResolveExtends("ending.yml", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := promptLines(ending.Prompts); got != "system:故事结束了" {
+		t.Errorf("prompts = %q, want only the child's", got)
+	}
+	if ending.Settings.UseSse != 2 {
+		t.Errorf("override mode should still inherit settings, useSse = %d", ending.Settings.UseSse)
+	}
+}
+
+func TestResolveExtendsBrokenChain(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"a.yml":      "extends: b\nPrompt:\n- role: system\n  content: A\n",
+		"b.yml":      "extends: a\n",
+		"self.yml":   "extends: self.yml\n",
+		"orphan.yml": "extends: nope\nPrompt:\n- role: system\n  content: 孤儿\n",
+	})
+
+	for _, name := range []string{"a.yml", "self.yml"} {
+		if _, err := ResolveExtends(name, files); err == nil || !strings.Contains(err.Error(), "循环") {
+			t.Errorf("%s: error = %v, want a cycle error", name, err)
+		}
+	}
+
+	// 父提示词不存在时报错,并返回在该处断开后合并的结果
+	orphan, err := ResolveExtends("orphan.yml", files)
+	if err == nil || !strings.Contains(err.Error(), "nope.yml 不存在") {
+		t.Errorf("error = %v, want missing parent", err)
+	}
+	if got := promptLines(orphan.Prompts); got != "system:孤儿" {
+		t.Errorf("prompts = %q, want the child's own prompts", got)
+	}
+}
+
+func TestResolveExtendsExplicitZero(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"parent.yml": "settings:\n  enhancedQA: true\n  useSse: 2\n  promptMarksLength: 5\n",
+		"child.yml":  "extends: parent\nsettings:\n  enhancedQA: false\n  useSse: 0\n",
+	})
+
+	// 子提示词写出的false和0也是设置,只有没写的项才继承
+	child, err := ResolveExtends("child.yml", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Settings.EnhancedQA || child.Settings.UseSse != 0 {
+		t.Errorf("enhancedQA %v, useSse %d; child set false and 0", child.Settings.EnhancedQA, child.Settings.UseSse)
+	}
+	if child.Settings.PromptMarksLength != 5 {
+		t.Errorf("promptMarksLength = %d, want inherited 5", child.Settings.PromptMarksLength)
+	}
+}
+
+func TestResolveExtendsPrependRandomAlternatives(t *testing.T) {
+	files := decodePromptFiles(t, map[string]string{
+		"base.yml":  "Prompt:\n- role: system\n  content: A||B\n",
+		"child.yml": "extends: base\nPrompt:\n- role: system\n  content: C||D\n",
+	})
+
+	child, err := ResolveExtends("child.yml", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按||随机选择时,每个候选都是父、子各取一个的组合,不会在接缝处切开
+	got := strings.Split(child.Prompts[0].Content, "||")
+	want := []string{"A\nC", "A\nD", "B\nC", "B\nD"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("alternatives = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,263 @@
+package prompt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 剧情图中config.yml和退出的节点名
+const (
+	GraphRootNode = "config.yml"
+	GraphExitNode = "退出"
+)
+
+// GraphEdge 剧情图中的一条边,Label为触发条件
+type GraphEdge struct {
+	From  string
+	To    string
+	Kind  string // promptMarks switchOnQ switchOnA exitOnQ exitOnA promptChoicesQ等
+	Label string
+}
+
+// StoryGraph 提示词之间的切换关系,节点为提示词,Missing为被引用但不存在或没有Prompt的提示词
+type StoryGraph struct {
+	Nodes   []string
+	Missing map[string]bool
+	Edges   []GraphEdge
+}
+
+// BuildGraph 解析提示词目录中的全部提示词,生成剧情状态图,global为config.yml的设置
+// -env和-keyboard附属文件不作为节点,无法解析的文件会被跳过
+func BuildGraph(global structs.Settings) (StoryGraph, error) {
+	graph := StoryGraph{Missing: make(map[string]bool)}
+
+	directory := PromptsDir()
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return graph, fmt.Errorf("无法读取提示词目录:%w", err)
+	}
+
+	rawSettings := make(map[string]structs.Settings)
+	promptFiles := make(map[string]PromptFile)
+	var names []string
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".yml" {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".yml")
+		if isCompanion(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(directory, file.Name()))
+		if err != nil {
+			continue
+		}
+		promptFile, err := decodePromptFile(data)
+		if err != nil {
+			continue
+		}
+		rawSettings[name] = promptFile.Settings
+		if promptFile.loadable() {
+			promptFiles[file.Name()] = promptFile
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// 子提示词继承父提示词的分支
+	settings := make(map[string]structs.Settings)
+	loaded := make(map[string]bool)
+	for _, name := range names {
+		if _, ok := promptFiles[name+".yml"]; !ok {
+			settings[name] = rawSettings[name]
+			continue
+		}
+		resolved, _ := ResolveExtends(name+".yml", promptFiles)
+		settings[name] = resolved.Settings
+		loaded[name] = len(resolved.Prompts) > 0
+	}
+
+	graph.Nodes = append([]string{GraphRootNode}, names...)
+	graph.addEdges(GraphRootNode, global, loaded)
+	for _, name := range names {
+		graph.addEdges(name, settings[name], loaded)
+	}
+	if graph.hasExit() {
+		graph.Nodes = append(graph.Nodes, GraphExitNode)
+	}
+	return graph, nil
+}
+
+// addEdges 添加一个提示词的全部分支,replaceText类的规则不切换提示词,作为指向自身的边
+func (g *StoryGraph) addEdges(from string, settings structs.Settings, loaded map[string]bool) {
+	add := func(to string, kind string, label string) {
+		if to != GraphExitNode && to != GraphRootNode && !loaded[to] {
+			g.Missing[to] = true
+		}
+		g.Edges = append(g.Edges, GraphEdge{From: from, To: to, Kind: kind, Label: label})
+	}
+
+	for _, mark := range settings.PromptMarks {
+		if mark.BranchName == "" {
+			continue
+		}
+		if len(mark.Keywords) == 0 {
+			add(mark.BranchName, "promptMarks", withCondition(fmt.Sprintf("满%d轮", settings.PromptMarksLength), mark.Condition))
+		} else {
+			add(mark.BranchName, "promptMarks", withCondition(strings.Join(mark.Keywords, "/"), mark.Condition))
+		}
+	}
+	for _, group := range []struct {
+		field    string
+		switches []structs.PromptSwitch
+	}{{"switchOnQ", settings.SwitchOnQ}, {"switchOnA", settings.SwitchOnA}} {
+		for _, choice := range group.switches {
+			for _, target := range choice.Switch {
+				if target != "" {
+					add(target, group.field, withCondition(edgeLabel(group.field, choice.Round, choice.Keywords), choice.Condition))
+				}
+			}
+		}
+	}
+	for _, group := range []struct {
+		field string
+		exits []structs.PromptExit
+	}{{"exitOnQ", settings.ExitOnQ}, {"exitOnA", settings.ExitOnA}} {
+		for _, exit := range group.exits {
+			add(GraphExitNode, group.field, edgeLabel(group.field, exit.Round, exit.Keywords))
+		}
+	}
+	for _, group := range []struct {
+		field   string
+		choices []structs.PromptChoice
+	}{
+		{"promptChoicesQ", settings.PromptChoicesQ},
+		{"promptChoicesA", settings.PromptChoicesA},
+		{"promptCoverQ", settings.PromptCoverQ},
+		{"promptCoverA", settings.PromptCoverA},
+	} {
+		for _, choice := range group.choices {
+			add(from, group.field, edgeLabel(group.field, choice.Round, choice.Keywords))
+		}
+	}
+	for _, group := range []struct {
+		field      string
+		changeVars []structs.PromptChangeVar
+	}{{"changeVarsQ", settings.ChangeVarsQ}, {"changeVarsA", settings.ChangeVarsA}} {
+		for _, changeVar := range group.changeVars {
+			add(from, group.field, fmt.Sprintf("%s → %s %s", edgeLabel(group.field, changeVar.Round, changeVar.Keywords), changeVar.Var, changeVar.Change))
+		}
+	}
+}
+
+func (g *StoryGraph) hasExit() bool {
+	for _, edge := range g.Edges {
+		if edge.To == GraphExitNode {
+			return true
+		}
+	}
+	return false
+}
+
+// edgeLabel 边的说明,如 switchOnQ 第2轮: 关键词1/关键词2,changeVars的round为0时不限轮次
+func edgeLabel(field string, round int, keywords []string) string {
+	label := fmt.Sprintf("%s 第%d轮", field, round)
+	if round == 0 {
+		label = field + " 任意轮次"
+	}
+	if len(keywords) > 0 {
+		label += ": " + strings.Join(keywords, "/")
+	}
+	return label
+}
+
+// withCondition 在边的说明后加上数值变量条件,如 [affection >= 50]
+func withCondition(label string, condition string) string {
+	if condition == "" {
+		return label
+	}
+	return fmt.Sprintf("%s [%s]", label, condition)
+}
+
+// allNodes 节点加上被引用但不存在的提示词
+func (g StoryGraph) allNodes() []string {
+	nodes := append([]string{}, g.Nodes...)
+	known := make(map[string]bool)
+	for _, node := range nodes {
+		known[node] = true
+	}
+	var missing []string
+	for name := range g.Missing {
+		if !known[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return append(nodes, missing...)
+}
+
+// DOT 输出Graphviz格式,不存在的提示词用红色虚线框表示
+func (g StoryGraph) DOT() string {
+	var builder strings.Builder
+	builder.WriteString("digraph story {\n")
+	builder.WriteString("  rankdir=LR;\n")
+	builder.WriteString("  node [shape=box];\n")
+	for _, node := range g.allNodes() {
+		attrs := ""
+		switch {
+		case node == GraphRootNode:
+			attrs = " [style=bold]"
+		case node == GraphExitNode:
+			attrs = " [shape=doublecircle]"
+		case g.Missing[node]:
+			attrs = " [style=dashed, color=red]"
+		}
+		fmt.Fprintf(&builder, "  %s%s;\n", dotQuote(node), attrs)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&builder, "  %s -> %s [label=%s];\n", dotQuote(edge.From), dotQuote(edge.To), dotQuote(edge.Label))
+	}
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// Mermaid 输出Mermaid flowchart格式,节点名可能含有Mermaid不支持的字符,统一使用编号作为ID
+func (g StoryGraph) Mermaid() string {
+	var builder strings.Builder
+	builder.WriteString("flowchart LR\n")
+	ids := make(map[string]string)
+	for i, node := range g.allNodes() {
+		id := fmt.Sprintf("n%d", i)
+		ids[node] = id
+		if node == GraphExitNode {
+			fmt.Fprintf(&builder, "  %s((%s))\n", id, mermaidQuote(node))
+		} else {
+			fmt.Fprintf(&builder, "  %s[%s]\n", id, mermaidQuote(node))
+		}
+		if g.Missing[node] {
+			fmt.Fprintf(&builder, "  style %s stroke:#f00,stroke-dasharray:5 5\n", id)
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&builder, "  %s -->|%s| %s\n", ids[edge.From], mermaidQuote(edge.Label), ids[edge.To])
+	}
+	return builder.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, `"`, "#quot;")
+	s = strings.ReplaceAll(s, "\n", " ")
+	return `"` + s + `"`
+}
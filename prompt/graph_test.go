@@ -0,0 +1,123 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// usePromptsDir 把提示词目录换成写入了files的临时目录,提示词目录是相对于工作目录的路径
+func usePromptsDir(t *testing.T, files map[string]string) {
+	t.Helper()
+	directory, err := os.MkdirTemp(".", "testprompts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := promptsDir
+	promptsDir = directory
+	t.Cleanup(func() { promptsDir = previous })
+}
+
+func TestBuildGraph(t *testing.T) {
+	usePromptsDir(t, map[string]string{
+		"start.yml": `Prompt:
+- role: system
+  content: 开场
+settings:
+  switchOnQ:
+  - round: 2
+    switch: ["forest", "shop"]
+    keywords: ["出发"]
+  promptChoicesQ:
+  - round: 1
+    keywords: ["你好"]
+    replaceText: ["问好"]
+`,
+		"forest.yml": `Prompt:
+- role: system
+  content: 森林
+settings:
+  exitOnA:
+  - round: 3
+    keywords: ["再见"]
+`,
+		"forest-keyboard.yml": "Prompt:\n- role: system\n  content: 按钮\n",
+		"readme.txt":          "不是提示词",
+	})
+
+	global := structs.Settings{PromptMarksLength: 2, PromptMarks: []structs.BranchConfig{{BranchName: "start"}}}
+	graph, err := BuildGraph(global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 附属文件和非yml文件不是节点,有退出分支时加上退出节点
+	if got, want := strings.Join(graph.Nodes, ","), strings.Join([]string{GraphRootNode, "forest", "start", GraphExitNode}, ","); got != want {
+		t.Errorf("nodes = %s, want %s", got, want)
+	}
+	want := []GraphEdge{
+		{GraphRootNode, "start", "promptMarks", "满2轮"},
+		{"forest", GraphExitNode, "exitOnA", "exitOnA 第3轮: 再见"},
+		{"start", "forest", "switchOnQ", "switchOnQ 第2轮: 出发"},
+		{"start", "shop", "switchOnQ", "switchOnQ 第2轮: 出发"},
+		{"start", "start", "promptChoicesQ", "promptChoicesQ 第1轮: 你好"},
+	}
+	if len(graph.Edges) != len(want) {
+		t.Fatalf("edges = %+v, want %+v", graph.Edges, want)
+	}
+	for i := range want {
+		if graph.Edges[i] != want[i] {
+			t.Errorf("edge %d = %+v, want %+v", i, graph.Edges[i], want[i])
+		}
+	}
+	if len(graph.Missing) != 1 || !graph.Missing["shop"] {
+		t.Errorf("missing = %v, want only shop", graph.Missing)
+	}
+}
+
+func TestStoryGraphExport(t *testing.T) {
+	graph := StoryGraph{
+		Nodes:   []string{GraphRootNode, "start", GraphExitNode},
+		Missing: map[string]bool{"shop": true},
+		Edges: []GraphEdge{
+			{GraphRootNode, "start", "promptMarks", "满2轮"},
+			{"start", "shop", "switchOnQ", `switchOnQ 第1轮: 说"买"`},
+			{"start", GraphExitNode, "exitOnQ", "exitOnQ 第3轮"},
+		},
+	}
+
+	dot := graph.DOT()
+	for _, line := range []string{
+		`"config.yml" [style=bold];`,
+		`"shop" [style=dashed, color=red];`,
+		`"退出" [shape=doublecircle];`,
+		`"start" -> "shop" [label="switchOnQ 第1轮: 说\"买\""];`,
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("DOT missing %s:\n%s", line, dot)
+		}
+	}
+
+	// 被引用但不存在的提示词排在最后,节点用编号作为ID
+	mermaid := graph.Mermaid()
+	for _, line := range []string{
+		"flowchart LR\n",
+		`n2(("退出"))`,
+		`n3["shop"]`,
+		"style n3 stroke:#f00,stroke-dasharray:5 5",
+		`n1 -->|"switchOnQ 第1轮: 说#quot;买#quot;"| n3`,
+	} {
+		if !strings.Contains(mermaid, line) {
+			t.Errorf("Mermaid missing %s:\n%s", line, mermaid)
+		}
+	}
+}
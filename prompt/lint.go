@@ -0,0 +1,400 @@
+package prompt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+	"gopkg.in/yaml.v3"
+)
+
+// 检查结果的级别
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintIssue 提示词检查发现的一个问题
+type LintIssue struct {
+	File    string
+	Level   string
+	Message string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("[%s] %s: %s", i.Level, i.File, i.Message)
+}
+
+// setVars可以设置的剧情变量
+var storyVarNames = map[string]bool{
+	"str1": true, "str2": true, "str3": true, "str4": true, "str5": true,
+	"str6": true, "str7": true, "str8": true, "str9": true, "str10": true,
+}
+
+// 检查中的一个提示词文件
+type lintPrompt struct {
+	file     string
+	settings structs.Settings
+	loaded   bool // 与载入时一致,没有Prompt的文件不会被载入
+}
+
+// Lint 检查提示词目录中的全部提示词,global为config.yml的设置,入口为空时把没有被引用的提示词作为入口
+// 检查内容:分支引用的提示词不存在、无法到达的提示词、超出promptMarksLength的轮次、空的replaceText和switch、无效的正则触发词、setVars的变量名、无效的数值变量条件和修改、settings中不存在的配置项
+func Lint(global structs.Settings, entries []string, checkKeyboard bool) []LintIssue {
+	var issues []LintIssue
+	add := func(file string, level string, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{File: file, Level: level, Message: fmt.Sprintf(format, args...)})
+	}
+
+	directory := PromptsDir()
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		add(directory, LintError, "无法读取提示词目录:%v", err)
+		return issues
+	}
+
+	prompts := make(map[string]*lintPrompt)
+	promptFiles := make(map[string]PromptFile)
+	var names []string
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".yml" {
+			continue
+		}
+		path := filepath.Join(directory, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			add(file.Name(), LintError, "无法读取:%v", err)
+			continue
+		}
+		promptFile, err := decodePromptFile(data)
+		if err != nil {
+			add(file.Name(), LintError, "YAML解析失败:%v", err)
+			continue
+		}
+		for _, key := range unknownPromptKeys(data) {
+			add(file.Name(), LintError, "未知的配置项%s", key)
+		}
+
+		if promptFile.ExtendsMode != "" && promptFile.ExtendsMode != ExtendsPrepend && promptFile.ExtendsMode != ExtendsOverride {
+			add(file.Name(), LintError, "未知的extendsMode %q,可选prepend或override", promptFile.ExtendsMode)
+		}
+		if promptFile.loadable() {
+			promptFiles[file.Name()] = promptFile
+		}
+
+		name := strings.TrimSuffix(file.Name(), ".yml")
+		prompts[name] = &lintPrompt{file: file.Name(), settings: promptFile.Settings}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// 按载入后的样子检查,继承的settings和Prompt一并计入
+	for _, name := range names {
+		p := prompts[name]
+		if promptFile, ok := promptFiles[p.file]; ok {
+			resolved, err := ResolveExtends(p.file, promptFiles)
+			if err != nil {
+				add(p.file, LintError, "extends解析失败:%v", err)
+			}
+			p.settings = resolved.Settings
+			p.loaded = len(resolved.Prompts) > 0
+			if promptFile.Extends != "" && !p.loaded {
+				add(p.file, LintWarning, "继承%s后仍然没有Prompt,引用它的分支会回到默认提示词", promptFile.Extends)
+			}
+		}
+		if !p.loaded && promptFiles[p.file].Extends == "" {
+			add(p.file, LintWarning, "没有Prompt,不会被载入,引用它的分支会回到默认提示词")
+		}
+	}
+
+	exists := func(name string) bool {
+		p, ok := prompts[name]
+		return ok && p.loaded
+	}
+
+	// 引用关系,config.yml中的全局剧情作为入口
+	edges := make(map[string][]string)
+	referenced := make(map[string]bool)
+	check := func(from string, file string, settings structs.Settings) {
+		length := settings.PromptMarksLength
+		if length < 1 {
+			length = 1
+		}
+		checkRound := func(field string, index int, round int) {
+			if round < 1 || round > length {
+				add(file, LintError, "%s[%d]的round %d 超出promptMarksLength(%d),不会生效", field, index, round, settings.PromptMarksLength)
+			}
+		}
+		// 触发词的写法见applogic/trigger.go
+		checkKeywords := func(field string, index int, keywords []string) {
+			for _, keyword := range keywords {
+				trigger := strings.TrimPrefix(keyword, "!")
+				trigger = strings.TrimPrefix(strings.TrimPrefix(trigger, "~"), "re:")
+				if trigger == "" {
+					add(file, LintError, "%s[%d]的触发词%q为空", field, index, keyword)
+					continue
+				}
+				if strings.HasPrefix(strings.TrimPrefix(keyword, "!"), "re:") {
+					if _, err := regexp.Compile(trigger); err != nil {
+						add(file, LintError, "%s[%d]的触发词%q不是有效的正则:%v", field, index, keyword, err)
+					}
+				}
+			}
+		}
+		checkCondition := func(field string, index int, condition string) {
+			if _, err := ParseCondition(condition); err != nil {
+				add(file, LintError, "%s[%d]的condition无效:%v", field, index, err)
+			}
+		}
+		reference := func(field string, index int, target string) {
+			if target == "" {
+				add(file, LintError, "%s[%d]的分支名为空", field, index)
+				return
+			}
+			edges[from] = append(edges[from], target)
+			referenced[target] = true
+			if !exists(target) {
+				add(file, LintError, "%s[%d]引用的%s.yml不存在或没有Prompt", field, index, target)
+			}
+		}
+
+		for i, mark := range settings.PromptMarks {
+			reference("promptMarks", i, mark.BranchName)
+			checkKeywords("promptMarks", i, mark.Keywords)
+			checkCondition("promptMarks", i, mark.Condition)
+		}
+		for _, group := range []struct {
+			field    string
+			switches []structs.PromptSwitch
+		}{{"switchOnQ", settings.SwitchOnQ}, {"switchOnA", settings.SwitchOnA}} {
+			field := group.field
+			for i, choice := range group.switches {
+				checkRound(field, i, choice.Round)
+				checkKeywords(field, i, choice.Keywords)
+				checkCondition(field, i, choice.Condition)
+				if len(choice.Switch) == 0 {
+					add(file, LintError, "%s[%d]的switch为空", field, i)
+				}
+				for _, target := range choice.Switch {
+					reference(field, i, target)
+				}
+			}
+		}
+		for _, group := range []struct {
+			field   string
+			choices []structs.PromptChoice
+		}{
+			{"promptChoicesQ", settings.PromptChoicesQ},
+			{"promptChoicesA", settings.PromptChoicesA},
+			{"promptCoverQ", settings.PromptCoverQ},
+			{"promptCoverA", settings.PromptCoverA},
+		} {
+			field := group.field
+			for i, choice := range group.choices {
+				checkRound(field, i, choice.Round)
+				checkKeywords(field, i, choice.Keywords)
+				if len(choice.ReplaceText) == 0 {
+					add(file, LintError, "%s[%d]的replaceText为空", field, i)
+				}
+			}
+		}
+		for _, group := range []struct {
+			field string
+			exits []structs.PromptExit
+		}{{"exitOnQ", settings.ExitOnQ}, {"exitOnA", settings.ExitOnA}} {
+			field := group.field
+			for i, exit := range group.exits {
+				checkRound(field, i, exit.Round)
+				checkKeywords(field, i, exit.Keywords)
+			}
+		}
+		for _, group := range []struct {
+			field   string
+			setVars []structs.PromptSetVar
+		}{{"setVarsQ", settings.SetVarsQ}, {"setVarsA", settings.SetVarsA}} {
+			field := group.field
+			for i, setVar := range group.setVars {
+				// round为0时不限轮次
+				if setVar.Round != 0 {
+					checkRound(field, i, setVar.Round)
+				}
+				checkKeywords(field, i, setVar.Keywords)
+				if !storyVarNames[setVar.Var] {
+					add(file, LintError, "%s[%d]的var %q 不是str1到str10", field, i, setVar.Var)
+				}
+			}
+		}
+		for _, group := range []struct {
+			field      string
+			changeVars []structs.PromptChangeVar
+		}{{"changeVarsQ", settings.ChangeVarsQ}, {"changeVarsA", settings.ChangeVarsA}} {
+			field := group.field
+			for i, changeVar := range group.changeVars {
+				// round为0时不限轮次
+				if changeVar.Round != 0 {
+					checkRound(field, i, changeVar.Round)
+				}
+				checkKeywords(field, i, changeVar.Keywords)
+				if !ValidVarName(changeVar.Var) {
+					add(file, LintError, "%s[%d]的var %q 不是有效的数值变量名", field, i, changeVar.Var)
+				}
+				if _, err := ParseVarChange(changeVar.Change); err != nil {
+					add(file, LintError, "%s[%d]的%v", field, i, err)
+				}
+			}
+		}
+	}
+
+	check("", "config.yml", global)
+	for _, name := range names {
+		p := prompts[name]
+		check(name, p.file, p.settings)
+
+		// -env和-keyboard是对应提示词的附属文件
+		for _, suffix := range []string{"-env", "-keyboard"} {
+			if strings.HasSuffix(name, suffix) {
+				base := strings.TrimSuffix(name, suffix)
+				edges[base] = append(edges[base], name)
+				referenced[name] = true
+				if _, ok := prompts[base]; !ok {
+					add(p.file, LintWarning, "对应的%s.yml不存在", base)
+				}
+			}
+		}
+		if isCompanion(name) {
+			continue
+		}
+		if p.settings.EnvType != 0 {
+			if _, ok := prompts[name+"-env"]; !ok {
+				add(p.file, LintWarning, "设置了envType但%s-env.yml不存在,将使用默认提示词生成场景", name)
+			}
+		}
+		if checkKeyboard {
+			if _, ok := prompts[name+"-keyboard"]; !ok {
+				add(p.file, LintWarning, "开启了useAIPromptkeyboard但%s-keyboard.yml不存在,将使用默认提示词生成气泡", name)
+			}
+		}
+	}
+
+	// 从入口出发标记能到达的提示词
+	roots := []string{""}
+	if len(entries) > 0 {
+		for _, entry := range entries {
+			if !exists(entry) {
+				add("-lint-entry", LintError, "入口%s.yml不存在或没有Prompt", entry)
+			}
+			roots = append(roots, entry)
+		}
+	} else {
+		for _, name := range names {
+			if !referenced[name] {
+				roots = append(roots, name)
+			}
+		}
+	}
+	reachable := make(map[string]bool)
+	for len(roots) > 0 {
+		name := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if reachable[name] {
+			continue
+		}
+		reachable[name] = true
+		roots = append(roots, edges[name]...)
+	}
+	for _, name := range names {
+		if !reachable[name] {
+			add(prompts[name].file, LintWarning, "从入口无法到达")
+		}
+	}
+
+	return issues
+}
+
+// isCompanion 是否是-env或-keyboard附属文件
+func isCompanion(name string) bool {
+	return strings.HasSuffix(name, "-env") || strings.HasSuffix(name, "-keyboard")
+}
+
+// unknownPromptKeys 返回提示词文件中PromptFile没有的键,解析时这些键会被静默忽略
+func unknownPromptKeys(data []byte) []string {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+	var keys []string
+	collectUnknownKeys(root.Content[0], reflect.TypeOf(PromptFile{}), "", &keys)
+	return keys
+}
+
+// collectUnknownKeys 按结构体的yaml标签递归比较映射中的键
+func collectUnknownKeys(node *yaml.Node, t reflect.Type, path string, keys *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			field, ok := fields[key]
+			if !ok {
+				*keys = append(*keys, keyPath)
+				continue
+			}
+			collectUnknownKeys(node.Content[i+1], field, keyPath, keys)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for i, item := range node.Content {
+			collectUnknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), keys)
+		}
+	}
+}
+
+// yamlFields 结构体中yaml键与字段类型的对应关系,与yaml.v3的默认规则一致
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		name := yamlKey(field)
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(tag, ",inline") {
+			for key, value := range yamlFields(field.Type) {
+				fields[key] = value
+			}
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// yamlKey 字段在yaml中的键,没有标签时为小写的字段名,与yaml.v3的默认规则一致
+func yamlKey(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 
@@ -22,16 +23,27 @@ type Prompt struct {
 }
 
 type PromptFile struct {
-	Prompts  []Prompt         `yaml:"Prompt"`
-	Settings structs.Settings `yaml:"settings"`
+	Prompts     []Prompt         `yaml:"Prompt"`
+	Settings    structs.Settings `yaml:"settings"`
+	Extends     string           `yaml:"extends"`     // 继承的提示词,不含.yml
+	ExtendsMode string           `yaml:"extendsMode"` // prepend或override,见extends.go
+
+	settingKeys map[string]bool // 文件中settings下写出的键,extends合并时只有写出的项覆盖父提示词
 }
 
 var (
 	promptsCache = make(map[string]PromptFile)
 	lock         sync.RWMutex
-	promptsDir   = "prompts" // 定义固定的目录名
+	promptsDir   = "prompts" // 默认的目录名,可通过promptsPath修改
+
+	watcherMu     sync.Mutex // 保护promptsDir、watcher和pendingTimers
+	watcher       *fsnotify.Watcher
+	pendingTimers = make(map[string]*time.Timer)
 )
 
+// 文件变动后等待该时间没有新的变动再载入,编辑器保存时通常会先清空再写入
+const reloadDelay = 200 * time.Millisecond
+
 func init() {
 	// 通过 init 函数在包加载时就执行目录监控
 	err := LoadPrompts()
@@ -42,28 +54,17 @@ func init() {
 
 // LoadPrompts 确保目录存在并尝试加载提示词文件
 func LoadPrompts() error {
-	// 构建目录路径
-	directory := filepath.Join(".", promptsDir)
-
-	// 尝试创建目录（如果不存在）
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		// 目录不存在，尝试创建它
-		if err := os.MkdirAll(directory, os.ModePerm); err != nil {
-			return err
-		}
-	}
-	files, err := os.ReadDir(directory)
+	directory := PromptsDir()
+	cache, err := loadDirectory(directory)
 	if err != nil {
 		return err
 	}
+	lock.Lock()
+	promptsCache = cache
+	invalidateResolved()
+	lock.Unlock()
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".yml" {
-			loadFile(filepath.Join(directory, file.Name()))
-		}
-	}
-
-	watcher, err := fsnotify.NewWatcher()
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
@@ -71,14 +72,15 @@ func LoadPrompts() error {
 	go func() {
 		for {
 			select {
-			case event, ok := <-watcher.Events:
+			case event, ok := <-w.Events:
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					loadFile(event.Name)
+				// 创建、写入、删除和重命名都重新同步该文件,重命名时新文件名会收到Create
+				if filepath.Ext(event.Name) == ".yml" && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+					scheduleSync(event.Name)
 				}
-			case err, ok := <-watcher.Errors:
+			case err, ok := <-w.Errors:
 				if !ok {
 					return
 				}
@@ -87,48 +89,179 @@ func LoadPrompts() error {
 		}
 	}()
 
-	err = watcher.Add(directory)
+	err = w.Add(directory)
 	if err != nil {
 		return err
 	}
 
+	watcherMu.Lock()
+	watcher = w
+	watcherMu.Unlock()
 	return nil
 }
 
-func loadFile(filename string) {
-	lock.Lock()
-	defer lock.Unlock()
+// PromptsDir 当前的提示词目录
+func PromptsDir() string {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+	return promptsDir
+}
 
-	data, err := os.ReadFile(filename)
+// SetPromptsDir 切换提示词目录,重新载入全部提示词并监控新目录,目录未变化时不做任何事
+func SetPromptsDir(directory string) error {
+	if directory == "" {
+		directory = "prompts"
+	}
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+	if filepath.Clean(directory) == filepath.Clean(promptsDir) {
+		return nil
+	}
+
+	cache, err := loadDirectory(directory)
 	if err != nil {
-		log.Println("Failed to read file:", err)
-		return
+		return err
+	}
+	if watcher != nil {
+		if err := watcher.Add(directory); err != nil {
+			return err
+		}
+		watcher.Remove(promptsDir)
+	}
+	for name, timer := range pendingTimers {
+		timer.Stop()
+		delete(pendingTimers, name)
 	}
 
-	var prompts PromptFile
-	err = yaml.Unmarshal(data, &prompts)
+	lock.Lock()
+	promptsCache = cache
+	invalidateResolved()
+	lock.Unlock()
+	fmt.Printf("提示词目录切换为%s,共载入%d个提示词\n", directory, len(cache))
+	promptsDir = directory
+	return nil
+}
+
+// loadDirectory 确保目录存在并解析其中全部的提示词
+func loadDirectory(directory string) (map[string]PromptFile, error) {
+	// 尝试创建目录（如果不存在）
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		// 目录不存在，尝试创建它
+		if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	files, err := os.ReadDir(directory)
 	if err != nil {
-		log.Printf("failed to unmarshal YAML[%v]:%v", filename, err)
+		return nil, err
+	}
+
+	cache := make(map[string]PromptFile)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".yml" {
+			continue
+		}
+		prompts, ok := parseFile(filepath.Join(directory, file.Name()))
+		if ok && prompts.loadable() {
+			cache[file.Name()] = prompts
+			fmt.Printf("成功载入prompts[%v]\n", file.Name())
+		}
+	}
+	return cache, nil
+}
+
+// scheduleSync 合并短时间内同一文件的多次变动
+func scheduleSync(filename string) {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+	if timer, ok := pendingTimers[filename]; ok {
+		timer.Stop()
+	}
+	pendingTimers[filename] = time.AfterFunc(reloadDelay, func() {
+		watcherMu.Lock()
+		delete(pendingTimers, filename)
+		watcherMu.Unlock()
+		syncFile(filename)
+	})
+}
+
+// syncFile 让缓存与磁盘上的文件一致,文件不存在时移除
+func syncFile(filename string) {
+	// 切换目录前旧目录中的变动
+	if filepath.Clean(filepath.Dir(filename)) != filepath.Clean(PromptsDir()) {
+		return
+	}
+	baseName := filepath.Base(filename)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		lock.Lock()
+		_, cached := promptsCache[baseName]
+		delete(promptsCache, baseName)
+		invalidateResolved()
+		lock.Unlock()
+		if cached {
+			fmt.Printf("prompts[%v]已删除\n", baseName)
+		}
 		return
 	}
+	loadFile(filename)
+}
 
+// loadFile 在锁外读取和解析,解析成功后整体替换缓存中的PromptFile,解析失败时保留原来的内容
+func loadFile(filename string) {
 	baseName := filepath.Base(filename)
-	if len(prompts.Prompts) == 0 {
-		fmt.Printf("prompts[%v][%v]载入中\n", baseName, filename)
+	prompts, ok := parseFile(filename)
+	if !ok {
+		return
+	}
+	if !prompts.loadable() {
+		lock.Lock()
+		delete(promptsCache, baseName)
+		invalidateResolved()
+		lock.Unlock()
+		fmt.Printf("prompts[%v][%v]没有Prompt,未载入\n", baseName, filename)
 		return
 	}
 
+	lock.Lock()
 	promptsCache[baseName] = prompts
+	invalidateResolved()
+	lock.Unlock()
 	fmt.Printf("成功载入prompts[%v]\n", baseName)
 }
 
+// parseFile 读取并解析提示词文件
+func parseFile(filename string) (PromptFile, bool) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Println("Failed to read file:", err)
+		return PromptFile{}, false
+	}
+
+	prompts, err := decodePromptFile(data)
+	if err != nil {
+		log.Printf("failed to unmarshal YAML[%v]:%v", filename, err)
+		return PromptFile{}, false
+	}
+	return prompts, true
+}
+
+// decodePromptFile 解析提示词文件,载入和-lint-prompts检查共用
+func decodePromptFile(data []byte) (PromptFile, error) {
+	var prompts PromptFile
+	if err := yaml.Unmarshal(data, &prompts); err != nil {
+		return prompts, err
+	}
+	prompts.settingKeys = presentSettingKeys(data)
+	return prompts, nil
+}
+
 // GetMessagesFromFilename returns a list of messages, each potentially with randomized content if '||' is used in prompts
 func GetMessagesFromFilename(basename string) ([]structs.Message, error) {
 	lock.RLock()
 	defer lock.RUnlock()
 
 	filename := basename + ".yml"
-	promptFile, exists := promptsCache[filename]
+	promptFile, exists := resolvedPromptFile(filename)
 	if !exists {
 		return nil, fmt.Errorf("no data for file: %s", filename)
 	}
@@ -182,7 +315,7 @@ func GetFirstSystemMessageStruct(basename string) (structs.Message, error) {
 	defer lock.RUnlock()
 
 	filename := basename + ".yml"
-	promptFile, exists := promptsCache[filename]
+	promptFile, exists := resolvedPromptFile(filename)
 	if !exists {
 		return structs.Message{}, fmt.Errorf("no data for file: %s", filename)
 	}
@@ -207,7 +340,7 @@ func GetMessagesExcludingSystem(basename string) ([]structs.Message, error) {
 	defer lock.RUnlock()
 
 	filename := basename + ".yml"
-	promptFile, exists := promptsCache[filename]
+	promptFile, exists := resolvedPromptFile(filename)
 	if !exists {
 		return nil, fmt.Errorf("no data for file: %s", filename)
 	}
@@ -234,7 +367,7 @@ func GetFirstSystemMessage(basename string) (string, error) {
 	defer lock.RUnlock()
 
 	filename := basename + ".yml"
-	promptFile, exists := promptsCache[filename]
+	promptFile, exists := resolvedPromptFile(filename)
 	if !exists {
 		return "", fmt.Errorf("no data for file: %s", filename)
 	}
@@ -261,7 +394,7 @@ func GetSettingFromFilename(basename, settingName string) (interface{}, error) {
 	defer lock.RUnlock()
 
 	filename := basename + ".yml"
-	promptFile, exists := promptsCache[filename]
+	promptFile, exists := resolvedPromptFile(filename)
 	if !exists {
 		return nil, fmt.Errorf("no data for file: %s", filename)
 	}
@@ -286,7 +419,7 @@ func CheckPromptExistence(basename string) bool {
 	lock.RLock()
 	defer lock.RUnlock()
 
-	// 检查文件是否存在于缓存中
-	_, exists := promptsCache[filename]
-	return exists
+	// 检查文件是否存在于缓存中,继承后仍然没有Prompt的视为不存在
+	promptFile, exists := resolvedPromptFile(filename)
+	return exists && len(promptFile.Prompts) > 0
 }
@@ -1,11 +1,12 @@
 package structs
 
 type Message struct {
-	ConversationID  string `json:"conversationId"`
-	ParentMessageID string `json:"parentMessageId"`
-	Text            string `json:"message"`
-	Role            string `json:"role"`
-	CreatedAt       string `json:"created_at"`
+	ConversationID  string            `json:"conversationId"`
+	ParentMessageID string            `json:"parentMessageId"`
+	Text            string            `json:"message"`
+	Role            string            `json:"role"`
+	CreatedAt       string            `json:"created_at"`
+	TemplateVars    map[string]string `json:"template_vars,omitempty"` // 请求conversation端点时携带的模板变量
 }
 
 type WXRequestMessage struct {
@@ -17,12 +18,13 @@ type WXRequestMessage struct {
 }
 
 type WXRequestMessageF struct {
-	ConversationID  string     `json:"conversationId"`
-	ParentMessageID string     `json:"parentMessageId"`
-	Text            string     `json:"message"`
-	Role            string     `json:"role"`
-	CreatedAt       string     `json:"created_at"`
-	WXFunction      WXFunction `json:"functions,omitempty"`
+	ConversationID  string            `json:"conversationId"`
+	ParentMessageID string            `json:"parentMessageId"`
+	Text            string            `json:"message"`
+	Role            string            `json:"role"`
+	CreatedAt       string            `json:"created_at"`
+	WXFunction      WXFunction        `json:"functions,omitempty"`
+	TemplateVars    map[string]string `json:"template_vars,omitempty"` // 请求conversation端点时携带的模板变量
 }
 
 type UsageInfo struct {
@@ -353,6 +355,7 @@ type Settings struct {
 
 	SensitiveMode        bool     `yaml:"sensitiveMode"`
 	SensitiveModeType    int      `yaml:"sensitiveModeType"`
+	SensitiveNormalize   bool     `yaml:"sensitiveNormalize"`
 	DefaultChangeWord    string   `yaml:"defaultChangeWord"`
 	AntiPromptAttackPath string   `yaml:"antiPromptAttackPath"`
 	ReverseUserPrompt    bool     `yaml:"reverseUserPrompt"`
@@ -371,32 +374,81 @@ type Settings struct {
 	CacheChance    int `yaml:"cacheChance"`
 	EmbeddingType  int `yaml:"embeddingType"`
 
-	PrintHanming  bool    `yaml:"printHanming"`
-	CacheK        float64 `yaml:"cacheK"`
-	CacheN        int64   `yaml:"cacheN"`
-	PrintVector   bool    `yaml:"printVector"`
-	VToBThreshold float64 `yaml:"vToBThreshold"`
-	GptModeration bool    `yaml:"gptModeration"`
-
-	VectorSensitiveFilter     bool     `yaml:"vectorSensitiveFilter"`
-	VertorSensitiveThreshold  int      `yaml:"vertorSensitiveThreshold"`
-	AllowedLanguages          []string `yaml:"allowedLanguages"`
-	LanguagesResponseMessages []string `yaml:"langResponseMessages"`
-	QuestionMaxLenth          int      `yaml:"questionMaxLenth"`
-	QmlResponseMessages       []string `yaml:"qmlResponseMessages"`
-	BlacklistResponseMessages []string `yaml:"blacklistResponseMessages"`
-	NoContext                 bool     `yaml:"noContext"`
-	WithdrawCommand           []string `yaml:"withdrawCommand"`
-	MemoryCommand             []string `yaml:"memoryCommand"`
-	MemoryLoadCommand         []string `yaml:"memoryLoadCommand"`
-	NewConversationCommand    []string `yaml:"newConversationCommand"`
-	MemoryListMD              int      `yaml:"memoryListMD"`
-	FunctionMode              bool     `yaml:"functionMode"`
-	FunctionPath              string   `yaml:"functionPath"`
-	UseFunctionPromptkeyboard bool     `yaml:"useFunctionPromptkeyboard"`
-	AIPromptkeyboardPath      string   `yaml:"AIPromptkeyboardPath"`
-	UseAIPromptkeyboard       bool     `yaml:"useAIPromptkeyboard"`
-	SplitByPuntuationsGroup   int      `yaml:"splitByPuntuationsGroup"`
+	PrintHanming       bool    `yaml:"printHanming"`
+	CacheK             float64 `yaml:"cacheK"`
+	CacheN             int64   `yaml:"cacheN"`
+	PrintVector        bool    `yaml:"printVector"`
+	VToBThreshold      float64 `yaml:"vToBThreshold"`
+	NoEmbeddingMemo    bool    `yaml:"noEmbeddingMemo"`
+	EmbeddingMemoSize  int     `yaml:"embeddingMemoSize"`
+	EmbeddingMemoRows  int     `yaml:"embeddingMemoRows"`
+	EmbeddingBatchSize int     `yaml:"embeddingBatchSize"`
+	GptModeration      bool    `yaml:"gptModeration"`
+
+	VectorSensitiveFilter     bool           `yaml:"vectorSensitiveFilter"`
+	VertorSensitiveThreshold  int            `yaml:"vertorSensitiveThreshold"`
+	InjectionDetect           bool           `yaml:"injectionDetect"`          // 是否在antiPromptAttackPath之前使用本地规则和注入样本检测提示词注入
+	InjectionPatterns         []string       `yaml:"injectionPatterns"`        // 额外的注入检测正则
+	InjectionCorpusThreshold  int            `yaml:"injectionCorpusThreshold"` // 汉明距离,与注入样本在该距离内判定为注入
+	InjectionFailClosed       bool           `yaml:"injectionFailClosed"`      // 检测出错时是否拦截
+	InjectionCacheSize        int            `yaml:"injectionCacheSize"`       // 记录的检测结果数量
+	KnowledgeBases            []string       `yaml:"knowledgeBases"`           // 使用的知识库,knowledge目录下的子目录名
+	KnowledgeTopK             int            `yaml:"knowledgeTopK"`            // 每次请求注入的知识片段数量
+	KnowledgeThreshold        int            `yaml:"knowledgeThreshold"`       // 汉明距离,超过该距离的知识片段不注入
+	KnowledgeChunkSize        int            `yaml:"knowledgeChunkSize"`       // 知识片段长度(字)
+	KnowledgeChunkOverlap     int            `yaml:"knowledgeChunkOverlap"`    // 相邻知识片段重叠的长度(字)
+	UserFacts                 bool           `yaml:"userFacts"`                // 是否从对话中提取并记住关于用户的事实
+	UserFactsPrompt           string         `yaml:"userFactsPrompt"`          // 提取事实所用的提示词yml名,复用AIPromptkeyboardPath
+	UserFactsTopK             int            `yaml:"userFactsTopK"`            // 每次请求注入的事实数量
+	UserFactsThreshold        int            `yaml:"userFactsThreshold"`       // 汉明距离,超过该距离的事实不注入
+	UserFactsDedupThreshold   int            `yaml:"userFactsDedupThreshold"`  // 汉明距离,新事实与旧事实在该距离内视为同一事实并替换
+	UserFactsMax              int            `yaml:"userFactsMax"`             // 每个用户最多保存的事实数量
+	FactListCommand           []string       `yaml:"factListCommand"`          // 查看事实列表指令
+	FactForgetCommand         []string       `yaml:"factForgetCommand"`        // 忘记事实指令
+	AllowedLanguages          []string       `yaml:"allowedLanguages"`
+	LanguagesResponseMessages []string       `yaml:"langResponseMessages"`
+	QuestionMaxLenth          int            `yaml:"questionMaxLenth"`
+	QmlResponseMessages       []string       `yaml:"qmlResponseMessages"`
+	BlacklistResponseMessages []string       `yaml:"blacklistResponseMessages"`
+	BlacklistAdmins           []string       `yaml:"blacklistAdmins"`           // 可以使用黑名单指令的用户ID
+	BlacklistAddCommand       []string       `yaml:"blacklistAddCommand"`       // 添加黑名单指令
+	BlacklistRemoveCommand    []string       `yaml:"blacklistRemoveCommand"`    // 删除黑名单指令
+	BlacklistListCommand      []string       `yaml:"blacklistListCommand"`      // 查看黑名单指令
+	SensitiveAddCommand       []string       `yaml:"sensitiveAddCommand"`       // 添加向量安全词指令
+	SensitiveRemoveCommand    []string       `yaml:"sensitiveRemoveCommand"`    // 删除向量安全词指令
+	SensitiveListCommand      []string       `yaml:"sensitiveListCommand"`      // 查看向量安全词指令
+	SensitiveTestCommand      []string       `yaml:"sensitiveTestCommand"`      // 测试句子与向量安全词距离的指令
+	SensitiveThresholdCommand []string       `yaml:"sensitiveThresholdCommand"` // 设置本群向量安全词阈值的指令
+	NoModerationLog           bool           `yaml:"noModerationLog"`           // 不记录拦截和替换事件
+	ModerationApiToken        string         `yaml:"moderationApiToken"`        // 查询拦截事件接口的token,为空时不开放接口
+	StrikeWeights             []StrikeWeight `yaml:"strikeWeights"`             // 各类拦截计入的违规分数
+	StrikeHalfLife            int            `yaml:"strikeHalfLife"`            // 违规分数的半衰期(分钟)
+	StrikeThreshold           float64        `yaml:"strikeThreshold"`           // 用户违规分数达到该值时临时封禁,0=不封禁
+	StrikeGroupThreshold      float64        `yaml:"strikeGroupThreshold"`      // 群违规分数达到该值时临时封禁,0=不封禁
+	StrikeBanMinutes          int            `yaml:"strikeBanMinutes"`          // 临时封禁时长(分钟)
+	PIIRedactMode             int            `yaml:"piiRedactMode"`             // 0=关闭 1=替换个人信息并在回复中还原 2=只在私聊中还原 3=从不还原
+	PIIDetectors              []string       `yaml:"piiDetectors"`              // 启用的内置个人信息检测:phone idcard email qq
+	PIIPatterns               []PIIPattern   `yaml:"piiPatterns"`               // 自定义个人信息检测规则
+	NoContext                 bool           `yaml:"noContext"`
+	WithdrawCommand           []string       `yaml:"withdrawCommand"`
+	MemoryCommand             []string       `yaml:"memoryCommand"`
+	MemoryLoadCommand         []string       `yaml:"memoryLoadCommand"`
+	NewConversationCommand    []string       `yaml:"newConversationCommand"`
+	MemoryListMD              int            `yaml:"memoryListMD"`
+	StorySaveCommand          []string       `yaml:"storySaveCommand"`    // 剧情存档 名字
+	StoryLoadCommand          []string       `yaml:"storyLoadCommand"`    // 读档 名字,不带名字时列出存档
+	StoryListCommand          []string       `yaml:"storyListCommand"`    // 存档列表
+	StoryDeleteCommand        []string       `yaml:"storyDeleteCommand"`  // 删除存档 名字
+	StorySlotLimit            int            `yaml:"storySlotLimit"`      // 每个用户(群上下文时为每个群)最多的存档数量
+	Experiments               []Experiment   `yaml:"experiments"`         // 提示词A/B实验
+	FeedbackGoodCommand       []string       `yaml:"feedbackGoodCommand"` // 实验中的用户对回复的好评
+	FeedbackBadCommand        []string       `yaml:"feedbackBadCommand"`  // 实验中的用户对回复的差评
+	FunctionMode              bool           `yaml:"functionMode"`
+	FunctionPath              string         `yaml:"functionPath"`
+	UseFunctionPromptkeyboard bool           `yaml:"useFunctionPromptkeyboard"`
+	AIPromptkeyboardPath      string         `yaml:"AIPromptkeyboardPath"`
+	UseAIPromptkeyboard       bool           `yaml:"useAIPromptkeyboard"`
+	SplitByPuntuationsGroup   int            `yaml:"splitByPuntuationsGroup"`
 
 	RwkvApiPath          string   `yaml:"rwkvApiPath"`
 	RwkvMaxTokens        int      `yaml:"rwkvMaxTokens"`
@@ -463,21 +515,30 @@ type Settings struct {
 	WSServerToken string `yaml:"wsServerToken"`
 	WSPath        string `yaml:"wsPath"`
 
-	PromptMarksLength int            `yaml:"promptMarksLength"`
-	PromptMarks       []BranchConfig `yaml:"promptMarks"`
-	EnhancedQA        bool           `yaml:"enhancedQA"`
-	PromptChanceQ     []PromptChance `yaml:"promptChanceQ"`
-	PromptChoicesQ    []PromptChoice `yaml:"promptChoicesQ"`
-	PromptChoicesA    []PromptChoice `yaml:"promptChoicesA"`
-	SwitchOnQ         []PromptSwitch `yaml:"switchOnQ"`
-	SwitchOnA         []PromptSwitch `yaml:"switchOnA"`
-	ExitOnQ           []PromptExit   `yaml:"exitOnQ"`
-	ExitOnA           []PromptExit   `yaml:"exitOnA"`
-	EnvType           int            `yaml:"envType"`
-	EnvPics           []string       `yaml:"envPics"`     //ai太慢了,而且影响气泡了,只能手动了
-	EnvContents       []string       `yaml:"envContents"` //ai太慢了,而且影响气泡了,只能手动了
-	PromptCoverQ      []PromptChoice `yaml:"promptCoverQ"`
-	PromptCoverA      []PromptChoice `yaml:"promptCoverA"` //暂时用不上 待实现
+	PromptMarksLength        int               `yaml:"promptMarksLength"`
+	PromptMarks              []BranchConfig    `yaml:"promptMarks"`
+	EnhancedQA               bool              `yaml:"enhancedQA"`
+	PromptChanceQ            []PromptChance    `yaml:"promptChanceQ"`
+	PromptChoicesQ           []PromptChoice    `yaml:"promptChoicesQ"`
+	PromptChoicesA           []PromptChoice    `yaml:"promptChoicesA"`
+	SwitchOnQ                []PromptSwitch    `yaml:"switchOnQ"`
+	SwitchOnA                []PromptSwitch    `yaml:"switchOnA"`
+	ExitOnQ                  []PromptExit      `yaml:"exitOnQ"`
+	ExitOnA                  []PromptExit      `yaml:"exitOnA"`
+	EnvType                  int               `yaml:"envType"`
+	EnvPics                  []string          `yaml:"envPics"`     //ai太慢了,而且影响气泡了,只能手动了
+	EnvContents              []string          `yaml:"envContents"` //ai太慢了,而且影响气泡了,只能手动了
+	PromptCoverQ             []PromptChoice    `yaml:"promptCoverQ"`
+	PromptCoverA             []PromptChoice    `yaml:"promptCoverA"`             //暂时用不上 待实现
+	SetVarsQ                 []PromptSetVar    `yaml:"setVarsQ"`                 // 用户的Q命中关键词时设置剧情变量
+	SetVarsA                 []PromptSetVar    `yaml:"setVarsA"`                 // 模型的A命中关键词时设置剧情变量
+	ChangeVarsQ              []PromptChangeVar `yaml:"changeVarsQ"`              // 用户的Q命中关键词时修改数值变量
+	ChangeVarsA              []PromptChangeVar `yaml:"changeVarsA"`              // 模型的A命中关键词时修改数值变量
+	BotName                  string            `yaml:"botName"`                  // 模板变量{{bot_name}}
+	SensitiveDicts           []SensitiveDict   `yaml:"sensitiveDicts"`           // 提示词额外使用的敏感词库,叠加在全局词库之上
+	StoryGraphPage           bool              `yaml:"storyGraphPage"`           // 开放 /story/graph 剧情图页面
+	PromptsPath              string            `yaml:"promptsPath"`              // 提示词目录,默认为prompts
+	SemanticTriggerThreshold float64           `yaml:"semanticTriggerThreshold"` // 触发词中~语义例句的余弦相似度阈值
 }
 
 type YuanqiConf struct {
@@ -486,6 +547,26 @@ type YuanqiConf struct {
 	YuanqiName        string `yaml:"yuanqiName"`        // 名字
 }
 
+// SensitiveDict 提示词额外使用的敏感词库
+type SensitiveDict struct {
+	File    string   `yaml:"file"`    // 词库文件,格式与sensitive_words_in.txt相同
+	Type    string   `yaml:"type"`    // in=过滤用户输入 out=过滤模型输出 white=白名单
+	Action  string   `yaml:"action"`  // replace=替换(默认) block=拦截整条消息 reply=拦截整条消息并回复replies中的一条
+	Replies []string `yaml:"replies"` // action为reply时随机回复的内容
+}
+
+// PIIPattern 自定义的个人信息检测规则,含有分组时只替换第一个分组
+type PIIPattern struct {
+	Name    string `yaml:"name"`    // 占位符中的类别名
+	Pattern string `yaml:"pattern"` // 正则表达式
+}
+
+// StrikeWeight 一类拦截计入的违规分数
+type StrikeWeight struct {
+	Stage  string  `yaml:"stage"`  // 拦截阶段,与moderation_events表的stage相同
+	Weight float64 `yaml:"weight"` // 每次计入的分数
+}
+
 // PromptChance 定义了包含概率和文本的结构体
 type PromptChance struct {
 	Probability int    `yaml:"probability"` // 概率值
@@ -496,6 +577,7 @@ type PromptChance struct {
 type BranchConfig struct {
 	BranchName string   `yaml:"branchName"` // 分支标识 yml的名称
 	Keywords   []string `yaml:"keywords"`   // 关键字列表
+	Condition  string   `yaml:"condition"`  // 数值变量条件,如 affection >= 50,不满足时不切换
 }
 
 // PromptChoice 用于存储轮次、替换词和匹配词的结构体
@@ -507,9 +589,40 @@ type PromptChoice struct {
 
 // PromptSwitch 用于存储轮次、切换分支和匹配词的结构体
 type PromptSwitch struct {
-	Round    int      `yaml:"round"`    // 轮次编号
-	Switch   []string `yaml:"switch"`   // 切换分支
-	Keywords []string `yaml:"keywords"` // 匹配词列表
+	Round     int      `yaml:"round"`     // 轮次编号
+	Switch    []string `yaml:"switch"`    // 切换分支
+	Keywords  []string `yaml:"keywords"`  // 匹配词列表
+	Condition string   `yaml:"condition"` // 数值变量条件,如 affection >= 50,不满足时不切换
+}
+
+// PromptSetVar 命中关键词时设置剧情存档中的str1到str10
+type PromptSetVar struct {
+	Round    int      `yaml:"round"`    // 轮次编号,0=任意轮次
+	Keywords []string `yaml:"keywords"` // 匹配词列表,为空时每轮都设置
+	Var      string   `yaml:"var"`      // 变量名 str1到str10
+	Value    string   `yaml:"value"`    // 变量值,可以使用模板变量,{{match}}为命中的匹配词
+}
+
+// PromptChangeVar 命中关键词时修改剧情的数值变量
+type PromptChangeVar struct {
+	Round    int      `yaml:"round"`    // 轮次编号,0=任意轮次
+	Keywords []string `yaml:"keywords"` // 匹配词列表,为空时每轮都修改
+	Var      string   `yaml:"var"`      // 变量名,如 affection
+	Change   string   `yaml:"change"`   // +5 -3 为增减,=10 为设置
+}
+
+// Experiment 提示词A/B实验,请求的提示词为prompt时,按用户或群固定分配到其中一个变体
+type Experiment struct {
+	Name     string              `yaml:"name"`     // 实验名,用于记录分配和统计
+	Prompt   string              `yaml:"prompt"`   // 参与实验的提示词,即上报地址中的prompt参数,为空时为config.yml
+	AssignBy string              `yaml:"assignBy"` // user=按用户分配(默认) group=群消息按群分配,私聊仍按用户
+	Variants []ExperimentVariant `yaml:"variants"` // 变体
+}
+
+// ExperimentVariant 实验的一个变体
+type ExperimentVariant struct {
+	Prompt string `yaml:"prompt"` // 变体使用的提示词名,为空时为config.yml
+	Weight int    `yaml:"weight"` // 权重,分配比例为weight/总权重
 }
 
 // PromptExit 用于存储轮次、切换分支和匹配词的结构体
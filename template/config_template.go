@@ -37,7 +37,11 @@ settings:
   splitByPuntuationsGroup : 10                  #截断率(群),仅在sse时有效,100则代表每句截断
   sensitiveMode : false                         #是否开启敏感词替换
   sensitiveModeType : 0                         #0=只过滤用户输入 1=输出也进行过滤
-  defaultChangeWord : "*"                       #默认的屏蔽词替换,你可以在sensitive_words.txt的####后修改为自己需要,可以用记事本批量替换
+  sensitiveNormalize : false                    #匹配敏感词前先规范化文本:忽略夹在字之间的空格、标点、符号和零宽字符,全角转半角,形近字母还原,大写转小写.句末的。！？；和换行仍作为分界,敏感词不会跨句匹配.拼音、缩写等写法请写在sensitive_alias.txt中,一行一个 别名####敏感词
+  sensitiveDicts : []                           #额外的敏感词库,可在prompts文件夹的提示词yml中单独设置,叠加在全局词库之上,格式同sensitive_words_in.txt,修改后自动重新载入.
+                                                #例:[{file: "kids_in.txt", type: "in", action: "reply", replies: ["我们换个话题吧"]}] type:in=输入 out=输出 white=白名单 action:replace=替换 block=拦截整条消息 reply=拦截并回复,useSse为2时只有replace生效
+  defaultChangeWord : "*"                       #默认的屏蔽词替换,你可以在sensitive_words.txt的####后修改为自己需要,可以用记事本批量替换 修改sensitive_words_in.txt/sensitive_words_out.txt/white.txt后会自动重新载入,无需重启
+                                                #词库中也可以写规则:re:正则表达式####替换文本(Go正则,如 re:1[3-9]\d{9}####[手机号]),wc:通配符####替换文本(?=任意1个字 *=任意0到3个字 *{n}=任意0到n个字,如 wc:傻*{2}瓜).规则只匹配原文,命中时会在日志中输出规则
 
   ignoreExtraTips : false                       #自用,无视[[]]的消息不检查是否是注入[[]]内的内容只能来自自己数据库,向量数据库,不能是用户输入.可能有安全问题.被审核端开启.
   proxy : ""                                    #proxy设定,如http://127.0.0.1:7890 请仅在出海业务使用代理,如discord机器人
@@ -55,6 +59,23 @@ settings:
   memoryLoadCommand : ["载入"]                  #载入指令
   newConversationCommand : ["新对话"]           #新对话指令
   memoryListMD : 0                              #记忆列表使用md按钮(qq开放平台) 0=不用 1=按钮 2=inlinecmd(文字链)
+  storySaveCommand : ["存档"]                   #存档 名字,同时保存对话记忆和剧情进度(当前提示词、轮次和str1~str10),同名存档会被覆盖,不带名字时以时间命名
+  storyLoadCommand : ["读档"]                   #读档 名字开头的前n字,不带名字时列出存档,列表使用memoryListMD的按钮
+  storyListCommand : ["存档列表"]               #列出存档
+  storyDeleteCommand : ["删档"]                 #删档 名字
+  storySlotLimit : 5                            #每个用户最多的存档数量,群上下文(groupContext=2)时为每个群
+  experiments : []                              #提示词A/B实验,请求的提示词为prompt时按用户或群的哈希分配到一个变体并保持不变,统计数据用 -experiment-report 查看
+  #experiments:
+  #- name: "persona-v2"                         #实验名,修改后所有人重新分配
+  #  prompt: ""                                 #参与实验的提示词,即上报地址中的prompt参数,为空时为config.yml
+  #  assignBy: "user"                           #user=按用户分配 group=群消息按群分配
+  #  variants:
+  #  - prompt: ""                               #变体使用的提示词名,为空时为config.yml
+  #    weight: 50
+  #  - prompt: "persona-v2"
+  #    weight: 50
+  feedbackGoodCommand : ["好评"]                #参与实验的用户对回复好评,计入实验统计
+  feedbackBadCommand : ["差评"]                 #参与实验的用户对回复差评,计入实验统计
   hideExtraLogs : false                         #忽略流信息的log,提高性能
   urlSendPics : false                           #自己构造图床加速图片发送.需配置公网ip+放通port+设置正确的selfPath
 
@@ -96,9 +117,29 @@ settings:
   questionMaxLenth : 100                        #最大问题字数. 0代表不限制
   qmlResponseMessages : ["问题太长了,缩短问题试试吧"]  #最大问题长度回复.
   blacklistResponseMessages : ["目前正在维护中...请稍候再试吧"]   #黑名单回复,将userid丢入blacklist.txt 一行一个
+  blacklistAdmins : []                          #可以在聊天中管理黑名单和向量安全词的用户ID,如["123456"].blacklist.txt仍然有效但只读,指令添加的黑名单保存在数据库blacklist_entries表
+  blacklistAddCommand : ["拉黑"]                #拉黑 范围 ID [时长] [self] [原因] 范围:user=用户 group=群或频道 member=群成员(ID写作 用户ID@群ID) 时长:30m 2h 7d 永久(默认) self=只对当前机器人生效
+  blacklistRemoveCommand : ["解除拉黑"]         #解除拉黑 编号,编号可在黑名单列表中查看
+  blacklistListCommand : ["黑名单"]             #查看数据库中未到期的黑名单
+  sensitiveAddCommand : ["添加安全词"]          #添加安全词 句子,计算向量后加入向量安全词并写入vector_sensitive.txt,仅blacklistAdmins可用
+  sensitiveRemoveCommand : ["删除安全词"]       #删除安全词 编号或原文,同时从vector_sensitive.txt中移除
+  sensitiveListCommand : ["安全词列表"]         #安全词列表 [页码]
+  sensitiveTestCommand : ["测试安全词"]         #测试安全词 句子,显示最接近的5个安全词、汉明距离、norm分组和本群阈值,只有同一分组的安全词会拦截,用于调整阈值
+  sensitiveThresholdCommand : ["安全词阈值"]    #安全词阈值 数字,单独设置本群的vertorSensitiveThreshold,0=恢复默认,私聊使用默认值不能单独设置
+  noModerationLog : false                       #默认会把每次拦截和替换(黑名单、语言、字数、向量安全词、提示词安全、敏感词)记录到数据库moderation_events表,true=关闭(违规分数仍会计入).可用 -moderation-report 参数查看统计
+  moderationApiToken : ""                      #设置后开放 /moderation/events?token=xxx 查询拦截记录,可用参数user_id group_id stage prompt since(如24h) limit summary=1.同一token可用于 /sensitive/entries(GET列表 POST添加text DELETE删除id或text) /sensitive/test(GET测试text和group_id POST设置group_id的threshold)
+  strikeThreshold : 0                           #违规分数达到该值时自动临时封禁用户,0=不封禁.封禁会加入数据库中的黑名单,到期自动解除
+  strikeGroupThreshold : 0                      #群内违规分数(群内全部用户之和)达到该值时临时封禁整个群,0=不封禁
+  strikeBanMinutes : 60                         #临时封禁时长(分钟)
+  piiRedactMode : 0                             #发往大模型前将手机号、身份证号、邮箱、QQ号替换为<PHONE_1>这样的占位符,同一对话中同一信息的占位符不变.0=关闭 1=在回复中向本人还原 2=只在私聊回复中还原 3=从不还原,内存中也不保存原文
+  piiDetectors : ["phone","idcard","email","qq"] #启用的内置检测,qq只匹配"QQ号 123456"这样带有提示的写法
+  piiPatterns : []                              #自定义检测,如[{name: "bankcard", pattern: "62\\d{14,17}"}],占位符为<BANKCARD_1>,正则含有分组时只替换第一个分组
+  strikeHalfLife : 1440                         #违规分数的半衰期(分钟),时间越久的违规计入的分数越少
+  strikeWeights : [{stage: "injection", weight: 3}, {stage: "vector_sensitive", weight: 2}]   #各类拦截计入的分数,stage可选 injection vector_sensitive word_in word_out language length
 
   #向量缓存(省钱-酌情调整参数)(进阶!!)需要有一定的调试能力,数据库调优能力,计算和数据测试能力.
   #不同种类的向量,维度和模型不同,所以请一开始决定好使用的向量,或者自行将数据库备份\对应,不同种类向量没有互相检索的能力。
+  #每条向量都记录了模型指纹(embeddingType+接口+vToBThreshold),指纹不同的向量不会被比较,更换后请使用命令行参数 -reembed 重新计算已储存的向量(可中断续跑).
 
   embeddingType : 0                             #0=混元向量 1=文心向量,需设置wenxinEmbeddingUrl 2=chatgpt向量,需设置gptEmbeddingUrl
   useCache : 1                              #使用缓存省钱.
@@ -109,13 +150,41 @@ settings:
   cacheN : 256                                  #分片数量=256个 计算公式 (norm*CacheK) mod cacheN = 分组id 分组越多,分类越精确,数据库越快,cacheN不能大于(norm*CacheK)否则只分一组。
   printVector : false                           #直接输出向量的内容,根据经验判断和设置向量二值化阈值.
   vToBThreshold : 0                             #默认0效果不错,浮点数,向量二值化阈值,这里二值化是为了加速,损失了向量的精度,请根据输出的向量特征,选择具有中间特性的向量二值化阈值.
+  noEmbeddingMemo : false                       #默认会记录计算过的向量(内存+数据库),相同的文本不再重复请求向量接口,true=关闭.
+  embeddingMemoSize : 4096                      #内存中最多记录的向量数量,超出时淘汰最久没有使用的.
+  embeddingMemoRows : 20000                     #数据库中最多记录的向量数量,每条约8KB(1024维),超出时删除最早记录的.
+  embeddingBatchSize : 16                       #批量计算向量时每次请求的文本数量,文心向量支持批量输入(最多16条),混元会逐条请求.
   vectorSensitiveFilter : false                 #是否开启向量拦截词,请放在同目录下的vector_sensitive.txt中 一行一个，可以是句子。 命令行参数 -test 会用test.exe中的内容跑测试脚本。
   vertorSensitiveThreshold : 200                #汉明距离,满足距离代表向量含义相近,可给出拦截.
+  injectionDetect : false                       #提示词注入检测,依次使用本地规则(忽略之前的指令、改写角色、套取系统提示词等)和同目录下injection_corpus.txt中的注入样本(一行一个),都无法判定时才请求antiPromptAttackPath
+  injectionPatterns : []                        #额外的注入检测规则,Go正则,如["(?i)pretend\\s+you\\s+are"]
+  injectionCorpusThreshold : 200               #汉明距离,与注入样本在该距离内判定为注入
+  injectionFailClosed : false                   #检测出错(如antiPromptAttackPath无法访问,或没有设置antiPromptAttackPath时样本向量计算失败)时是否拦截,false=放行
+  injectionCacheSize : 2048                     #按文本记录的检测结果数量,相同的文本不再重复检测
+
+  #知识库(RAG),在knowledge目录下建立子目录,子目录名即知识库名,放入.md/.txt文件,启动时和文件变动时会自动增量索引,命令行参数 -reindex-kb 全部重新索引.
+  knowledgeBases : []                           #使用的知识库名,可在prompts文件夹的提示词yml中单独设置,每次请求会将最相关的片段添加到Q后方.
+  knowledgeTopK : 3                             #每次请求添加的片段数量.
+  knowledgeThreshold : 0                        #汉明距离,超过该距离的片段不添加,0=不限制.
+  knowledgeChunkSize : 300                      #切分片段的长度(字),修改后请使用 -reindex-kb 重新索引.
+  knowledgeChunkOverlap : 50                    #相邻片段重叠的长度(字).
+
+  #长期记忆(用户事实),每次回复后使用AIPromptkeyboardPath和userFactsPrompt对应的提示词从问答中提取关于用户的短句,提示词需要要求模型一行输出一条事实,没有则输出"无".
+  userFacts : false                             #是否开启,需要设置embeddingType和AIPromptkeyboardPath.
+  userFactsPrompt : "facts"                     #提取事实所用的提示词,即prompts文件夹中的facts.yml.
+  userFactsTopK : 3                             #每次请求添加到Q后方的事实数量.
+  userFactsThreshold : 0                        #汉明距离,超过该距离的事实不添加,0=不限制.
+  userFactsDedupThreshold : 0                   #汉明距离,新事实与旧事实在该距离内视为同一事实并替换,0=只合并完全相同的事实.
+  userFactsMax : 50                             #每个用户最多保存的事实数量,超出时删除最久没有更新的.
+  factListCommand : ["我的档案"]                #查看记住的事实
+  factForgetCommand : ["忘记"]                  #忘记 序号 忘记一条 忘记 全部 忘记所有,后面不是序号或全部时作为普通对话
 
   #多配置覆盖,切换条件等设置 该类配置比较绕,可咨询QQ2022717137
+  promptsPath : "prompts"                       #提示词目录,可以是绝对路径,修改后自动重新载入.目录中的yml新增、修改、删除、重命名都会自动生效
   promptMarksLength : 99999                        #未设置keywords时,多少轮开始切换上下文.
   enhancedQA : false                            #默认是false,用于在故事支线将firstQA的位置从顶部移动到用户之前,增强权重和效果.
-  promptMarks:
+  semanticTriggerThreshold : 0.85               #触发词keywords中可以使用 re:正则 !排除词(可与re:和~组合) ~语义例句,语义例句与用户消息的向量余弦相似度达到该值即命中,需要设置embeddingType.命中原因会输出到日志
+  promptMarks:                                  #condition为数值变量条件,如 "affection >= 50 && gold < 10",不满足时不切换,switchOnQ/A同样可以设置
   - branchName: "分支yml名"
     keywords: ["触发词", "触发词2"]
 
@@ -147,6 +216,37 @@ settings:
     - round: 1
       keywords: ["退出"]
 
+  storyGraphPage : false                        #开放 /story/graph 剧情图页面,format=dot或mermaid时返回文本.也可以用 -story-graph dot 启动参数直接输出
+
+  #模板变量 提示词的系统提示词、QA、replaceText、envContents和固定回复中可以使用{{变量名}}
+  #可用变量:nickname card user_id group_id bot_name date time weekday round str1~str10 以及数值变量名 setVars的value中还可以使用match(命中的关键词)
+  botName : ""                                  #{{bot_name}}的值
+  setVarsQ : []                                 #Q命中关键词时设置剧情变量,round为0时不限轮次,keywords为空时总是设置
+  #setVarsQ:
+  #- round: 1
+  #  keywords: ["触发词", "触发词2"]
+  #  var: "str1"
+  #  value: "{{match}}"
+  setVarsA : []                                 #A命中关键词时设置剧情变量,格式同setVarsQ
+  #setVarsA:
+  #- round: 0
+  #  keywords: ["触发词"]
+  #  var: "str2"
+  #  value: "值"
+
+  changeVarsQ : []                              #Q命中关键词时修改数值变量,change为+5 -3增减或=10设置,未设置过的变量为0,重置和退出时清空
+  #changeVarsQ:
+  #- round: 0
+  #  keywords: ["谢谢"]
+  #  var: "affection"
+  #  change: "+5"
+  changeVarsA : []                              #A命中关键词时修改数值变量,格式同changeVarsQ
+  #changeVarsA:
+  #- round: 0
+  #  keywords: ["金币"]
+  #  var: "gold"
+  #  change: "+1"
+
   #混元配置项
   secretId : ""                                 #腾讯云账号(右上角)-访问管理-访问密钥，生成获取
   secretKey : ""
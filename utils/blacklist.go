@@ -10,6 +10,7 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
 )
 
@@ -17,7 +18,7 @@ var blacklist = make(map[string]bool)
 var mu sync.RWMutex
 
 // LoadBlacklist 从给定的文件路径载入黑名单ID。
-// 如果文件不存在，则创建该文件。
+// 如果文件不存在，则创建该文件。文件只读,聊天指令添加的黑名单保存在数据库中。
 func LoadBlacklist(filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -92,92 +93,78 @@ func WatchBlacklist(filePath string) {
 	<-done // Keep the watcher alive
 }
 
-// BlacklistIntercept 检查用户ID是否在黑名单中，如果在，则发送预设消息
-func BlacklistIntercept(message structs.OnebotGroupMessage, selfid string, promptstr string) bool {
-	// 检查群ID是否在黑名单中
-	if IsInBlacklist(strconv.FormatInt(message.GroupID, 10)) {
-		// 获取黑名单响应消息
-		responseMessage := config.GetBlacklistResponseMessages()
-
-		// 根据消息类型发送响应
-		if message.RealMessageType == "group_private" || message.MessageType == "private" {
-			if !config.GetUsePrivateSSE() {
-				SendPrivateMessage(message.UserID, responseMessage, selfid, promptstr)
-			} else {
-				SendSSEPrivateMessage(message.UserID, responseMessage, promptstr, selfid)
-			}
-		} else {
-			SendGroupMessage(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
-		}
+// blacklistRule 依次检查黑名单文件中的群ID、用户ID和数据库中的黑名单,返回拦截记录中的规则
+func blacklistRule(userID string, groupID string, selfid string) (string, bool) {
+	if IsInBlacklist(groupID) {
+		return "file:group:" + groupID, true
+	}
+	if IsInBlacklist(userID) {
+		return "file:user:" + userID, true
+	}
+	if entry, ok := moderation.MatchBlacklist(userID, groupID, selfid); ok {
+		return fmt.Sprintf("entry:%d %s %s", entry.ID, entry.Target(), entry.Reason), true
+	}
+	return "", false
+}
 
-		fmt.Printf("groupid:[%v]这个群在黑名单中,被拦截\n", message.GroupID)
-		return true // 拦截
+// BlacklistIntercept 检查用户或群是否在黑名单文件或数据库黑名单中，如果在，则发送预设消息
+func BlacklistIntercept(message structs.OnebotGroupMessage, selfid string, promptstr string) bool {
+	rule, blocked := blacklistRule(strconv.FormatInt(message.UserID, 10), strconv.FormatInt(message.GroupID, 10), selfid)
+	if !blocked {
+		return false // 用户和群都不在黑名单中，不拦截
 	}
 
-	// 检查用户ID是否在黑名单中
-	if IsInBlacklist(strconv.FormatInt(message.UserID, 10)) {
-		// 获取黑名单响应消息
-		responseMessage := config.GetBlacklistResponseMessages()
-
-		// 根据消息类型发送响应
-		if message.RealMessageType == "group_private" || message.MessageType == "private" {
-			if !config.GetUsePrivateSSE() {
-				SendPrivateMessage(message.UserID, responseMessage, selfid, promptstr)
-			} else {
-				SendSSEPrivateMessage(message.UserID, responseMessage, promptstr, selfid)
-			}
+	// 获取黑名单响应消息
+	responseMessage := RenderTemplate(config.GetBlacklistResponseMessages(), MessageTemplateVars(message, promptstr))
+
+	// 根据消息类型发送响应
+	if message.RealMessageType == "group_private" || message.MessageType == "private" {
+		if !config.GetUsePrivateSSE() {
+			SendPrivateMessage(message.UserID, responseMessage, selfid, promptstr)
 		} else {
-			SendGroupMessage(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
+			SendSSEPrivateMessage(message.UserID, responseMessage, promptstr, selfid)
 		}
-
-		fmt.Printf("userid:[%v]这位用户在黑名单中,被拦截\n", message.UserID)
-		return true // 拦截
+	} else {
+		SendGroupMessage(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
 	}
 
-	return false // 用户ID不在黑名单中，不拦截
+	event := ModerationEvent(message, selfid, promptstr, moderation.StageBlacklist)
+	event.Rule = rule
+	event.Original = message.RawMessage
+	event.Final = responseMessage
+	moderation.Record(event)
+
+	fmt.Printf("userid:[%v]groupid:[%v]命中黑名单%s,被拦截\n", message.UserID, message.GroupID, rule)
+	return true // 拦截
 }
 
-// BlacklistIntercept 检查用户ID是否在黑名单中，如果在，则发送预设消息
+// BlacklistInterceptSP 检查用户或群是否在黑名单文件或数据库黑名单中，如果在，则发送预设消息
 func BlacklistInterceptSP(message structs.OnebotGroupMessageS, selfid string, promptstr string) bool {
-	// 检查群ID是否在黑名单中
-	if IsInBlacklist(message.GroupID) {
-		// 获取黑名单响应消息
-		responseMessage := config.GetBlacklistResponseMessages()
-
-		// 根据消息类型发送响应
-		if message.RealMessageType == "group_private" || message.MessageType == "private" {
-			if !config.GetUsePrivateSSE() {
-				SendPrivateMessageSP(message.UserID, responseMessage, selfid, promptstr)
-			} else {
-				SendSSEPrivateMessageSP(message.UserID, responseMessage, promptstr, selfid)
-			}
-		} else {
-			SendGroupMessageSP(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
-		}
-
-		fmt.Printf("groupid:[%v]这个群在黑名单中,被拦截\n", message.GroupID)
-		return true // 拦截
+	rule, blocked := blacklistRule(message.UserID, message.GroupID, selfid)
+	if !blocked {
+		return false // 用户和群都不在黑名单中，不拦截
 	}
 
-	// 检查用户ID是否在黑名单中
-	if IsInBlacklist(message.UserID) {
-		// 获取黑名单响应消息
-		responseMessage := config.GetBlacklistResponseMessages()
-
-		// 根据消息类型发送响应
-		if message.RealMessageType == "group_private" || message.MessageType == "private" {
-			if !config.GetUsePrivateSSE() {
-				SendPrivateMessageSP(message.UserID, responseMessage, selfid, promptstr)
-			} else {
-				SendSSEPrivateMessageSP(message.UserID, responseMessage, promptstr, selfid)
-			}
+	// 获取黑名单响应消息
+	responseMessage := RenderTemplate(config.GetBlacklistResponseMessages(), MessageTemplateVarsSP(message, promptstr))
+
+	// 根据消息类型发送响应
+	if message.RealMessageType == "group_private" || message.MessageType == "private" {
+		if !config.GetUsePrivateSSE() {
+			SendPrivateMessageSP(message.UserID, responseMessage, selfid, promptstr)
 		} else {
-			SendGroupMessageSP(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
+			SendSSEPrivateMessageSP(message.UserID, responseMessage, promptstr, selfid)
 		}
-
-		fmt.Printf("userid:[%v]这位用户在黑名单中,被拦截\n", message.UserID)
-		return true // 拦截
+	} else {
+		SendGroupMessageSP(message.GroupID, message.UserID, responseMessage, selfid, promptstr)
 	}
 
-	return false // 用户ID不在黑名单中，不拦截
+	event := ModerationEventSP(message, selfid, promptstr, moderation.StageBlacklist)
+	event.Rule = rule
+	event.Original = message.RawMessage
+	event.Final = responseMessage
+	moderation.Record(event)
+
+	fmt.Printf("userid:[%v]groupid:[%v]命中黑名单%s,被拦截\n", message.UserID, message.GroupID, rule)
+	return true // 拦截
 }
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 内置的个人信息检测规则,含有分组时只替换第一个分组
+var builtinPIIDetectors = []structs.PIIPattern{
+	{Name: "email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	{Name: "idcard", Pattern: `[1-9]\d{5}(?:18|19|20)\d{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12]\d|3[01])\d{3}[\dXx]`},
+	{Name: "phone", Pattern: `(?:\+?86[- ]?)?1[3-9]\d(?:[- ]?\d{4}){2}`},
+	{Name: "qq", Pattern: `(?i)(?:qq|扣扣|企鹅)号?(?:码)?\s*[:：是为]?\s*([1-9]\d{4,10})`},
+}
+
+// 占位符中使用的类别名
+var piiLabels = map[string]string{
+	"email":  "EMAIL",
+	"idcard": "ID_CARD",
+	"phone":  "PHONE",
+	"qq":     "QQ",
+}
+
+// 自定义规则的名称中不能用于占位符的字符
+var piiLabelCleanRe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// 回复中的占位符
+var piiPlaceholderRe = regexp.MustCompile(`<[A-Z][A-Z0-9_]*_\d+>`)
+
+// 超过该时间没有对话的范围会被清除,之后的占位符重新编号
+const piiScopeIdle = 24 * time.Hour
+
+type piiDetector struct {
+	label string
+	re    *regexp.Regexp
+}
+
+type piiEntry struct {
+	placeholder string
+	value       string // 严格模式下不保存原文
+	owner       int64  // 发送该信息的用户,只向本人还原
+}
+
+// piiScope 一个对话上下文中的占位符,同一信息在上下文中始终使用同一个占位符
+type piiScope struct {
+	byValue       map[string]*piiEntry // 原文的摘要 -> 占位符
+	byPlaceholder map[string]*piiEntry
+	counters      map[string]int
+	lastUsed      time.Time
+}
+
+var (
+	piiMu        sync.Mutex
+	piiScopes    = make(map[string]*piiScope)
+	piiLastSweep time.Time
+
+	piiDetectorsMu     sync.Mutex
+	piiDetectorsSource string
+	piiDetectors       []piiDetector
+)
+
+// piiScopeKey groupContext为2时群内共用,私聊和群私聊时groupID传0,与发送回复时还原的范围一致
+func piiScopeKey(groupID int64, userID int64, selfid string) string {
+	if groupID != 0 && config.GetGroupContext() == 2 {
+		return fmt.Sprintf("group:%d:%s", groupID, selfid)
+	}
+	return fmt.Sprintf("user:%d:%s", userID, selfid)
+}
+
+// compiledPIIDetectors piiDetectors选择的内置规则加上piiPatterns,配置变化后重新编译
+func compiledPIIDetectors() []piiDetector {
+	names := config.GetPIIDetectors()
+	patterns := config.GetPIIPatterns()
+	source := fmt.Sprint(names, patterns)
+
+	piiDetectorsMu.Lock()
+	defer piiDetectorsMu.Unlock()
+	if piiDetectors != nil && source == piiDetectorsSource {
+		return piiDetectors
+	}
+
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		enabled[strings.ToLower(name)] = true
+	}
+	var selected []structs.PIIPattern
+	for _, detector := range builtinPIIDetectors {
+		if enabled[detector.Name] {
+			selected = append(selected, detector)
+		}
+	}
+	selected = append(selected, patterns...)
+
+	detectors := []piiDetector{}
+	for _, pattern := range selected {
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil || pattern.Name == "" {
+			fmtf.Printf("个人信息检测规则%s无效:%v\n", pattern.Name, err)
+			continue
+		}
+		label, ok := piiLabels[pattern.Name]
+		if !ok {
+			label = strings.ToUpper(piiLabelCleanRe.ReplaceAllString(pattern.Name, "_"))
+		}
+		detectors = append(detectors, piiDetector{label: label, re: re})
+	}
+	piiDetectors = detectors
+	piiDetectorsSource = source
+	return detectors
+}
+
+// overlapsPlaceholder 匹配是否与已有的占位符重叠,较宽的自定义规则不能再替换或破坏占位符
+func overlapsPlaceholder(spans [][]int, start int, end int) bool {
+	for _, span := range spans {
+		if start < span[1] && end > span[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// isDigitAt 用于数字类规则的边界判断,避免从更长的数字中截取
+func isDigitAt(text string, i int) bool {
+	return i >= 0 && i < len(text) && text[i] >= '0' && text[i] <= '9'
+}
+
+// placeholder 返回信息在该范围内的占位符,没有时分配新的编号
+func (s *piiScope) placeholder(label string, value string, owner int64, keepValue bool) string {
+	sum := sha256.Sum256([]byte(label + "\x00" + value))
+	digest := hex.EncodeToString(sum[:])
+	if entry, ok := s.byValue[digest]; ok {
+		return entry.placeholder
+	}
+	s.counters[label]++
+	entry := &piiEntry{placeholder: fmt.Sprintf("<%s_%d>", label, s.counters[label]), owner: owner}
+	if keepValue {
+		entry.value = value
+	}
+	s.byValue[digest] = entry
+	s.byPlaceholder[entry.placeholder] = entry
+	return entry.placeholder
+}
+
+// RedactPII 将发往大模型的文本中的个人信息替换为占位符,私聊时groupID传0
+func RedactPII(text string, groupID int64, userID int64, selfid string) string {
+	mode := config.GetPIIRedactMode()
+	if mode == 0 || text == "" {
+		return text
+	}
+	detectors := compiledPIIDetectors()
+	if len(detectors) == 0 {
+		return text
+	}
+
+	now := time.Now()
+	piiMu.Lock()
+	defer piiMu.Unlock()
+	if now.Sub(piiLastSweep) > time.Hour {
+		for key, scope := range piiScopes {
+			if now.Sub(scope.lastUsed) > piiScopeIdle {
+				delete(piiScopes, key)
+			}
+		}
+		piiLastSweep = now
+	}
+
+	key := piiScopeKey(groupID, userID, selfid)
+	scope, ok := piiScopes[key]
+	if !ok {
+		scope = &piiScope{
+			byValue:       make(map[string]*piiEntry),
+			byPlaceholder: make(map[string]*piiEntry),
+			counters:      make(map[string]int),
+		}
+		piiScopes[key] = scope
+	}
+	scope.lastUsed = now
+
+	count := 0
+	for _, detector := range detectors {
+		var builder strings.Builder
+		last := 0
+		placeholders := piiPlaceholderRe.FindAllStringIndex(text, -1)
+		for _, loc := range detector.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if len(loc) >= 4 && loc[2] >= 0 {
+				start, end = loc[2], loc[3]
+			}
+			if isDigitAt(text, start-1) || isDigitAt(text, end) || overlapsPlaceholder(placeholders, start, end) {
+				continue
+			}
+			builder.WriteString(text[last:start])
+			builder.WriteString(scope.placeholder(detector.label, text[start:end], userID, mode != 3))
+			last = end
+			count++
+		}
+		if last > 0 {
+			builder.WriteString(text[last:])
+			text = builder.String()
+		}
+	}
+	if count > 0 {
+		fmtf.Printf("已将%d处个人信息替换为占位符\n", count)
+	}
+	return text
+}
+
+// RestorePII 在发给用户的回复中还原该用户自己的个人信息,私聊时groupID传0
+// piiRedactMode为2时只在私聊中还原,为3时从不还原
+func RestorePII(text string, groupID int64, userID int64, selfid string) string {
+	mode := config.GetPIIRedactMode()
+	if mode != 1 && !(mode == 2 && groupID == 0) {
+		return text
+	}
+	if !strings.Contains(text, "<") {
+		return text
+	}
+
+	piiMu.Lock()
+	defer piiMu.Unlock()
+	scope, ok := piiScopes[piiScopeKey(groupID, userID, selfid)]
+	if !ok {
+		return text
+	}
+	return piiPlaceholderRe.ReplaceAllStringFunc(text, func(placeholder string) string {
+		entry, ok := scope.byPlaceholder[placeholder]
+		if !ok || entry.owner != userID || entry.value == "" {
+			return placeholder
+		}
+		return entry.value
+	})
+}
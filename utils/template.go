@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/config"
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+// 模板变量的写法 {{nickname}},变量名前后可以有空格
+const (
+	templateOpen  = "{{"
+	templateClose = "}}"
+)
+
+var weekdayNames = [...]string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"}
+
+// TemplateVars 不依赖剧情存档的模板变量:发送者昵称、群名片、用户ID、群号、机器人名字、日期、时间和星期
+func TemplateVars(nickname string, card string, userID string, groupID string, promptstr string) map[string]string {
+	now := time.Now()
+	if card == "" {
+		card = nickname
+	}
+	return map[string]string{
+		"nickname": nickname,
+		"card":     card,
+		"user_id":  userID,
+		"group_id": groupID,
+		"bot_name": config.GetBotName(promptstr),
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+		"weekday":  weekdayNames[now.Weekday()],
+	}
+}
+
+// MessageTemplateVars 消息的模板变量
+func MessageTemplateVars(message structs.OnebotGroupMessage, promptstr string) map[string]string {
+	groupID := ""
+	if message.GroupID != 0 {
+		groupID = strconv.FormatInt(message.GroupID, 10)
+	}
+	return TemplateVars(message.Sender.Nickname, message.Sender.Card, strconv.FormatInt(message.UserID, 10), groupID, promptstr)
+}
+
+// MessageTemplateVarsSP 消息的模板变量
+func MessageTemplateVarsSP(message structs.OnebotGroupMessageS, promptstr string) map[string]string {
+	return TemplateVars(message.Sender.Nickname, message.Sender.Card, message.UserID, message.GroupID, promptstr)
+}
+
+// RenderTemplate 替换文本中的{{变量}},未知的变量保持原样
+func RenderTemplate(text string, vars map[string]string) string {
+	if !strings.Contains(text, templateOpen) {
+		return text
+	}
+	var builder strings.Builder
+	for {
+		start := strings.Index(text, templateOpen)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start+len(templateOpen):], templateClose)
+		if end < 0 {
+			break
+		}
+		end += start + len(templateOpen)
+		name := strings.TrimSpace(text[start+len(templateOpen) : end])
+		builder.WriteString(text[:start])
+		if value, ok := vars[name]; ok {
+			builder.WriteString(value)
+		} else {
+			builder.WriteString(text[start : end+len(templateClose)])
+		}
+		text = text[end+len(templateClose):]
+	}
+	builder.WriteString(text)
+	return builder.String()
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-llm/structs"
+)
+
+func TestRenderTemplateMessageVars(t *testing.T) {
+	message := structs.OnebotGroupMessage{
+		UserID: 123456,
+		Sender: structs.Sender{Nickname: "灵梦"},
+	}
+	vars := MessageTemplateVars(message, "")
+
+	got := RenderTemplate("{{ nickname }}({{card}}),用户{{user_id}},群[{{group_id}}]", vars)
+	// 没有群名片时使用昵称,私聊时群号为空
+	if want := "灵梦(灵梦),用户123456,群[]"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+
+	message.GroupID = 789
+	message.Sender.Card = "巫女"
+	got = RenderTemplate("{{card}}在群{{group_id}}", MessageTemplateVars(message, ""))
+	if want := "巫女在群789"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"date", "time", "weekday"} {
+		if vars[name] == "" {
+			t.Errorf("template var %s is empty", name)
+		}
+	}
+}
+
+func TestRenderTemplateKeepsUnknownText(t *testing.T) {
+	vars := map[string]string{"name": "灵梦"}
+
+	if got := RenderTemplate("没有变量", vars); got != "没有变量" {
+		t.Errorf("text without vars changed to %q", got)
+	}
+	// 未知变量原样保留,方便发现写错的变量名
+	if got := RenderTemplate("{{nmae}}和{{name}}", vars); got != "{{nmae}}和灵梦" {
+		t.Errorf("unknown var rendered as %q", got)
+	}
+	if got := RenderTemplate("{{name", vars); got != "{{name" {
+		t.Errorf("unclosed var rendered as %q", got)
+	}
+}
+
+func TestRenderTemplateDoesNotRenderValues(t *testing.T) {
+	// 昵称由用户决定,其中的{{...}}不能再次被替换
+	vars := map[string]string{"nickname": "{{bot_name}}", "bot_name": "小千"}
+	if got := RenderTemplate("你好{{nickname}},我是{{bot_name}}", vars); got != "你好{{bot_name}},我是小千" {
+		t.Errorf("rendered %q", got)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/hoshinonyaruko/gensokyo-llm/config"
 	"github.com/hoshinonyaruko/gensokyo-llm/fmtf"
 	"github.com/hoshinonyaruko/gensokyo-llm/hunyuan"
+	"github.com/hoshinonyaruko/gensokyo-llm/moderation"
 	"github.com/hoshinonyaruko/gensokyo-llm/promptkb"
 	"github.com/hoshinonyaruko/gensokyo-llm/server"
 	"github.com/hoshinonyaruko/gensokyo-llm/structs"
@@ -256,8 +257,19 @@ func ExtractEventDetails(eventData map[string]interface{}) (string, structs.Usag
 }
 
 func SendGroupMessage(groupID int64, userID int64, message string, selfid string, promptstr string) error {
+	return sendGroupMessage(groupID, userID, message, selfid, promptstr, false)
+}
+
+// SendGroupMessageStream 发送流式回复中的一段,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendGroupMessageStream(groupID int64, userID int64, message string, selfid string, promptstr string) error {
+	return sendGroupMessage(groupID, userID, message, selfid, promptstr, true)
+}
+
+func sendGroupMessage(groupID int64, userID int64, message string, selfid string, promptstr string, stream bool) error {
 	//TODO: 用userid作为了echo,在ws收到回调信息的时候,加入到全局撤回数组,AddMessageID,实现撤回
 	if server.IsSelfIDExists(selfid) {
+		// 反向ws连接同样需要还原本人的个人信息占位符
+		message = RestorePII(message, groupID, userID, selfid)
 		// 创建消息结构体
 		msg := map[string]interface{}{
 			"action": "send_group_msg",
@@ -299,9 +311,15 @@ func SendGroupMessage(groupID int64, userID int64, message string, selfid string
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, strconv.FormatInt(userID, 10), strconv.FormatInt(groupID, 10), selfid, stream); !send {
+			return nil
+		}
 	}
 
+	// 还原本人的个人信息占位符
+	message = RestorePII(message, groupID, userID, selfid)
+
 	// 是否不显示Emoji
 	if config.GetNoEmoji(promptstr) == 2 {
 		message = RemoveEmojis(message)
@@ -366,6 +384,15 @@ func SendGroupMessage(groupID int64, userID int64, message string, selfid string
 }
 
 func SendGroupMessageSP(groupID string, userID string, message string, selfid string, promptstr string) error {
+	return sendGroupMessageSP(groupID, userID, message, selfid, promptstr, false)
+}
+
+// SendGroupMessageStreamSP 发送流式回复中的一段,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendGroupMessageStreamSP(groupID string, userID string, message string, selfid string, promptstr string) error {
+	return sendGroupMessageSP(groupID, userID, message, selfid, promptstr, true)
+}
+
+func sendGroupMessageSP(groupID string, userID string, message string, selfid string, promptstr string, stream bool) error {
 	//TODO: 用userid作为了echo,在ws收到回调信息的时候,加入到全局撤回数组,AddMessageID,实现撤回
 	if server.IsSelfIDExists(selfid) {
 		// 创建消息结构体
@@ -409,7 +436,10 @@ func SendGroupMessageSP(groupID string, userID string, message string, selfid st
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, userID, groupID, selfid, stream); !send {
+			return nil
+		}
 	}
 
 	// 是否不显示Emoji
@@ -476,8 +506,19 @@ func SendGroupMessageSP(groupID string, userID string, message string, selfid st
 }
 
 func SendGroupMessageMdPromptKeyboard(groupID int64, userID int64, message string, selfid string, newmsg string, response string, promptstr string) error {
+	return sendGroupMessageMdPromptKeyboard(groupID, userID, message, selfid, newmsg, response, promptstr, false)
+}
+
+// SendGroupMessageMdPromptKeyboardStream 发送流式回复的最后一段并附带按钮,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendGroupMessageMdPromptKeyboardStream(groupID int64, userID int64, message string, selfid string, newmsg string, response string, promptstr string) error {
+	return sendGroupMessageMdPromptKeyboard(groupID, userID, message, selfid, newmsg, response, promptstr, true)
+}
+
+func sendGroupMessageMdPromptKeyboard(groupID int64, userID int64, message string, selfid string, newmsg string, response string, promptstr string, stream bool) error {
 	//TODO: 用userid作为了echo,在ws收到回调信息的时候,加入到全局撤回数组,AddMessageID,实现反向ws连接时候的撤回
 	if server.IsSelfIDExists(selfid) {
+		// 反向ws连接同样需要还原本人的个人信息占位符
+		message = RestorePII(message, groupID, userID, selfid)
 		// 创建消息结构体
 		msg := map[string]interface{}{
 			"action": "send_group_msg",
@@ -519,9 +560,15 @@ func SendGroupMessageMdPromptKeyboard(groupID int64, userID int64, message strin
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, strconv.FormatInt(userID, 10), strconv.FormatInt(groupID, 10), selfid, stream); !send {
+			return nil
+		}
 	}
 
+	// 还原本人的个人信息占位符
+	message = RestorePII(message, groupID, userID, selfid)
+
 	// 是否不显示Emoji
 	if config.GetNoEmoji(promptstr) == 2 {
 		message = RemoveEmojis(message)
@@ -736,6 +783,15 @@ func SendGroupMessageMdPromptKeyboard(groupID int64, userID int64, message strin
 }
 
 func SendGroupMessageMdPromptKeyboardSP(groupID string, userID string, message string, selfid string, newmsg string, response string, promptstr string) error {
+	return sendGroupMessageMdPromptKeyboardSP(groupID, userID, message, selfid, newmsg, response, promptstr, false)
+}
+
+// SendGroupMessageMdPromptKeyboardStreamSP 发送流式回复的最后一段并附带按钮,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendGroupMessageMdPromptKeyboardStreamSP(groupID string, userID string, message string, selfid string, newmsg string, response string, promptstr string) error {
+	return sendGroupMessageMdPromptKeyboardSP(groupID, userID, message, selfid, newmsg, response, promptstr, true)
+}
+
+func sendGroupMessageMdPromptKeyboardSP(groupID string, userID string, message string, selfid string, newmsg string, response string, promptstr string, stream bool) error {
 	//TODO: 用userid作为了echo,在ws收到回调信息的时候,加入到全局撤回数组,AddMessageID,实现反向ws连接时候的撤回
 	if server.IsSelfIDExists(selfid) {
 		// 创建消息结构体
@@ -779,7 +835,10 @@ func SendGroupMessageMdPromptKeyboardSP(groupID string, userID string, message s
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, userID, groupID, selfid, stream); !send {
+			return nil
+		}
 	}
 
 	// 是否不显示Emoji
@@ -1011,6 +1070,8 @@ func SendGroupMessageMdPromptKeyboardSP(groupID string, userID string, message s
 func SendGroupMessageMdPromptKeyboardV2(groupID int64, userID int64, message string, selfid string, promptstr string, promptkeyboard []string) error {
 	//TODO: 用userid作为了echo,在ws收到回调信息的时候,加入到全局撤回数组,AddMessageID,实现反向ws连接时候的撤回
 	if server.IsSelfIDExists(selfid) {
+		// 反向ws连接同样需要还原本人的个人信息占位符
+		message = RestorePII(message, groupID, userID, selfid)
 		// 创建消息结构体
 		msg := map[string]interface{}{
 			"action": "send_group_msg",
@@ -1052,9 +1113,15 @@ func SendGroupMessageMdPromptKeyboardV2(groupID int64, userID int64, message str
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUTPrompt(message, promptstr, strconv.FormatInt(userID, 10), strconv.FormatInt(groupID, 10), selfid); !send {
+			return nil
+		}
 	}
 
+	// 还原本人的个人信息占位符
+	message = RestorePII(message, groupID, userID, selfid)
+
 	// 是否不显示Emoji
 	if config.GetNoEmoji(promptstr) == 2 {
 		message = RemoveEmojis(message)
@@ -1265,7 +1332,10 @@ func SendGroupMessageMdPromptKeyboardV2SP(groupID string, userID string, message
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUTPrompt(message, promptstr, userID, groupID, selfid); !send {
+			return nil
+		}
 	}
 
 	// 是否不显示Emoji
@@ -1435,7 +1505,18 @@ func SendGroupMessageMdPromptKeyboardV2SP(groupID string, userID string, message
 }
 
 func SendPrivateMessage(UserID int64, message string, selfid string, promptstr string) error {
+	return sendPrivateMessage(UserID, message, selfid, promptstr, false)
+}
+
+// SendPrivateMessageStream 发送流式回复中的一段,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendPrivateMessageStream(UserID int64, message string, selfid string, promptstr string) error {
+	return sendPrivateMessage(UserID, message, selfid, promptstr, true)
+}
+
+func sendPrivateMessage(UserID int64, message string, selfid string, promptstr string, stream bool) error {
 	if server.IsSelfIDExists(selfid) {
+		// 反向ws连接同样需要还原本人的个人信息占位符
+		message = RestorePII(message, 0, UserID, selfid)
 		// 创建消息结构体
 		msg := map[string]interface{}{
 			"action": "send_private_msg",
@@ -1476,9 +1557,15 @@ func SendPrivateMessage(UserID int64, message string, selfid string, promptstr s
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, strconv.FormatInt(UserID, 10), "", selfid, stream); !send {
+			return nil
+		}
 	}
 
+	// 还原本人的个人信息占位符
+	message = RestorePII(message, 0, UserID, selfid)
+
 	// 是否不显示Emoji
 	if config.GetNoEmoji(promptstr) == 2 {
 		message = RemoveEmojis(message)
@@ -1542,6 +1629,15 @@ func SendPrivateMessage(UserID int64, message string, selfid string, promptstr s
 }
 
 func SendPrivateMessageSP(UserID string, message string, selfid string, promptstr string) error {
+	return sendPrivateMessageSP(UserID, message, selfid, promptstr, false)
+}
+
+// SendPrivateMessageStreamSP 发送流式回复中的一段,敏感词只进行替换,block和reply的词库只对整条消息生效
+func SendPrivateMessageStreamSP(UserID string, message string, selfid string, promptstr string) error {
+	return sendPrivateMessageSP(UserID, message, selfid, promptstr, true)
+}
+
+func sendPrivateMessageSP(UserID string, message string, selfid string, promptstr string, stream bool) error {
 	if server.IsSelfIDExists(selfid) {
 		// 创建消息结构体
 		msg := map[string]interface{}{
@@ -1583,7 +1679,10 @@ func SendPrivateMessageSP(UserID string, message string, selfid string, promptst
 	u.RawQuery = query.Encode()
 
 	if config.GetSensitiveModeType() == 1 {
-		message = acnode.CheckWordOUT(message)
+		var send bool
+		if message, send = checkWordOUT(message, promptstr, UserID, "", selfid, stream); !send {
+			return nil
+		}
 	}
 
 	// 是否不显示Emoji
@@ -1767,9 +1866,12 @@ func SendPrivateMessageSSE(UserID int64, message structs.InterfaceBody, promptst
 
 	// 检查是否需要启用敏感词过滤
 	if config.GetSensitiveModeType() == 1 && message.Content != "" {
-		message.Content = acnode.CheckWordOUT(message.Content)
+		message.Content = checkWordOUTStream(message.Content, promptstr, strconv.FormatInt(UserID, 10), "", selfid)
 	}
 
+	// 还原本人的个人信息占位符
+	message.Content = RestorePII(message.Content, 0, UserID, selfid)
+
 	// 是否不显示Emoji
 	if config.GetNoEmoji(promptstr) == 2 {
 		message.Content = RemoveEmojis(message.Content)
@@ -1877,7 +1979,7 @@ func SendPrivateMessageSSESP(UserID string, message structs.InterfaceBody, promp
 
 	// 检查是否需要启用敏感词过滤
 	if config.GetSensitiveModeType() == 1 && message.Content != "" {
-		message.Content = acnode.CheckWordOUT(message.Content)
+		message.Content = checkWordOUTStream(message.Content, promptstr, UserID, "", selfid)
 	}
 
 	// 是否不显示Emoji
@@ -2832,10 +2934,16 @@ func LanguageIntercept(text string, message structs.OnebotGroupMessage, selfid s
 	}
 
 	// 语言不允许，进行拦截
-	responseMessage := config.GetLanguagesResponseMessages()
+	responseMessage := RenderTemplate(config.GetLanguagesResponseMessages(), MessageTemplateVars(message, promptstr))
 	friendlyName := FriendlyLanguageNameCN(info.Lang)
 	responseMessage = strings.Replace(responseMessage, "**", friendlyName, -1)
 
+	event := ModerationEvent(message, selfid, promptstr, moderation.StageLanguage)
+	event.Rule = lang
+	event.Original = text
+	event.Final = responseMessage
+	moderation.Record(event)
+
 	// 发送响应消息
 	if message.RealMessageType == "group_private" || message.MessageType == "private" {
 		if !config.GetUsePrivateSSE() {
@@ -2869,10 +2977,16 @@ func LanguageInterceptSP(text string, message structs.OnebotGroupMessageS, selfi
 	}
 
 	// 语言不允许，进行拦截
-	responseMessage := config.GetLanguagesResponseMessages()
+	responseMessage := RenderTemplate(config.GetLanguagesResponseMessages(), MessageTemplateVarsSP(message, promptstr))
 	friendlyName := FriendlyLanguageNameCN(info.Lang)
 	responseMessage = strings.Replace(responseMessage, "**", friendlyName, -1)
 
+	event := ModerationEventSP(message, selfid, promptstr, moderation.StageLanguage)
+	event.Rule = lang
+	event.Original = text
+	event.Final = responseMessage
+	moderation.Record(event)
+
 	// 发送响应消息
 	if message.RealMessageType == "group_private" || message.MessageType == "private" {
 		if !config.GetUsePrivateSSE() {
@@ -2928,7 +3042,13 @@ func LengthIntercept(text string, message structs.OnebotGroupMessage, selfid str
 	maxLen := config.GetQuestionMaxLenth()
 	if len(text) > maxLen {
 		// 长度超出限制，获取并发送响应消息
-		responseMessage := config.GetQmlResponseMessages()
+		responseMessage := RenderTemplate(config.GetQmlResponseMessages(), MessageTemplateVars(message, promptstr))
+		event := ModerationEvent(message, selfid, promptstr, moderation.StageLength)
+		event.Rule = "questionMaxLenth:" + strconv.Itoa(maxLen)
+		event.Score = float64(len(text))
+		event.Original = text
+		event.Final = responseMessage
+		moderation.Record(event)
 
 		// 根据消息类型发送响应
 		if message.RealMessageType == "group_private" || message.MessageType == "private" {
@@ -2951,7 +3071,13 @@ func LengthInterceptSP(text string, message structs.OnebotGroupMessageS, selfid
 	maxLen := config.GetQuestionMaxLenth()
 	if len(text) > maxLen {
 		// 长度超出限制，获取并发送响应消息
-		responseMessage := config.GetQmlResponseMessages()
+		responseMessage := RenderTemplate(config.GetQmlResponseMessages(), MessageTemplateVarsSP(message, promptstr))
+		event := ModerationEventSP(message, selfid, promptstr, moderation.StageLength)
+		event.Rule = "questionMaxLenth:" + strconv.Itoa(maxLen)
+		event.Score = float64(len(text))
+		event.Original = text
+		event.Final = responseMessage
+		moderation.Record(event)
 
 		// 根据消息类型发送响应
 		if message.RealMessageType == "group_private" || message.MessageType == "private" {
@@ -3305,3 +3431,73 @@ func FilterSimplifiedChinese(input string) string {
 	}
 	return string(result)
 }
+
+// ModerationEvent 根据消息生成拦截记录的公共字段
+func ModerationEvent(message structs.OnebotGroupMessage, selfid string, promptstr string, stage string) moderation.Event {
+	return moderation.Event{
+		UserID:  strconv.FormatInt(message.UserID, 10),
+		GroupID: strconv.FormatInt(message.GroupID, 10),
+		SelfID:  selfid,
+		Prompt:  promptstr,
+		Stage:   stage,
+	}
+}
+
+// ModerationEventSP 根据消息生成拦截记录的公共字段
+func ModerationEventSP(message structs.OnebotGroupMessageS, selfid string, promptstr string, stage string) moderation.Event {
+	return moderation.Event{
+		UserID:  message.UserID,
+		GroupID: message.GroupID,
+		SelfID:  selfid,
+		Prompt:  promptstr,
+		Stage:   stage,
+	}
+}
+
+// checkWordOUTPrompt 使用全局词库和提示词的词库过滤输出,整条消息被拦截时改为设置的回复,没有回复时send为false
+func checkWordOUTPrompt(message string, promptstr string, userID string, groupID string, selfid string) (string, bool) {
+	checkResult := acnode.CheckWordOUTPrompt(message, config.GetSensitiveDicts(promptstr))
+	recordWordOUT(checkResult, message, promptstr, userID, groupID, selfid)
+	if !checkResult.Blocked {
+		return checkResult.Text, true
+	}
+	if checkResult.Reply == "" {
+		return "", false
+	}
+	return checkResult.Reply, true
+}
+
+// checkWordOUT 过滤输出,stream为true时message是流式回复中的一段,只进行替换
+func checkWordOUT(message string, promptstr string, userID string, groupID string, selfid string, stream bool) (string, bool) {
+	if stream {
+		return checkWordOUTStream(message, promptstr, userID, groupID, selfid), true
+	}
+	return checkWordOUTPrompt(message, promptstr, userID, groupID, selfid)
+}
+
+// checkWordOUTStream 过滤useSse为2时的一段流式消息,只进行替换,block和reply的词库不生效
+func checkWordOUTStream(message string, promptstr string, userID string, groupID string, selfid string) string {
+	checkResult := acnode.CheckWordOUTStream(message, config.GetSensitiveDicts(promptstr))
+	recordWordOUT(checkResult, message, promptstr, userID, groupID, selfid)
+	return checkResult.Text
+}
+
+// recordWordOUT 输出命中词库时记录拦截事件
+func recordWordOUT(checkResult acnode.CheckResult, message string, promptstr string, userID string, groupID string, selfid string) {
+	if len(checkResult.Hits) > 0 {
+		final := checkResult.Text
+		if checkResult.Blocked {
+			final = checkResult.Reply
+		}
+		moderation.Record(moderation.Event{
+			UserID:   userID,
+			GroupID:  groupID,
+			SelfID:   selfid,
+			Prompt:   promptstr,
+			Stage:    moderation.StageWordOut,
+			Rule:     strings.Join(checkResult.Hits, ","),
+			Original: message,
+			Final:    final,
+		})
+	}
+}